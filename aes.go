@@ -0,0 +1,268 @@
+package memguard
+
+/*
+AESBlock is an implementation of the AES block cipher, satisfying the crypto/cipher.Block interface, that keeps its expanded key inside a LockedBuffer.
+
+Unlike the block returned by crypto/aes.NewCipher, whose key schedule lives on the regular heap where the garbage collector can copy it around and it can end up in core dumps, the round keys of an AESBlock are protected in the same way as any other LockedBuffer and are wiped when the AESBlock is destroyed. An AESBlock can be used anywhere that a cipher.Block is accepted, such as with cipher.NewGCM.
+
+The implementation is written in pure Go and does not make use of hardware acceleration, so it is considerably slower than crypto/aes. It is constant-time: the S-box is computed with branch-free arithmetic instead of being looked up in a table, so neither the key nor the data can be learnt from which memory is accessed or from cache timing.
+*/
+type AESBlock struct {
+	roundKeys *LockedBuffer // The expanded key.
+	rounds    int           // Number of rounds, which depends on the key size.
+}
+
+/*
+NewAESBlock expands a 16, 24, or 32 byte key into a new AESBlock, selecting AES-128, AES-192, or AES-256 respectively. The key itself is left untouched.
+
+If the key is not one of those sizes, the call will return an ErrInvalidKeySize. If the key has been destroyed, the call will return an ErrDestroyed.
+*/
+func NewAESBlock(key *LockedBuffer) (*AESBlock, error) {
+	// Get a mutex lock on the key.
+	key.Lock()
+	defer key.Unlock()
+
+	// Check if it's destroyed.
+	if len(key.buffer) == 0 {
+		return nil, ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if key.hidden {
+		return nil, ErrHidden
+	}
+
+	return newAESBlock(key.buffer)
+}
+
+// Expand a key into a new AESBlock. The caller must stop the key from changing or being destroyed while this happens.
+func newAESBlock(key []byte) (*AESBlock, error) {
+	// Check that it's a valid size.
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, ErrInvalidKeySize
+	}
+
+	// Create an immutable LockedBuffer holding the round keys, expanding the key into it before it's protected.
+	rounds := len(key)/4 + 6
+	roundKeys, err := newFilledContainer(16*(rounds+1), false, false, func(buf []byte) error {
+		expandAESKey(buf, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &AESBlock{roundKeys, rounds}, nil
+}
+
+/*
+BlockSize returns the AES block size, which is 16 bytes.
+*/
+func (c *AESBlock) BlockSize() int {
+	return 16
+}
+
+/*
+Encrypt encrypts the first block of src into dst. Just like the other implementations of cipher.Block, it panics if either slice is shorter than a block, and it also panics if the AESBlock has been destroyed.
+*/
+func (c *AESBlock) Encrypt(dst, src []byte) {
+	// Check that there's a whole block to work on.
+	if len(src) < 16 || len(dst) < 16 {
+		panic("memguard.AESBlock: input not full block")
+	}
+
+	// Get a mutex lock on the round keys.
+	c.roundKeys.Lock()
+	defer c.roundKeys.Unlock()
+
+	// Check if they're destroyed.
+	if len(c.roundKeys.buffer) == 0 {
+		panic("memguard.AESBlock: block has been destroyed")
+	}
+
+	// Load the state, making sure that it doesn't outlive this call.
+	var s [16]byte
+	copy(s[:], src)
+	defer wipeBytes(s[:])
+
+	rk := c.roundKeys.buffer
+	addRoundKey(&s, rk[:16])
+	for r := 1; r < c.rounds; r++ {
+		subBytes(&s)
+		shiftRows(&s)
+		mixColumns(&s)
+		addRoundKey(&s, rk[16*r:16*(r+1)])
+	}
+	subBytes(&s)
+	shiftRows(&s)
+	addRoundKey(&s, rk[16*c.rounds:])
+
+	copy(dst, s[:])
+}
+
+/*
+Decrypt decrypts the first block of src into dst. Just like the other implementations of cipher.Block, it panics if either slice is shorter than a block, and it also panics if the AESBlock has been destroyed.
+*/
+func (c *AESBlock) Decrypt(dst, src []byte) {
+	// Check that there's a whole block to work on.
+	if len(src) < 16 || len(dst) < 16 {
+		panic("memguard.AESBlock: input not full block")
+	}
+
+	// Get a mutex lock on the round keys.
+	c.roundKeys.Lock()
+	defer c.roundKeys.Unlock()
+
+	// Check if they're destroyed.
+	if len(c.roundKeys.buffer) == 0 {
+		panic("memguard.AESBlock: block has been destroyed")
+	}
+
+	// Load the state, making sure that it doesn't outlive this call.
+	var s [16]byte
+	copy(s[:], src)
+	defer wipeBytes(s[:])
+
+	rk := c.roundKeys.buffer
+	addRoundKey(&s, rk[16*c.rounds:])
+	for r := c.rounds - 1; r > 0; r-- {
+		invShiftRows(&s)
+		invSubBytes(&s)
+		addRoundKey(&s, rk[16*r:16*(r+1)])
+		invMixColumns(&s)
+	}
+	invShiftRows(&s)
+	invSubBytes(&s)
+	addRoundKey(&s, rk[:16])
+
+	copy(dst, s[:])
+}
+
+/*
+Destroy wipes and frees the expanded key. The AESBlock cannot be used afterwards.
+*/
+func (c *AESBlock) Destroy() {
+	c.roundKeys.Destroy()
+}
+
+// Rotate a byte left by n bits.
+func rotl8(x byte, n uint) byte {
+	return x<<n | x>>(8-n)
+}
+
+// Find the multiplicative inverse of an element of GF(2^8), or zero for zero, by raising it to the power of 254. Every step is a call to gmul, so the time taken does not depend on the value.
+func ginv(x byte) byte {
+	x2 := gmul(x, x)
+	x3 := gmul(x2, x)
+	x12 := gmul(x3, x3)
+	x12 = gmul(x12, x12)
+	x15 := gmul(x12, x3)
+	x240 := x15
+	for i := 0; i < 4; i++ {
+		x240 = gmul(x240, x240)
+	}
+	return gmul(gmul(x240, x12), x2)
+}
+
+// Apply the AES S-box to a byte by inverting it and then applying the affine transformation, without using a table.
+func aesSub(x byte) byte {
+	q := ginv(x)
+	return q ^ rotl8(q, 1) ^ rotl8(q, 2) ^ rotl8(q, 3) ^ rotl8(q, 4) ^ 0x63
+}
+
+// Apply the inverse of the AES S-box to a byte by undoing the affine transformation and then inverting it, without using a table.
+func aesInvSub(x byte) byte {
+	return ginv(rotl8(x, 1) ^ rotl8(x, 3) ^ rotl8(x, 6) ^ 0x05)
+}
+
+// Expand an AES key into the round keys, writing them into dst.
+func expandAESKey(dst, key []byte) {
+	nk := len(key) / 4
+	copy(dst, key)
+
+	var t [4]byte
+	rcon := byte(1)
+	for i := nk; i < len(dst)/4; i++ {
+		copy(t[:], dst[4*(i-1):4*i])
+		if i%nk == 0 {
+			t[0], t[1], t[2], t[3] = aesSub(t[1])^rcon, aesSub(t[2]), aesSub(t[3]), aesSub(t[0])
+			rcon = gmul(rcon, 2)
+		} else if nk > 6 && i%nk == 4 {
+			t[0], t[1], t[2], t[3] = aesSub(t[0]), aesSub(t[1]), aesSub(t[2]), aesSub(t[3])
+		}
+		for j := 0; j < 4; j++ {
+			dst[4*i+j] = dst[4*(i-nk)+j] ^ t[j]
+		}
+	}
+	wipeBytes(t[:])
+}
+
+// Multiply two elements of GF(2^8) without branching on either of them.
+func gmul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		p ^= -(b & 1) & a
+		a = a<<1 ^ -(a>>7)&0x1b
+		b >>= 1
+	}
+	return p
+}
+
+func addRoundKey(s *[16]byte, rk []byte) {
+	for i := range s {
+		s[i] ^= rk[i]
+	}
+}
+
+func subBytes(s *[16]byte) {
+	for i := range s {
+		s[i] = aesSub(s[i])
+	}
+}
+
+func invSubBytes(s *[16]byte) {
+	for i := range s {
+		s[i] = aesInvSub(s[i])
+	}
+}
+
+// The state is stored column by column, so row r of column c is at index 4*c+r.
+func shiftRows(s *[16]byte) {
+	t := *s
+	for c := 0; c < 4; c++ {
+		for r := 1; r < 4; r++ {
+			s[4*c+r] = t[4*((c+r)%4)+r]
+		}
+	}
+}
+
+func invShiftRows(s *[16]byte) {
+	t := *s
+	for c := 0; c < 4; c++ {
+		for r := 1; r < 4; r++ {
+			s[4*((c+r)%4)+r] = t[4*c+r]
+		}
+	}
+}
+
+func mixColumns(s *[16]byte) {
+	for c := 0; c < 16; c += 4 {
+		a0, a1, a2, a3 := s[c], s[c+1], s[c+2], s[c+3]
+		s[c] = gmul(a0, 2) ^ gmul(a1, 3) ^ a2 ^ a3
+		s[c+1] = a0 ^ gmul(a1, 2) ^ gmul(a2, 3) ^ a3
+		s[c+2] = a0 ^ a1 ^ gmul(a2, 2) ^ gmul(a3, 3)
+		s[c+3] = gmul(a0, 3) ^ a1 ^ a2 ^ gmul(a3, 2)
+	}
+}
+
+func invMixColumns(s *[16]byte) {
+	for c := 0; c < 16; c += 4 {
+		a0, a1, a2, a3 := s[c], s[c+1], s[c+2], s[c+3]
+		s[c] = gmul(a0, 14) ^ gmul(a1, 11) ^ gmul(a2, 13) ^ gmul(a3, 9)
+		s[c+1] = gmul(a0, 9) ^ gmul(a1, 14) ^ gmul(a2, 11) ^ gmul(a3, 13)
+		s[c+2] = gmul(a0, 13) ^ gmul(a1, 9) ^ gmul(a2, 14) ^ gmul(a3, 11)
+		s[c+3] = gmul(a0, 11) ^ gmul(a1, 13) ^ gmul(a2, 9) ^ gmul(a3, 14)
+	}
+}
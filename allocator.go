@@ -0,0 +1,183 @@
+package memguard
+
+import (
+	"sync"
+	"unsafe"
+
+	"github.com/awnumar/memguard/memcall"
+)
+
+/*
+Allocator is the interface to the system calls that memguard uses to manage the memory of LockedBuffers. By default the memcall package is used, but SetAllocator can be used to replace it, such as with a mock that simulates failures in tests, or with a custom arena.
+
+All slices passed to the methods, other than Alloc, lie within memory that was returned by Alloc. Protect and Unlock are only ever given whole pages. Alloc must return memory that is aligned to a page boundary, and each slice that it returns is given back to Free exactly once. If Free, Unlock, or Protect return an error, memguard panics, since it cannot go on safely.
+*/
+type Allocator interface {
+	// Alloc allocates n bytes of readable and writable memory.
+	Alloc(n int) ([]byte, error)
+
+	// Free releases memory that was allocated with Alloc.
+	Free(b []byte) error
+
+	// Lock stops memory from being swapped out to disk.
+	Lock(b []byte) error
+
+	// Unlock undoes Lock.
+	Unlock(b []byte) error
+
+	// Protect sets whether memory can be read and written.
+	Protect(b []byte, read, write bool) error
+}
+
+// The default Allocator, which uses the memcall package.
+var defaultAllocator Allocator = memcallAllocator{}
+
+// memcallAllocator implements Allocator with the memcall package, which panics by itself if anything goes wrong with the calls that don't return an error.
+type memcallAllocator struct{}
+
+func (memcallAllocator) Alloc(n int) ([]byte, error) {
+	return memcall.Alloc(n)
+}
+
+func (memcallAllocator) Free(b []byte) error {
+	memcall.Free(b)
+	return nil
+}
+
+func (memcallAllocator) Lock(b []byte) error {
+	return memcall.Lock(b)
+}
+
+func (memcallAllocator) Unlock(b []byte) error {
+	memcall.Unlock(b)
+	return nil
+}
+
+func (memcallAllocator) Protect(b []byte, read, write bool) error {
+	memcall.Protect(b, read, write)
+	return nil
+}
+
+/*
+SetAllocator replaces the Allocator that is used for the memory of LockedBuffers created from now on. LockedBuffers that already exist, and slabs that already exist, carry on using the Allocator that they were created with until they are destroyed.
+
+Some features rely on the memcall package directly, so they are only available with the default Allocator: huge pages fall back to normal pages, and memory is only explicitly excluded from core dumps, and checked to be lockable at all before it is allocated, when the default is in use.
+
+Calling SetAllocator with nil restores the default.
+*/
+func SetAllocator(a Allocator) {
+	allocatorMutex.Lock()
+	defer allocatorMutex.Unlock()
+
+	if a == nil {
+		a = defaultAllocator
+	}
+	allocator = a
+}
+
+// Get the Allocator to use for new memory.
+func getAllocator() Allocator {
+	allocatorMutex.Lock()
+	defer allocatorMutex.Unlock()
+
+	return allocator
+}
+
+// Check whether an Allocator is the default one.
+func isDefaultAllocator(a Allocator) bool {
+	_, ok := a.(memcallAllocator)
+	return ok
+}
+
+// Keep memory out of core dumps, and have it wiped in the children of a fork if that's enabled, if the Allocator is the default one. Kernels that can't wipe memory on fork are ignored.
+func dontDump(a Allocator, b []byte) error {
+	if !isDefaultAllocator(a) {
+		return nil
+	}
+	if getWipeOnFork() {
+		memcall.WipeOnFork(b)
+	}
+	return memcall.DontDump(b)
+}
+
+// Change the protection of memory, panicking if we can't.
+func protectMemory(a Allocator, b []byte, read, write bool) {
+	if err := a.Protect(b, read, write); err != nil {
+		safePanic(err)
+	}
+}
+
+// Unlock memory, panicking if we can't.
+func unlockMemory(a Allocator, b []byte) {
+	if err := tryUnlockMemory(a, b); err != nil {
+		safePanic(err)
+	}
+}
+
+// Unlock memory, returning an error if we can't. It stops counting towards the limit on locked memory either way, since it is about to be freed.
+func tryUnlockMemory(a Allocator, b []byte) error {
+	releaseLocked(len(b))
+	return a.Unlock(b)
+}
+
+// Free memory, panicking if we can't.
+func freeMemory(a Allocator, b []byte) {
+	if err := a.Free(b); err != nil {
+		safePanic(err)
+	}
+}
+
+/*
+MockAllocator is an Allocator for tests that hands out regular memory from the Go heap and records every change of protection instead of making it. Memory is never actually locked or protected, so hiding a LockedBuffer or touching its guard pages does not cause a fault, and tests can use RecordedProtections to check exactly which calls to Protect were made.
+
+It must never be used outside of tests, since none of the protections that memguard normally provides are in place. The zero value is ready to use.
+*/
+type MockAllocator struct {
+	mutex       sync.Mutex   // Local mutex lock, which can't be embedded since Lock and Unlock are taken.
+	protections []Protection // Every call to Protect, in order.
+}
+
+/*
+Protection records a single call to the Protect method of a MockAllocator.
+*/
+type Protection struct {
+	Region      []byte // The memory whose protection was changed.
+	Read, Write bool   // Whether it was made readable and writable.
+}
+
+func (a *MockAllocator) Alloc(n int) ([]byte, error) {
+	// Allocate an extra page so that the start can be aligned to a page boundary.
+	b := make([]byte, n+pageSize)
+	offset := int(-uintptr(unsafe.Pointer(&b[0])) & uintptr(pageSize-1))
+	return b[offset : offset+n : offset+n], nil
+}
+
+func (a *MockAllocator) Free(b []byte) error {
+	return nil
+}
+
+func (a *MockAllocator) Lock(b []byte) error {
+	return nil
+}
+
+func (a *MockAllocator) Unlock(b []byte) error {
+	return nil
+}
+
+func (a *MockAllocator) Protect(b []byte, read, write bool) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.protections = append(a.protections, Protection{b, read, write})
+	return nil
+}
+
+/*
+RecordedProtections returns every call to Protect that has been made on the MockAllocator so far, in the order that they were made.
+*/
+func (a *MockAllocator) RecordedProtections() []Protection {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return append([]Protection(nil), a.protections...)
+}
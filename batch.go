@@ -0,0 +1,128 @@
+package memguard
+
+import (
+	"sync"
+	"unsafe"
+
+	"github.com/awnumar/memguard/memcall"
+)
+
+// batch is a single allocation holding several LockedBuffers of the same size, each between guard pages of its own, that was made by NewMutableBatch.
+type batch struct {
+	sync.Mutex // Local mutex lock.
+
+	memory []byte    // All of the memory, including every guard page.
+	alloc  Allocator // The Allocator that the memory came from.
+	locked bool      // Is the memory locked into RAM?
+	live   int       // Number of LockedBuffers in the batch that have not been destroyed.
+}
+
+/*
+NewMutableBatch creates count mutable LockedBuffers of the same size with a single allocation, and locks them all with a single system call. This is a lot quicker than calling NewMutable count times, which matters when a program sets up many LockedBuffers at once, such as at start up.
+
+Each LockedBuffer still has its own canary and guard pages on either side of it, with neighbouring LockedBuffers sharing the guard pages in between, and each one can be made immutable, hidden, and destroyed on its own. They can't be suspended. Destroying one wipes its memory and makes it inaccessible, but the whole allocation is only unlocked and freed once every LockedBuffer in the batch has been destroyed. LockedBuffers from a batch are never kept by a Pool.
+
+If size or count is less than one, the call will return an ErrInvalidLength.
+*/
+func NewMutableBatch(size, count int) ([]*LockedBuffer, error) {
+	// Return an error if length < 1.
+	if size < 1 || count < 1 {
+		return nil, ErrInvalidLength
+	}
+
+	// Decide what the canaries will look like, and how much guard space to use.
+	canaryLen, canaryRef := getCanarySettings()
+	guardLen := getGuardLen()
+
+	// Return an error if it's too large, taking each LockedBuffer and the guard pages after it as a unit.
+	if err := checkAllocSize(size, canaryLen, guardLen); err != nil {
+		return nil, err
+	}
+	roundedLength := roundToPageSize(size + canaryLen)
+	if count > (maxInt-guardLen)/(roundedLength+guardLen) {
+		return nil, ErrSizeTooLarge
+	}
+
+	// Make sure that the memory can actually be locked, if it has to be.
+	a := getAllocator()
+	if ok, _ := memcall.LockSupported(); isDefaultAllocator(a) && !ok && getLockPolicy() == LockRequired {
+		return nil, ErrLockUnavailable
+	}
+
+	// Allocate it all.
+	stride := guardLen + roundedLength
+	memory, err := a.Alloc(guardLen + count*stride)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lock all of it at once, and keep it out of core dumps and forked children, releasing everything if we can't.
+	locked, err := lockMemory(a, memory)
+	if err != nil {
+		freeMemory(a, memory)
+		return nil, err
+	}
+	if err := dontDump(a, memory); err != nil {
+		if locked {
+			unlockMemory(a, memory)
+		}
+		freeMemory(a, memory)
+		return nil, err
+	}
+
+	// Make the guard pages inaccessible.
+	for i := 0; i <= count; i++ {
+		protectMemory(a, memory[i*stride:i*stride+guardLen], false, false)
+	}
+
+	// Carve out the LockedBuffers.
+	bt := &batch{memory: memory, alloc: a, locked: locked, live: count}
+	bufs := make([]*LockedBuffer, count)
+	for i := range bufs {
+		b := &LockedBuffer{new(container), new(littleBird)}
+		b.memory = memory[i*stride : (i+1)*stride+guardLen]
+		b.inner = b.memory[guardLen : guardLen+roundedLength]
+		b.guardLen = guardLen
+		b.batch = bt
+		b.alloc = a
+		b.locked = locked
+		b.canaryLen, b.canaryRef = canaryLen, canaryRef
+
+		// Set the canary, and the slice that describes the data.
+		fillCanary(b.inner[len(b.inner)-size-canaryLen:len(b.inner)-size], canaryRef)
+		b.buffer = getBytes(uintptr(unsafe.Pointer(&b.inner[len(b.inner)-size])), size)
+		wipeBytes(b.buffer)
+		b.mutable = true
+
+		// Start keeping track of it.
+		track(b)
+		bufs[i] = b
+	}
+
+	return bufs, nil
+}
+
+// Account for a LockedBuffer in the batch having been destroyed, unlocking and freeing all of the memory if it was the last one. The first error from freeing it is returned.
+func (bt *batch) release() error {
+	// Get a mutex lock on the batch.
+	bt.Lock()
+	defer bt.Unlock()
+
+	// Keep the memory around while something is still using it.
+	bt.live--
+	if bt.live > 0 {
+		return nil
+	}
+
+	// Every LockedBuffer has already been wiped, so just unlock and free all of the memory, carrying on as far as we can if something fails.
+	err := bt.alloc.Protect(bt.memory, true, true)
+	if bt.locked {
+		if e := tryUnlockMemory(bt.alloc, bt.memory); err == nil {
+			err = e
+		}
+	}
+	if e := bt.alloc.Free(bt.memory); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,235 @@
+package memguard
+
+import (
+	"crypto/cipher"
+	"sync"
+	"time"
+)
+
+/*
+Coffer holds a key that Enclaves can be sealed with instead of the key that is shared by the whole process, and periodically replaces it with a new one, re-encrypting everything that was sealed into it. This limits how long any one key is in use, so that an attacker who is able to slowly extract memory, such as through a side channel, has a moving target.
+
+A Coffer keeps a reference to every Enclave sealed into it so that it can re-encrypt them, so Enclaves that are no longer needed should be passed to Discard. Enclaves sealed into a Coffer are opened in exactly the same way as any other, with Open, OpenContext, or Reader.
+
+Destroy must be called once a Coffer is no longer needed, to stop the goroutine that re-keys it and destroy its key. After that, or after a call to DestroyAll, the Enclaves sealed into it can no longer be opened.
+*/
+type Coffer struct {
+	sync.Mutex // Local mutex lock.
+
+	key      *LockedBuffer // The current key.
+	enclaves []*Enclave    // Every Enclave sealed with the key.
+	done     chan struct{} // Closed to stop the goroutine that re-keys the Coffer.
+}
+
+/*
+NewCoffer creates a Coffer with a freshly generated key, and starts a goroutine that calls Rekey on it every interval. If interval is not positive, no goroutine is started and Rekey has to be called by hand.
+*/
+func NewCoffer(interval time.Duration) (*Coffer, error) {
+	// Generate the first key.
+	key, err := NewImmutableRandom(32)
+	if err != nil {
+		return nil, err
+	}
+	key.SetLabel("memguard.coffer-key")
+	c := &Coffer{key: key, done: make(chan struct{})}
+
+	// Start re-keying it in the background.
+	if interval > 0 {
+		go c.rekeyEvery(time.NewTicker(interval))
+	}
+
+	return c, nil
+}
+
+// Re-key the Coffer every time the ticker fires, until it is destroyed.
+func (c *Coffer) rekeyEvery(t *time.Ticker) {
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			// Other errors, such as running out of memory, may go away by the next time.
+			if c.Rekey() == ErrDestroyed {
+				return
+			}
+		}
+	}
+}
+
+/*
+Seal is identical to the package-level Seal, except that the contents are encrypted with the key of the Coffer and will be re-encrypted every time it is re-keyed.
+
+If the LockedBuffer or the Coffer has been destroyed, the call will return an ErrDestroyed.
+*/
+func (c *Coffer) Seal(b *LockedBuffer) (*Enclave, error) {
+	return seal(b, c)
+}
+
+/*
+Rekey generates a new key for the Coffer, re-encrypts every Enclave that was sealed into it under the new key, and then destroys the old key. It is called automatically at the interval given to NewCoffer, but it can also be called by hand, such as when a key might have been exposed.
+
+Each Enclave is decrypted into a LockedBuffer a chunk at a time, so the plaintext never leaves protected memory. An Enclave that can't be decrypted, because it has been tampered with, is left as it is and will no longer open.
+
+If the Coffer has been destroyed, the call will return an ErrDestroyed.
+*/
+func (c *Coffer) Rekey() error {
+	// Get a mutex lock on the Coffer.
+	c.Lock()
+	defer c.Unlock()
+
+	// Set up the cipher with the current key.
+	oldBlock, oldAEAD, err := c.cipher()
+	if err != nil {
+		return err
+	}
+	defer oldBlock.Destroy()
+
+	// Generate the new key.
+	key, err := NewImmutableRandom(32)
+	if err != nil {
+		return err
+	}
+	key.SetLabel("memguard.coffer-key")
+	newBlock, newAEAD, err := newEnclaveAEAD(key.buffer)
+	if err != nil {
+		key.Destroy()
+		return err
+	}
+	defer newBlock.Destroy()
+
+	// Re-encrypt everything, only touching the Enclaves once nothing can go wrong.
+	ciphertexts := make([][]byte, len(c.enclaves))
+	for i, e := range c.enclaves {
+		ciphertext, err := rekeyEnclave(e, oldAEAD, newAEAD)
+		if err != nil && err != ErrDecryptionFailed {
+			key.Destroy()
+			return err
+		}
+		ciphertexts[i] = ciphertext
+	}
+	for i, e := range c.enclaves {
+		if ciphertexts[i] != nil {
+			copy(e.ciphertext, ciphertexts[i])
+		}
+	}
+
+	// Replace the old key.
+	c.key.Destroy()
+	c.key = key
+
+	// Everything went well.
+	return nil
+}
+
+// Re-encrypt the contents of an Enclave from one key to another, with a new nonce, returning the new ciphertext. It is the same length as the old one, so it can be copied over it in place.
+func rekeyEnclave(e *Enclave, oldAEAD, newAEAD cipher.AEAD) ([]byte, error) {
+	// Check that it's well-formed.
+	size := e.Size()
+	if size < 1 {
+		return nil, ErrDecryptionFailed
+	}
+
+	// Create a LockedBuffer to hold the plaintext of each chunk.
+	chunkSize := e.chunkSize
+	if chunkSize > size {
+		chunkSize = size
+	}
+	plaintext, err := NewMutable(chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	defer plaintext.Destroy()
+
+	// Generate a new nonce, and then decrypt and re-encrypt a chunk at a time.
+	ciphertext := make([]byte, 12, len(e.ciphertext))
+	fillRandBytes(ciphertext)
+	nonce, ad := make([]byte, 12), make([]byte, 9)
+	ct := e.ciphertext[12:]
+	for i, off := 0, 0; off < size; i, off = i+1, off+e.chunkSize {
+		end := off + e.chunkSize
+		if end > size {
+			end = size
+		}
+		chunkParams(nonce, ad, e.ciphertext[:12], i, end == size)
+		pt, err := oldAEAD.Open(plaintext.buffer[:0], nonce, ct[:end-off+16], ad)
+		if err != nil {
+			return nil, ErrDecryptionFailed
+		}
+		chunkParams(nonce, ad, ciphertext[:12], i, end == size)
+		ciphertext = newAEAD.Seal(ciphertext, nonce, pt, ad)
+		wipeBytes(pt)
+		ct = ct[end-off+16:]
+	}
+
+	return ciphertext, nil
+}
+
+/*
+Discard removes an Enclave from the Coffer that it was sealed into, so that it is no longer re-encrypted and can be garbage collected, and wipes its ciphertext so that it can no longer be opened. Enclaves that weren't sealed into this Coffer are left alone.
+*/
+func (c *Coffer) Discard(e *Enclave) {
+	// Get a mutex lock on the Coffer.
+	c.Lock()
+	defer c.Unlock()
+
+	for i, v := range c.enclaves {
+		if v == e {
+			c.enclaves = append(c.enclaves[:i], c.enclaves[i+1:]...)
+			wipeBytes(e.ciphertext)
+			return
+		}
+	}
+}
+
+/*
+Destroy stops the goroutine that re-keys the Coffer and destroys its key, so that none of the Enclaves sealed into it can be opened any more.
+
+If the Coffer has already been destroyed then the call makes no changes.
+*/
+func (c *Coffer) Destroy() {
+	// Get a mutex lock on the Coffer.
+	c.Lock()
+	defer c.Unlock()
+
+	// Check if it's destroyed.
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	// Stop the goroutine, destroy the key, and forget about the Enclaves.
+	close(c.done)
+	c.key.Destroy()
+	c.enclaves = nil
+}
+
+// Call a function with an AEAD instance keyed with the key of the Coffer.
+func (c *Coffer) withCipher(f func(cipher.AEAD) error) error {
+	// Get a mutex lock on the Coffer.
+	c.Lock()
+	defer c.Unlock()
+
+	// Initialise the cipher, destroying the expanded key once we're done with it.
+	block, aead, err := c.cipher()
+	if err != nil {
+		return err
+	}
+	defer block.Destroy()
+
+	return f(aead)
+}
+
+// Set up the cipher with the current key. The caller must hold the mutex lock on the Coffer, and must destroy the AESBlock once it is done with the AEAD.
+func (c *Coffer) cipher() (*AESBlock, cipher.AEAD, error) {
+	// Stop the key from being destroyed while we use it.
+	c.key.Lock()
+	defer c.key.Unlock()
+	if len(c.key.buffer) == 0 {
+		return nil, nil, ErrDestroyed
+	}
+
+	return newEnclaveAEAD(c.key.buffer)
+}
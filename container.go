@@ -1,9 +1,10 @@
 package memguard
 
 import (
-	"crypto/subtle"
+	"fmt"
 	"runtime"
 	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/awnumar/memguard/memcall"
@@ -27,61 +28,214 @@ type LockedBuffer struct {
 
 // container implements the actual data container.
 type container struct {
-	sync.Mutex // Local mutex lock.
+	sync.RWMutex // Local mutex lock. Only calls that never change anything, such as ReadAll, take the read lock.
 
-	buffer  []byte // Slice that references the protected memory.
-	mutable bool   // Is this LockedBuffer mutable?
+	buffer   []byte    // Slice that references the protected memory.
+	memory   []byte    // All of the memory allocated for this LockedBuffer, including the guard pages.
+	inner    []byte    // The locked memory that holds the canary and the data.
+	slab     *slab     // The slab that inner was carved out of, if any.
+	batch    *batch    // The batch that memory was carved out of, if any.
+	huge     bool      // Is inner made up of huge pages?
+	guardLen int       // Length of the guard pages on either side of inner.
+	alloc    Allocator // The Allocator that memory, or the slab, came from.
+
+	foreign  bool // Is the memory owned by someone else?
+	readOnly bool // Is the memory impossible to write to?
+
+	canaryLen int    // Length of the canary preceding the data.
+	canaryRef []byte // Value that the canary is made of, repeated as many times as necessary.
+
+	mutable   bool   // Is this LockedBuffer mutable?
+	hidden    bool   // Is the memory currently inaccessible?
+	locked    bool   // Is the memory locked into RAM?
+	suspended bool   // Has the memory been unlocked and hidden by Suspend?
+	label     string // Optional name used to identify this LockedBuffer.
+
+	ttl *time.Timer // Timer that destroys this LockedBuffer when its time is up, if any.
 }
 
 // littleBird is a value that we monitor instead of the LockedBuffer
 // itself. It allows us to tell the GC to auto-destroy LockedBuffers.
 type littleBird [16]byte
 
+// Destroy a container whose LockedBuffer was garbage collected, reporting the leak if it hadn't been destroyed already.
+func (b *container) destroyLeaked() {
+	// Attain a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	// Nothing leaked if it's already destroyed.
+	if len(b.buffer) == 0 {
+		return
+	}
+
+	// Report the leak.
+	leakLoggerMutex.Lock()
+	l := leakLogger
+	leakLoggerMutex.Unlock()
+	if l != nil {
+		name := "unlabelled LockedBuffer"
+		if b.label != "" {
+			name = fmt.Sprintf("LockedBuffer %q", b.label)
+		}
+		l.Printf("memguard: %s (%d bytes) was garbage collected without being destroyed", name, len(b.buffer))
+	}
+
+	b.destroy()
+}
+
 // Global internal function used to create new secure containers.
 func newContainer(size int, mutable bool) (*LockedBuffer, error) {
+	return newFilledContainer(size, mutable, false, nil)
+}
+
+// Create a new secure container, calling fill (if given) on its buffer while it's still writable and before it's made immutable, so that immutable containers never have to pass through a mutable state. If huge is set, the container is given huge pages if possible.
+func newFilledContainer(size int, mutable, huge bool, fill func([]byte) error) (*LockedBuffer, error) {
+	return newNodeContainer(size, mutable, huge, -1, fill)
+}
+
+// Create a new secure container in the same way as newFilledContainer, with the pages that hold its data bound to a given NUMA node unless node is negative.
+func newNodeContainer(size int, mutable, huge bool, node int, fill func([]byte) error) (*LockedBuffer, error) {
 	// Return an error if length < 1.
 	if size < 1 {
 		return nil, ErrInvalidLength
 	}
 
+	// Decide what the canary will look like, and how much guard space to use.
+	canaryLen, canaryRef := getCanarySettings()
+	guardLen := getGuardLen()
+
+	// Return an error if it's too large.
+	if err := checkAllocSize(size, canaryLen, guardLen); err != nil {
+		return nil, err
+	}
+
+	// Get the Allocator to use.
+	a := getAllocator()
+
+	// Make sure that the memory can actually be locked, if it has to be.
+	if ok, _ := memcall.LockSupported(); isDefaultAllocator(a) && !ok && getLockPolicy() == LockRequired {
+		return nil, ErrLockUnavailable
+	}
+
 	// Allocate a new LockedBuffer.
 	ib := new(container)
 	b := &LockedBuffer{ib, new(littleBird)}
+	b.canaryLen, b.canaryRef = canaryLen, canaryRef
+	b.alloc = a
+
+	// Small mutable buffers may be able to share a slab, unless they need to be on a particular node.
+	var err error
+	if mutable && !huge && node < 0 {
+		if b.slab, b.inner, err = slabAlloc(a, size, canaryLen, guardLen); err != nil {
+			return nil, err
+		}
+	}
 
-	// Round length + 32 bytes for the canary to a multiple of the page size..
-	roundedLength := roundToPageSize(size + 32)
+	// Otherwise give it pages of its own.
+	if b.slab == nil {
+		// Round length + the canary to a multiple of the page size..
+		roundedLength := roundToPageSize(size + canaryLen)
 
-	// Calculate the total size of memory including the guard pages.
-	totalSize := (2 * pageSize) + roundedLength
+		// Try to use huge pages if asked to, with normal guard pages around them. Only the default Allocator knows how.
+		var memory []byte
+		free := a.Free
+		if hp := memcall.HugePageSize(); huge && hp > 0 && isDefaultAllocator(a) {
+			hugeLength := (size + canaryLen + hp - 1) / hp * hp
+			if memory, err = memcall.AllocHuge(hugeLength, guardLen); err == nil {
+				roundedLength = hugeLength
+				free = func(b []byte) error { memcall.FreeHuge(b); return nil }
+				b.huge = true
+			}
+		}
 
-	// Allocate it all.
-	memory := memcall.Alloc(totalSize)
+		// Otherwise, or if there aren't any available, use normal pages.
+		if memory == nil {
+			// Calculate the total size of memory including the guard pages.
+			totalSize := (2 * guardLen) + roundedLength
 
-	// Make the guard pages inaccessible.
-	memcall.Protect(memory[:pageSize], false, false)
-	memcall.Protect(memory[pageSize+roundedLength:], false, false)
+			// Allocate it all.
+			if memory, err = a.Alloc(totalSize); err != nil {
+				return nil, err
+			}
+		}
 
-	// Lock the pages that will hold the sensitive data.
-	memcall.Lock(memory[pageSize : pageSize+roundedLength])
+		// Make the guard pages inaccessible.
+		protectMemory(a, memory[:guardLen], false, false)
+		protectMemory(a, memory[guardLen+roundedLength:], false, false)
+
+		// Bind the pages that will hold the sensitive data to the node, if there is one, before they're locked.
+		if node >= 0 {
+			if err := memcall.Bind(memory[guardLen:guardLen+roundedLength], node); err != nil {
+				free(memory)
+				return nil, err
+			}
+		}
+
+		// Lock the pages that will hold the sensitive data, releasing everything if we can't.
+		locked, err := lockMemory(a, memory[guardLen:guardLen+roundedLength])
+		if err != nil {
+			free(memory)
+			return nil, err
+		}
+
+		// Keep them out of core dumps, and out of forked children, too.
+		if err := dontDump(a, memory[guardLen:guardLen+roundedLength]); err != nil {
+			if locked {
+				unlockMemory(a, memory[guardLen:guardLen+roundedLength])
+			}
+			free(memory)
+			return nil, err
+		}
+
+		b.memory = memory
+		b.inner = memory[guardLen : guardLen+roundedLength]
+		b.locked = locked
+		b.guardLen = guardLen
+	} else {
+		b.locked = b.slab.locked
+	}
 
 	// Set the canary.
-	subtle.ConstantTimeCopy(1, memory[pageSize+roundedLength-size-32:pageSize+roundedLength-size], canary)
+	fillCanary(b.inner[len(b.inner)-size-canaryLen:len(b.inner)-size], canaryRef)
 
 	// Set Buffer to a byte slice that describes the reigon of memory that is protected.
-	b.buffer = getBytes(uintptr(unsafe.Pointer(&memory[pageSize+roundedLength-size])), size)
+	b.buffer = getBytes(uintptr(unsafe.Pointer(&b.inner[len(b.inner)-size])), size)
 
 	// The buffer is filled with weird bytes so let's wipe it.
 	wipeBytes(b.buffer)
 
+	// Fill it with the initial contents, cleaning up if we can't.
+	if fill != nil {
+		if err := fill(b.buffer); err != nil {
+			b.destroy()
+			return nil, err
+		}
+	}
+
 	// Set appropriate mutability state.
 	b.mutable = true
 	if !mutable {
 		b.MakeImmutable()
 	}
 
+	// Start keeping track of it.
+	track(b)
+
+	// Return a pointer to the LockedBuffer.
+	return b, nil
+}
+
+// Set up the finalizer of a new LockedBuffer and add it to the list of active LockedBuffers.
+func track(b *LockedBuffer) {
+	ib := b.container
+
+	// Take note of the size before anyone else can see it, since it could be destroyed as soon as it's in the list.
+	size := len(ib.buffer)
+
 	// Use a finalizer to make sure the buffer gets destroyed if forgotten.
 	runtime.SetFinalizer(b.littleBird, func(_ *littleBird) {
-		go ib.Destroy()
+		go ib.destroyLeaked()
 	})
 
 	// Append the container to allLockedBuffers. We have to add container
@@ -90,6 +244,25 @@ func newContainer(size int, mutable bool) (*LockedBuffer, error) {
 	allLockedBuffers = append(allLockedBuffers, ib)
 	allLockedBuffersMutex.Unlock()
 
-	// Return a pointer to the LockedBuffer.
-	return b, nil
+	// Let the observer know about it.
+	getObserver().OnCreate(size)
+}
+
+// Remove a container from the list of active LockedBuffers.
+func untrack(b *container) {
+	allLockedBuffersMutex.Lock()
+	found := false
+	for i, v := range allLockedBuffers {
+		if v == b {
+			allLockedBuffers = append(allLockedBuffers[:i], allLockedBuffers[i+1:]...)
+			found = true
+			break
+		}
+	}
+	allLockedBuffersMutex.Unlock()
+
+	// Let the observer know that it's gone, as long as it was told about it in the first place. Containers that fail to be filled in are destroyed before they're tracked.
+	if found {
+		getObserver().OnDestroy(len(b.buffer))
+	}
 }
@@ -0,0 +1,423 @@
+package memguard
+
+import (
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+var (
+	// Key used to encrypt the contents of Enclaves, and associated mutex.
+	enclaveKey      *LockedBuffer
+	enclaveKeyMutex = &sync.Mutex{}
+
+	// Length of the plaintext sealed into each chunk of a new Enclave.
+	enclaveChunkSize = 64 * 1024
+)
+
+/*
+Enclave holds the contents of a LockedBuffer in encrypted form, in regular memory.
+
+Long-lived secrets can be kept sealed inside an Enclave for most of their life and only decrypted into a LockedBuffer for the brief periods that they are actually needed, which makes it much less likely that the plaintext is ever caught by something like a core dump.
+
+The contents are encrypted with AES-256-GCM under a key that is randomly generated for each process and is itself kept inside a LockedBuffer, as is the AES key schedule, which is expanded with AESBlock each time the key is used. GCM does derive an authentication key from the cipher and keeps it in regular memory for the length of each call, which would let someone who caught it forge ciphertexts, but not decrypt them. Since AESBlock is written in pure Go, sealing and opening each manage well under a megabyte a second, so Enclaves are best suited to keys and other small secrets. Large contents are split into chunks that are sealed separately, so that opening an Enclave can be cancelled part of the way through with OpenContext. Since DestroyAll destroys that key along with everything else, Enclaves that were sealed before a call to DestroyAll can no longer be opened afterwards.
+*/
+type Enclave struct {
+	ciphertext []byte  // Nonce followed by the sealed chunks.
+	chunkSize  int     // Length of the plaintext in each chunk but the last.
+	coffer     *Coffer // The Coffer whose key it was sealed with, if any.
+}
+
+/*
+Seal encrypts the contents of a LockedBuffer into a new Enclave and then destroys the LockedBuffer.
+
+If the LockedBuffer has already been destroyed, the call will return an ErrDestroyed.
+*/
+func Seal(b *LockedBuffer) (*Enclave, error) {
+	return seal(b, nil)
+}
+
+// Seal a LockedBuffer into a new Enclave, under the key of a Coffer if one is given and the enclave key otherwise.
+func seal(b *LockedBuffer, c *Coffer) (*Enclave, error) {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		b.Unlock()
+		return nil, ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if b.hidden {
+		b.Unlock()
+		return nil, ErrHidden
+	}
+
+	// Encrypt the contents.
+	e, err := sealLocked(b, c)
+
+	// Release the lock so that the original can be destroyed.
+	b.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	b.Destroy()
+
+	// Return the Enclave.
+	return e, nil
+}
+
+// Encrypt the contents of a LockedBuffer into a new Enclave, under the key of a Coffer if one is given and the enclave key otherwise. The caller must hold a lock on the LockedBuffer, and must have checked that it isn't destroyed.
+func sealLocked(b *LockedBuffer, c *Coffer) (*Enclave, error) {
+	// Generate a random nonce, which the nonce of each chunk is derived from.
+	chunkSize := enclaveChunkSize
+	ciphertext := make([]byte, 12, 12+len(b.buffer)+16*((len(b.buffer)+chunkSize-1)/chunkSize))
+	fillRandBytes(ciphertext)
+
+	// Encrypt the contents a chunk at a time, appending the ciphertext to the nonce.
+	var e *Enclave
+	err := withEnclaveCipher(c, func(aead cipher.AEAD) error {
+		nonce, ad := make([]byte, 12), make([]byte, 9)
+		for i, off := 0, 0; off < len(b.buffer); i, off = i+1, off+chunkSize {
+			end := off + chunkSize
+			if end > len(b.buffer) {
+				end = len(b.buffer)
+			}
+			chunkParams(nonce, ad, ciphertext[:12], i, end == len(b.buffer))
+			ciphertext = aead.Seal(ciphertext, nonce, b.buffer[off:end], ad)
+		}
+
+		// Let the Coffer know about it while we still hold its lock, so that it can't miss a change of key.
+		e = &Enclave{ciphertext, chunkSize, c}
+		if c != nil {
+			c.enclaves = append(c.enclaves, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Return the Enclave.
+	return e, nil
+}
+
+/*
+Checkpoint encrypts the contents of a LockedBuffer into a new Enclave in the same way as Seal, but leaves the LockedBuffer as it is. Along with Restore, this makes it possible to roll back changes to a secret, such as when rotating a key fails part of the way through, without the old contents ever being left in plaintext outside of protected memory.
+
+If the LockedBuffer has been destroyed, the call will return an ErrDestroyed.
+*/
+func Checkpoint(b *LockedBuffer) (*Enclave, error) {
+	// Get a read lock on this LockedBuffer.
+	b.RLock()
+	defer b.RUnlock()
+
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		return nil, ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if b.hidden {
+		return nil, ErrHidden
+	}
+
+	return sealLocked(b, nil)
+}
+
+/*
+Restore overwrites the contents of a LockedBuffer with the contents of an Enclave, such as one made by Checkpoint. The Enclave is decrypted into protected memory first, so if that fails the LockedBuffer is left untouched, and the Enclave itself is left untouched either way, so it can be restored from again.
+
+If the contents could not be decrypted, the call will return an ErrDecryptionFailed. If the LockedBuffer is not the same length as the contents, the call will return an ErrLengthMismatch. If it is immutable, the call will return an ErrImmutable, and if it has been destroyed, the call will return an ErrDestroyed.
+*/
+func Restore(b *LockedBuffer, cp *Enclave) error {
+	// Decrypt the checkpoint.
+	saved, err := Open(cp)
+	if err != nil {
+		return err
+	}
+	defer saved.Destroy()
+
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		return ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if b.hidden {
+		return ErrHidden
+	}
+
+	// Check if it's immutable.
+	if !b.mutable {
+		return ErrImmutable
+	}
+
+	// Check that the lengths match.
+	if len(b.buffer) != len(saved.buffer) {
+		return ErrLengthMismatch
+	}
+
+	// Copy the old contents back.
+	copy(b.buffer, saved.buffer)
+
+	// Everything went well.
+	return nil
+}
+
+/*
+Open decrypts the contents of an Enclave directly into a new, mutable LockedBuffer. The Enclave is left untouched, so it can be opened again later.
+
+If the contents could not be decrypted, either because the Enclave has been tampered with or because it was sealed before a call to DestroyAll, the call will return an ErrDecryptionFailed.
+*/
+func Open(e *Enclave) (*LockedBuffer, error) {
+	return OpenContext(context.Background(), e)
+}
+
+/*
+OpenContext is identical to Open, except that the context is checked between each chunk that is decrypted. If the context is done before the whole Enclave has been decrypted, the partially decrypted LockedBuffer is destroyed and the error from the context is returned. This stops something like a server handler from carrying on decrypting large secrets after its client has gone away.
+*/
+func OpenContext(ctx context.Context, e *Enclave) (*LockedBuffer, error) {
+	// Check that it's well-formed.
+	size := e.Size()
+	if size < 1 {
+		return nil, ErrDecryptionFailed
+	}
+
+	// Don't bother starting if we've already been cancelled.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Create a LockedBuffer to hold the plaintext.
+	b, err := NewMutable(size)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decrypt straight into the protected memory, a chunk at a time.
+	err = withEnclaveCipher(e.coffer, func(aead cipher.AEAD) error {
+		nonce, ad := make([]byte, 12), make([]byte, 9)
+		ct := e.ciphertext[12:]
+		for i, off := 0, 0; off < size; i, off = i+1, off+e.chunkSize {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			end := off + e.chunkSize
+			if end > size {
+				end = size
+			}
+			chunkParams(nonce, ad, e.ciphertext[:12], i, end == size)
+			if _, err := aead.Open(b.buffer[off:off], nonce, ct[:end-off+16], ad); err != nil {
+				return ErrDecryptionFailed
+			}
+			ct = ct[end-off+16:]
+		}
+		return nil
+	})
+	if err != nil {
+		b.Destroy()
+		if err == ctx.Err() {
+			return nil, err
+		}
+		return nil, ErrDecryptionFailed
+	}
+
+	// Return the LockedBuffer.
+	return b, nil
+}
+
+// Work out the nonce and additional data for the chunk at a given index. Binding the index and whether it's the last chunk stops chunks from being reordered, or an Enclave or stream from being truncated, without detection.
+func chunkParams(nonce, ad, base []byte, index int, last bool) {
+	copy(nonce, base)
+	binary.BigEndian.PutUint64(ad, uint64(index))
+	for i := 0; i < 8; i++ {
+		nonce[4+i] ^= ad[i]
+	}
+	ad[8] = 0
+	if last {
+		ad[8] = 1
+	}
+}
+
+/*
+Append returns a new Enclave holding the contents of the original followed by the contents of a given LockedBuffer, which is destroyed. The original Enclave is left untouched. If the original was sealed into a Coffer, so is the new one.
+
+The combined plaintext only ever exists inside LockedBuffers, all of which are destroyed before the call returns, even if sealing the result fails.
+
+If the LockedBuffer has already been destroyed, the call will return an ErrDestroyed.
+*/
+func (e *Enclave) Append(b *LockedBuffer) (*Enclave, error) {
+	// Decrypt the existing contents.
+	old, err := Open(e)
+	if err != nil {
+		return nil, err
+	}
+	defer old.Destroy()
+
+	// Get a mutex lock on the LockedBuffer.
+	b.Lock()
+
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		b.Unlock()
+		return nil, ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if b.hidden {
+		b.Unlock()
+		return nil, ErrHidden
+	}
+
+	// Create a LockedBuffer to hold the combined contents.
+	combined, err := NewMutable(len(old.buffer) + len(b.buffer))
+	if err != nil {
+		b.Unlock()
+		return nil, err
+	}
+	defer combined.Destroy()
+
+	// Copy the values across.
+	combined.Copy(old.buffer)
+	combined.CopyAt(b.buffer, len(old.buffer))
+
+	// Release the lock so that the LockedBuffer can be destroyed.
+	b.Unlock()
+	b.Destroy()
+
+	// Seal the combined contents, into the same Coffer if there is one.
+	return seal(combined, e.coffer)
+}
+
+/*
+Reader returns an io.ReadCloser that streams the plaintext sealed inside an Enclave. Nothing is decrypted until the first call to Read, at which point the Enclave is opened into a LockedBuffer that subsequent reads are served from.
+
+Close destroys that LockedBuffer whether or not it was read to the end, so callers should always defer a call to Close. Reading after Close returns an ErrDestroyed. The Enclave itself is left untouched.
+*/
+func (e *Enclave) Reader() (io.ReadCloser, error) {
+	// Catch malformed Enclaves early.
+	if e.Size() < 0 {
+		return nil, ErrDecryptionFailed
+	}
+
+	return &enclaveReader{e: e}, nil
+}
+
+// enclaveReader implements the io.ReadCloser returned by Enclave.Reader.
+type enclaveReader struct {
+	e      *Enclave      // The Enclave being read from.
+	b      *LockedBuffer // The decrypted contents, once opened.
+	r      *Reader       // Reader over the decrypted contents.
+	closed bool          // Has Close been called?
+}
+
+func (er *enclaveReader) Read(p []byte) (int, error) {
+	// Check if it's been closed.
+	if er.closed {
+		return 0, ErrDestroyed
+	}
+
+	// Decrypt the contents on the first call.
+	if er.b == nil {
+		b, err := Open(er.e)
+		if err != nil {
+			return 0, err
+		}
+		er.b = b
+		er.r = NewReader(b)
+	}
+
+	return er.r.Read(p)
+}
+
+func (er *enclaveReader) Close() error {
+	er.closed = true
+
+	// Destroy the plaintext, if there is any.
+	if er.b != nil {
+		er.b.Destroy()
+	}
+
+	return nil
+}
+
+/*
+Size returns the length, in bytes, of the plaintext sealed inside an Enclave. If the Enclave is malformed, the result is negative.
+*/
+func (e *Enclave) Size() int {
+	// Every chunk is the plaintext followed by a tag.
+	n := len(e.ciphertext) - 12
+	if n <= 16 || e.chunkSize < 1 {
+		return -1
+	}
+	full, last := n/(e.chunkSize+16), n%(e.chunkSize+16)
+	if last == 0 {
+		return full * e.chunkSize
+	}
+	if last <= 16 {
+		return -1
+	}
+	return full*e.chunkSize + last - 16
+}
+
+// Call a function with an AEAD instance keyed with the key of a Coffer, or with the enclave key if no Coffer is given, creating the enclave key if it doesn't exist yet or has been destroyed.
+func withEnclaveCipher(c *Coffer, f func(cipher.AEAD) error) error {
+	if c != nil {
+		return c.withCipher(f)
+	}
+
+	// Get a mutex lock on the key.
+	enclaveKeyMutex.Lock()
+	defer enclaveKeyMutex.Unlock()
+
+	// Generate a new key if we need to.
+	if enclaveKey == nil || enclaveKey.IsDestroyed() {
+		key, err := NewImmutableRandom(32)
+		if err != nil {
+			return err
+		}
+		key.SetLabel("memguard.enclave-key")
+		enclaveKey = key
+	}
+
+	// Stop the key from being destroyed while we use it.
+	enclaveKey.Lock()
+	defer enclaveKey.Unlock()
+	if len(enclaveKey.buffer) == 0 {
+		return ErrDestroyed
+	}
+
+	// Initialise the cipher, destroying the expanded key once we're done with it.
+	block, aead, err := newEnclaveAEAD(enclaveKey.buffer)
+	if err != nil {
+		return err
+	}
+	defer block.Destroy()
+
+	return f(aead)
+}
+
+// Set up AES-256-GCM with a given key, expanding it into an AESBlock so that the key schedule stays in protected memory. The caller must destroy the AESBlock once it is done with the AEAD.
+func newEnclaveAEAD(key []byte) (*AESBlock, cipher.AEAD, error) {
+	block, err := newAESBlock(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		block.Destroy()
+		return nil, nil, err
+	}
+
+	return block, aead, nil
+}
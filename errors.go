@@ -11,5 +11,50 @@ var ErrImmutable = errors.New("memguard.ErrImmutable: cannot modify immutable bu
 // ErrInvalidLength is returned when a LockedBuffer of smaller than one byte is requested.
 var ErrInvalidLength = errors.New("memguard.ErrInvalidLength: length of buffer must be greater than zero")
 
+// ErrSizeTooLarge is returned when a LockedBuffer is requested that is so large that its size calculations would overflow, or that its total allocation would exceed the limit set with SetMaxAllocSize.
+var ErrSizeTooLarge = errors.New("memguard.ErrSizeTooLarge: length of buffer exceeds the allocation limit")
+
 // ErrInvalidConversion is returned when attempting to get a slice of a LockedBuffer that is of an inappropriate size for that slice type. For example, attempting to get a []uint16 representation of a LockedBuffer of length 9 bytes would trigger this error, since there would be a byte leftover after the conversion.
 var ErrInvalidConversion = errors.New("memguard.ErrInvalidConversion: length of buffer must align with target type")
+
+// ErrOutOfRange is returned when an offset and length do not describe a region that lies entirely within the LockedBuffer.
+var ErrOutOfRange = errors.New("memguard.ErrOutOfRange: region must lie within the bounds of the buffer")
+
+// ErrCanaryViolation is returned when the canary value guarding a LockedBuffer has been overwritten, indicating that a buffer overflow has occurred.
+var ErrCanaryViolation = errors.New("memguard.ErrCanaryViolation: canary value has been modified")
+
+// ErrCannotMarshal is returned when an attempt is made to serialize or deserialize a LockedBuffer. This is intentional, to stop secrets from leaking through encoding layers.
+var ErrCannotMarshal = errors.New("memguard.ErrCannotMarshal: buffers cannot be marshaled or unmarshaled")
+
+// ErrInvalidKeySize is returned when a LockedBuffer that is not 16, 24, or 32 bytes long is used as an AES key.
+var ErrInvalidKeySize = errors.New("memguard.ErrInvalidKeySize: AES keys must be 16, 24, or 32 bytes")
+
+// ErrDecryptionFailed is returned when the contents of an Enclave cannot be decrypted, either because it has been tampered with or because the key that it was sealed with no longer exists.
+var ErrDecryptionFailed = errors.New("memguard.ErrDecryptionFailed: enclave could not be decrypted")
+
+// ErrEnvNotSet is returned when a LockedBuffer is to be created from an environment variable that is not set.
+var ErrEnvNotSet = errors.New("memguard.ErrEnvNotSet: environment variable is not set")
+
+// ErrLengthMismatch is returned when an operation needs LockedBuffers of the same length and is given ones that differ.
+var ErrLengthMismatch = errors.New("memguard.ErrLengthMismatch: buffers must be the same length")
+
+// ErrLockUnavailable is returned when a LockedBuffer cannot be created because this process is not able to lock memory at all, such as when the limit on locked memory is zero or the working set quota is too small.
+var ErrLockUnavailable = errors.New("memguard.ErrLockUnavailable: memory cannot be locked on this system")
+
+// ErrNoSlack is returned by Grow when there is not enough spare room in the memory of a LockedBuffer to extend it in place.
+var ErrNoSlack = errors.New("memguard.ErrNoSlack: not enough room to grow the buffer in place")
+
+// ErrUnsupported is returned when an operation cannot be performed on a particular LockedBuffer, such as hiding one that shares its pages with others in a slab.
+var ErrUnsupported = errors.New("memguard.ErrUnsupported: operation is not supported on this buffer")
+
+// ErrMemlockBudget is returned by CheckMemlockBudget when there is not enough of the limit on locked memory left for the amount that is needed. The limit can be raised with ulimit -l, or with LimitMEMLOCK for a systemd service.
+var ErrMemlockBudget = errors.New("memguard.ErrMemlockBudget: not enough of the locked memory limit is left; raise RLIMIT_MEMLOCK, such as with ulimit -l")
+
+// ErrConsumed is returned when a ScratchBuffer is read after it has already been consumed.
+var ErrConsumed = errors.New("memguard.ErrConsumed: scratch buffer has already been consumed")
+
+// ErrMemoryLimitExceeded is returned when memory cannot be locked because it would take the total amount of memory locked by memguard over the limit set with SetMemoryLimit.
+var ErrMemoryLimitExceeded = errors.New("memguard.ErrMemoryLimitExceeded: locking this memory would exceed the limit set with SetMemoryLimit")
+
+// ErrHidden is returned when a LockedBuffer is accessed while its memory has been made inaccessible with Hide or Suspend.
+var ErrHidden = errors.New("memguard.ErrHidden: buffer is hidden")
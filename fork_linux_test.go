@@ -0,0 +1,61 @@
+// +build linux,amd64
+
+package memguard
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/awnumar/memguard/memcall"
+)
+
+// Fork, and return whatever the child's copy of a buffer ORs together to. Nothing but raw system calls can be used in the child.
+func forkAndRead(t *testing.T, buf []byte) byte {
+	pid, _, errno := syscall.RawSyscall(syscall.SYS_FORK, 0, 0, 0)
+	if errno != 0 {
+		t.Skip("could not fork:", errno)
+	}
+	if pid == 0 {
+		var x byte
+		for _, v := range buf {
+			x |= v
+		}
+		syscall.RawSyscall(syscall.SYS_EXIT_GROUP, uintptr(x), 0, 0)
+	}
+
+	var status syscall.WaitStatus
+	if _, err := syscall.Wait4(int(pid), &status, 0, nil); err != nil || !status.Exited() {
+		t.Fatal("child did not exit;", err, status)
+	}
+	return byte(status.ExitStatus())
+}
+
+func TestSetWipeOnFork(t *testing.T) {
+	// Check that the kernel supports it.
+	probe, _ := memcall.Alloc(pageSize)
+	err := memcall.WipeOnFork(probe)
+	memcall.Free(probe)
+	if err != nil {
+		t.Skip("wiping on fork is not supported:", err)
+	}
+	defer SetWipeOnFork(true)
+
+	// The child should see the contents when it's disabled.
+	SetWipeOnFork(false)
+	a, _ := NewImmutableFromBytes([]byte{1, 2, 4, 8})
+	if x := forkAndRead(t, a.Buffer()); x != 15 {
+		t.Error("expected child to see the contents;", x)
+	}
+	a.Destroy()
+
+	// And zeroes when it's enabled, while the parent keeps its copy.
+	SetWipeOnFork(true)
+	b, _ := NewImmutableFromBytes([]byte{1, 2, 4, 8})
+	if x := forkAndRead(t, b.Buffer()); x != 0 {
+		t.Error("expected child's copy to be wiped;", x)
+	}
+	if b.Buffer()[3] != 8 {
+		t.Error("parent's copy was wiped")
+	}
+	b.Destroy()
+}
@@ -0,0 +1,117 @@
+package memguard
+
+import (
+	"fmt"
+	"runtime/debug"
+	"unsafe"
+)
+
+/*
+EnableGuardFaultReporting arranges for an access to inaccessible memory made by the calling goroutine to cause a recoverable panic instead of immediately crashing the process with a bare segmentation fault. It only affects the goroutine that calls it.
+
+It is meant to be paired with a deferred call to ReportGuardFault at the top of the same goroutine, which turns the panic into one that names the LockedBuffer whose guard page was hit:
+
+    go func() {
+        defer memguard.ReportGuardFault()
+        memguard.EnableGuardFaultReporting()
+
+        // Code that might overflow a LockedBuffer.
+    }()
+*/
+func EnableGuardFaultReporting() {
+	SetGuardFaultMode(GuardFaultPanic)
+}
+
+// GuardFaultMode selects what happens when a goroutine touches inaccessible memory, such as the guard pages around a LockedBuffer.
+type GuardFaultMode int
+
+const (
+	// GuardFaultCrash makes an access to inaccessible memory crash the process. This is the default for every goroutine.
+	GuardFaultCrash GuardFaultMode = iota
+
+	// GuardFaultPanic makes an access to inaccessible memory cause a panic that can be recovered from.
+	GuardFaultPanic
+)
+
+/*
+SetGuardFaultMode sets what happens when the calling goroutine touches inaccessible memory, and returns the mode that was in effect before. With GuardFaultPanic, hitting a guard page or a hidden LockedBuffer causes a runtime error that can be caught with recover, and whose Addr method gives the faulting address, instead of killing the whole process. This makes overflows much quicker to track down in tests. ReportGuardFault can be deferred to turn the panic into one that names the LockedBuffer in question.
+
+There are a few caveats. The Go runtime owns the signal handlers for memory faults, so the mode can't be set for the whole process and applies only to the calling goroutine; it has to be set again in each goroutine that should panic. Recovering is only sound when the fault was caused by reading or writing through a slice, and not inside the runtime or cgo, which will still crash. The operating system must also report the fault in a way that the runtime can turn into a panic, which is the case on Linux, the BSDs, macOS and Windows. Since a fault usually means that memory was about to be corrupted, GuardFaultPanic is intended for development and testing rather than for production.
+*/
+func SetGuardFaultMode(mode GuardFaultMode) GuardFaultMode {
+	if debug.SetPanicOnFault(mode == GuardFaultPanic) {
+		return GuardFaultPanic
+	}
+	return GuardFaultCrash
+}
+
+/*
+ReportGuardFault must be called directly by a deferred statement in a goroutine that has called EnableGuardFaultReporting. If that goroutine is panicking because it touched one of the guard pages surrounding a LockedBuffer, ReportGuardFault panics again with a message that gives the faulting address, which side of the data it was on, and the size and label of the LockedBuffer in question.
+
+Any other panic is passed on unchanged. If the goroutine is not panicking, ReportGuardFault does nothing.
+*/
+func ReportGuardFault() {
+	// Find out if we are panicking at all.
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	// Only faults carry an address.
+	if fault, ok := v.(interface{ Addr() uintptr }); ok {
+		if msg, found := describeGuardFault(fault.Addr()); found {
+			safePanic(msg)
+		}
+	}
+
+	// Not one of ours; carry on panicking.
+	panic(v)
+}
+
+// Look for the LockedBuffer whose guard pages contain a given address, and describe the fault if there is one.
+func describeGuardFault(addr uintptr) (string, bool) {
+	// Get a Mutex lock on allLockedBuffers, and get a copy.
+	allLockedBuffersMutex.Lock()
+	containers := make([]*container, len(allLockedBuffers))
+	copy(containers, allLockedBuffers)
+	allLockedBuffersMutex.Unlock()
+
+	for _, b := range containers {
+		if msg, found := b.describeGuardFault(addr); found {
+			return msg, true
+		}
+	}
+
+	return "", false
+}
+
+// Describe a fault at a given address if it lies in the guard pages of this LockedBuffer, holding its read lock so that it can't change or be destroyed part of the way through. Any locks taken by the goroutine that faulted have already been released while unwinding.
+func (b *container) describeGuardFault(addr uintptr) (string, bool) {
+	// Get a read lock on this LockedBuffer.
+	b.RLock()
+	defer b.RUnlock()
+
+	// LockedBuffers in a slab, or in foreign memory, don't have guard pages of their own, and destroyed ones have nothing at all.
+	if b.memory == nil {
+		return "", false
+	}
+
+	// Work out where the guard pages are.
+	start := uintptr(unsafe.Pointer(&b.memory[0]))
+	end := start + uintptr(len(b.memory))
+
+	// Describe the LockedBuffer.
+	name := "an unlabelled LockedBuffer"
+	if b.label != "" {
+		name = fmt.Sprintf("LockedBuffer %q", b.label)
+	}
+
+	switch {
+	case addr >= start && addr < start+uintptr(b.guardLen):
+		return fmt.Sprintf("memguard.ReportGuardFault(): access to guard page at %#x before %s (%d bytes)", addr, name, len(b.buffer)), true
+	case addr >= end-uintptr(b.guardLen) && addr < end:
+		return fmt.Sprintf("memguard.ReportGuardFault(): access to guard page at %#x after %s (%d bytes)", addr, name, len(b.buffer)), true
+	}
+
+	return "", false
+}
@@ -0,0 +1,108 @@
+package memguard
+
+import (
+	"crypto/hmac"
+	"hash"
+)
+
+/*
+HKDF derives any number of subkeys from a master secret held in a LockedBuffer, using HKDF as described in RFC 5869 with a given hash function, such as sha256.New. Each subkey is written straight into a new, immutable LockedBuffer of the requested length, in the order that the lengths are given, so that a whole key hierarchy can be built without any of it leaving protected memory. The subkeys are consecutive parts of the same output, so asking for lengths of 32 and 16 gives the same bytes as asking for a single length of 48 and splitting it.
+
+A read lock is held on the secret, and on the salt if there is one, for the whole call. The salt may be nil, in which case a string of zeroes is used as RFC 5869 describes. The pseudorandom key that is extracted from the secret, and each block of output, are kept in LockedBuffers that are destroyed before the call returns. Note that the hmac package copies its key, and the hash function keeps its state, in regular memory, which memguard has no way of wiping.
+
+If the secret or the salt has been destroyed, the call will return an ErrDestroyed. If any length is less than one, the call will return an ErrInvalidLength, and if they add up to more than HKDF can produce, which is 255 times the size of the hash, the call will return an ErrOutOfRange. If anything goes wrong, any subkeys that have already been created are destroyed.
+*/
+func HKDF(h func() hash.Hash, secret, salt *LockedBuffer, info []byte, lengths ...int) ([]*LockedBuffer, error) {
+	// Check the lengths.
+	hashLen := h().Size()
+	var total int
+	for _, n := range lengths {
+		if n < 1 {
+			return nil, ErrInvalidLength
+		}
+		if n > 255*hashLen-total {
+			return nil, ErrOutOfRange
+		}
+		total += n
+	}
+
+	// Get read locks on the secret and the salt, taking care not to lock the same one twice.
+	secret.RLock()
+	defer secret.RUnlock()
+	if len(secret.buffer) == 0 {
+		return nil, ErrDestroyed
+	}
+	if secret.hidden {
+		return nil, ErrHidden
+	}
+	var saltBytes []byte
+	if salt != nil {
+		if salt.container != secret.container {
+			salt.RLock()
+			defer salt.RUnlock()
+		}
+		if len(salt.buffer) == 0 {
+			return nil, ErrDestroyed
+		}
+		if salt.hidden {
+			return nil, ErrHidden
+		}
+		saltBytes = salt.buffer
+	}
+	if saltBytes == nil {
+		saltBytes = make([]byte, hashLen)
+	}
+
+	// Extract the pseudorandom key.
+	prk, err := NewMutable(hashLen)
+	if err != nil {
+		return nil, err
+	}
+	defer prk.Destroy()
+	mac := hmac.New(h, saltBytes)
+	mac.Write(secret.buffer)
+	mac.Sum(prk.buffer[:0])
+
+	// Create somewhere to hold each block of output.
+	block, err := NewMutable(hashLen)
+	if err != nil {
+		return nil, err
+	}
+	defer block.Destroy()
+
+	// Expand it, a block at a time, into each of the subkeys in turn.
+	var blockLen, pos int
+	counter := []byte{0}
+	expand := func(buf []byte) error {
+		for len(buf) > 0 {
+			if pos == blockLen {
+				mac := hmac.New(h, prk.buffer)
+				mac.Write(block.buffer[:blockLen])
+				mac.Write(info)
+				counter[0]++
+				mac.Write(counter)
+				mac.Sum(block.buffer[:0])
+				blockLen, pos = hashLen, 0
+			}
+			n := copy(buf, block.buffer[pos:blockLen])
+			buf = buf[n:]
+			pos += n
+		}
+		return nil
+	}
+
+	keys := make([]*LockedBuffer, 0, len(lengths))
+	for _, n := range lengths {
+		key, err := newFilledContainer(n, false, false, expand)
+		if err != nil {
+			for _, k := range keys {
+				k.Destroy()
+			}
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	// Everything went well.
+	return keys, nil
+}
@@ -0,0 +1,35 @@
+// +build memguard_inject
+
+package memguard
+
+import "sync"
+
+/*
+Fault injection points that let the tests reach branches which would otherwise only run when memory is really corrupted or a system call really fails. They only exist in builds with the memguard_inject tag, and are compiled out of everything else.
+*/
+var (
+	// Make every canary look like it has been overwritten.
+	injectCanaryMismatch bool
+
+	// Error to return instead of locking memory, if any.
+	injectLockFailure error
+
+	// Mutex for the above.
+	injectMutex = &sync.Mutex{}
+)
+
+// Check whether a canary mismatch is being injected.
+func canaryMismatchInjected() bool {
+	injectMutex.Lock()
+	defer injectMutex.Unlock()
+
+	return injectCanaryMismatch
+}
+
+// Get the error to return instead of locking memory, if any.
+func lockFailureInjected() error {
+	injectMutex.Lock()
+	defer injectMutex.Unlock()
+
+	return injectLockFailure
+}
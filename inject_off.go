@@ -0,0 +1,13 @@
+// +build !memguard_inject
+
+package memguard
+
+// Without the memguard_inject tag, nothing is ever injected.
+
+func canaryMismatchInjected() bool {
+	return false
+}
+
+func lockFailureInjected() error {
+	return nil
+}
@@ -0,0 +1,134 @@
+// +build memguard_inject
+
+package memguard
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Set the injected faults for the duration of a test.
+func inject(canaryMismatch bool, lockFailure error) {
+	injectMutex.Lock()
+	defer injectMutex.Unlock()
+
+	injectCanaryMismatch, injectLockFailure = canaryMismatch, lockFailure
+}
+
+func TestInjectCanaryMismatch(t *testing.T) {
+	defer inject(false, nil)
+
+	b, _ := NewMutableFromBytes([]byte("yellow submarine"))
+	inject(true, nil)
+
+	// Verify should report it.
+	if err := b.Verify(); err != ErrCanaryViolation {
+		t.Error("expected ErrCanaryViolation; got", err)
+	}
+
+	// Destroy should panic, leaving the buffer alone.
+	func() {
+		defer func() {
+			if v := recover(); v != "memguard.Destroy(): buffer overflow detected" {
+				t.Error("unexpected panic value;", v)
+			}
+		}()
+		b.Destroy()
+	}()
+	if b.IsDestroyed() {
+		t.Error("expected buffer to survive")
+	}
+
+	// So should putting it back into a Pool.
+	p := NewPool(1)
+	func() {
+		defer func() {
+			if v := recover(); v != "memguard.Pool.Put(): buffer overflow detected" {
+				t.Error("unexpected panic value;", v)
+			}
+		}()
+		p.Put(b)
+	}()
+
+	// Everything works again once the fault is gone.
+	inject(false, nil)
+	if err := b.Verify(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	b.Destroy()
+	if !b.IsDestroyed() {
+		t.Error("expected buffer to be destroyed")
+	}
+	p.Destroy()
+}
+
+func TestInjectLockFailure(t *testing.T) {
+	defer inject(false, nil)
+	defer SetLockPolicy(LockRequired)
+	defer SetLockRetryPolicy(0, 0)
+	EnableSlabAllocator(32)
+	defer EnableSlabAllocator(0)
+
+	allLockedBuffersMutex.Lock()
+	before := len(allLockedBuffers)
+	allLockedBuffersMutex.Unlock()
+	inject(false, syscall.EPERM)
+
+	// The error should be passed on for both slabs and dedicated pages, without leaking anything.
+	for _, size := range []int{8, 64} {
+		if _, err := NewMutable(size); err != syscall.EPERM {
+			t.Error("expected EPERM; got", err)
+		}
+	}
+	allSlabsMutex.Lock()
+	n := len(allSlabs)
+	allSlabsMutex.Unlock()
+	allLockedBuffersMutex.Lock()
+	m := len(allLockedBuffers)
+	allLockedBuffersMutex.Unlock()
+	if n != 0 || m != before {
+		t.Error("memory leaked;", n, m-before)
+	}
+
+	// Transient failures should be retried, and still fail in the end.
+	inject(false, syscall.EAGAIN)
+	SetLockRetryPolicy(2, time.Millisecond)
+	start := time.Now()
+	if _, err := NewMutable(64); err != syscall.EAGAIN {
+		t.Error("expected EAGAIN; got", err)
+	}
+	if time.Since(start) < 3*time.Millisecond {
+		t.Error("expected retries to wait")
+	}
+	SetLockRetryPolicy(0, 0)
+
+	// With best effort, buffers are created without being locked.
+	SetLockPolicy(LockBestEffort)
+	b, err := NewMutable(64)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if b.IsLocked() {
+		t.Error("expected buffer to be unlocked")
+	}
+	b.Destroy()
+
+	// Resuming should fail gracefully, leaving the buffer hidden.
+	SetLockPolicy(LockRequired)
+	inject(false, nil)
+	c, _ := NewMutable(64)
+	c.Suspend()
+	inject(false, syscall.EPERM)
+	if err := c.Resume(); err != syscall.EPERM {
+		t.Error("expected EPERM; got", err)
+	}
+	if !c.IsSuspended() || !c.IsHidden() {
+		t.Error("unexpected state")
+	}
+	inject(false, nil)
+	if err := c.Resume(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	c.Destroy()
+}
@@ -2,8 +2,17 @@ package memguard
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"log"
 	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/awnumar/memguard/memcall"
@@ -16,12 +25,81 @@ var (
 	// Canary value that acts as an alarm in case of disallowed memory access.
 	canary = createCanary()
 
+	// Length of the canaries of new LockedBuffers, and a fixed pattern to use instead of the random canary, and associated mutex.
+	canarySize         = 32
+	canaryPattern      []byte
+	canarySettingMutex = &sync.Mutex{}
+
 	// Create a dedicated sync object for the CatchInterrupt function.
 	catchInterruptOnce sync.Once
 
+	// Create a dedicated sync object for the CatchSignal function.
+	catchSignalOnce sync.Once
+
 	// Array of all active containers, and associated mutex.
 	allLockedBuffers      []*container
 	allLockedBuffersMutex = &sync.Mutex{}
+
+	// Number of guard pages on either side of new LockedBuffers, and associated mutex.
+	guardPageCount      = 1
+	guardPageCountMutex = &sync.Mutex{}
+
+	// Largest total allocation, including guard pages, that a LockedBuffer may use, and associated mutex.
+	maxAllocSize      = 1 << 30
+	maxAllocSizeMutex = &sync.Mutex{}
+
+	// Number of times that the contents of a LockedBuffer have been copied out with CopyOut.
+	exposureCount uint64
+
+	// Logger to report LockedBuffers that are garbage collected without being destroyed, and associated mutex.
+	leakLogger      *log.Logger
+	leakLoggerMutex = &sync.Mutex{}
+
+	// What to do about memory that can't be locked, and associated mutex.
+	lockPolicy      = LockRequired
+	lockPolicyMutex = &sync.Mutex{}
+
+	// How many more times to try locking memory after a transient failure, and how long to wait before the first retry, and associated mutex.
+	lockRetryAttempts int
+	lockRetryDelay    time.Duration
+	lockRetryMutex    = &sync.Mutex{}
+
+	// Key used to compute the fingerprints of LockedBuffers, and associated mutex.
+	fingerprintKey      *LockedBuffer
+	fingerprintKeyMutex = &sync.Mutex{}
+
+	// Whether to check that memory really is zero after wiping it on destruction, and associated mutex.
+	wipeVerification      bool
+	wipeVerificationMutex = &sync.Mutex{}
+
+	// Allocator used for the memory of new LockedBuffers, and associated mutex.
+	allocator      = defaultAllocator
+	allocatorMutex = &sync.Mutex{}
+
+	// Function to call before panicking, and associated mutex.
+	panicHandler      func(interface{})
+	panicHandlerMutex = &sync.Mutex{}
+
+	// How to overwrite the memory of LockedBuffers, and associated mutex.
+	wipeStrategy      = ZeroWipe
+	wipeStrategyMutex = &sync.Mutex{}
+
+	// Largest number of bytes that may be locked at once, or zero for no limit, and the number that are currently locked, and associated mutex.
+	memoryLimit      int
+	memoryLocked     int
+	memoryLimitMutex = &sync.Mutex{}
+
+	// Whether to have new memory wiped in the children of a fork, and associated mutex.
+	wipeOnFork      = true
+	wipeOnForkMutex = &sync.Mutex{}
+
+	// Whether New and NewFromFunc create mutable LockedBuffers, and associated mutex.
+	defaultMutable      = true
+	defaultMutableMutex = &sync.Mutex{}
+
+	// Observer to notify of lifecycle events, and associated mutex.
+	observer      Observer = noopObserver{}
+	observerMutex          = &sync.Mutex{}
 )
 
 // Create and allocate a canary value. Return to caller.
@@ -33,14 +111,24 @@ func createCanary() []byte {
 	totalLen := (2 * pageSize) + roundedLen
 
 	// Allocate it.
-	memory := memcall.Alloc(totalLen)
+	memory, err := memcall.Alloc(totalLen)
+	if err != nil {
+		panic(err)
+	}
 
 	// Make the guard pages inaccessible.
 	memcall.Protect(memory[:pageSize], false, false)
 	memcall.Protect(memory[pageSize+roundedLen:], false, false)
 
-	// Lock the pages that will hold the canary.
-	memcall.Lock(memory[pageSize : pageSize+roundedLen])
+	// Lock the pages that will hold the canary. If memory can't be locked at all then no LockedBuffers can be created anyway, and that is reported when trying to create one, so don't stop the program from starting up.
+	if ok, _ := memcall.LockSupported(); ok {
+		if err := memcall.Lock(memory[pageSize : pageSize+roundedLen]); err != nil {
+			panic(err)
+		}
+	}
+	if err := memcall.DontDump(memory[pageSize : pageSize+roundedLen]); err != nil {
+		panic(err)
+	}
 
 	// Fill the memory with cryptographically-secure random bytes (the canary value).
 	c := getBytes(uintptr(unsafe.Pointer(&memory[pageSize+roundedLen-32])), 32)
@@ -53,24 +141,266 @@ func createCanary() []byte {
 	return c
 }
 
+// Give the user's panic handler, if any, a chance to run before panicking with a given value.
+func safePanic(v interface{}) {
+	// Get a copy of the handler.
+	panicHandlerMutex.Lock()
+	f := panicHandler
+	panicHandlerMutex.Unlock()
+
+	// Run it, making sure that a panicking handler doesn't stop us from panicking with the original value.
+	if f != nil {
+		func() {
+			defer func() { recover() }()
+			f(v)
+		}()
+	}
+
+	panic(v)
+}
+
+// Largest value that an int can hold.
+const maxInt = int(^uint(0) >> 1)
+
+// Check that a LockedBuffer of a given size can be allocated, with guard pages of a given total length on either side, without the size calculations overflowing or the total allocation exceeding the limit.
+func checkAllocSize(size, canaryLen, guardLen int) error {
+	// Make sure that adding the canary and guard pages can't overflow.
+	if size > maxInt-canaryLen-pageSize-(2*guardLen) {
+		return ErrSizeTooLarge
+	}
+
+	// Get the current limit.
+	maxAllocSizeMutex.Lock()
+	limit := maxAllocSize
+	maxAllocSizeMutex.Unlock()
+
+	// Compare it to the total allocation.
+	if (2*guardLen)+roundToPageSize(size+canaryLen) > limit {
+		return ErrSizeTooLarge
+	}
+
+	return nil
+}
+
+// Get the current lock policy.
+func getLockPolicy() LockPolicy {
+	lockPolicyMutex.Lock()
+	defer lockPolicyMutex.Unlock()
+
+	return lockPolicy
+}
+
+// Lock a region of memory with an Allocator according to the lock policy, reporting whether it was actually locked.
+func lockMemory(a Allocator, b []byte) (bool, error) {
+	policy := getLockPolicy()
+	if policy == LockDisabled {
+		return false, nil
+	}
+
+	// Count it against the limit, giving it back if it doesn't end up locked.
+	if err := reserveLocked(len(b)); err != nil {
+		return false, err
+	}
+
+	// Get the retry policy.
+	lockRetryMutex.Lock()
+	attempts, delay := lockRetryAttempts, lockRetryDelay
+	lockRetryMutex.Unlock()
+
+	for {
+		err := lockFailureInjected()
+		if err == nil {
+			err = a.Lock(b)
+		}
+		if err == nil {
+			return true, nil
+		}
+
+		// Memory that is being unlocked elsewhere may free up room, so wait a bit and try again if that could help.
+		if attempts > 0 && isTransientLockError(err) {
+			attempts--
+			time.Sleep(delay)
+			delay *= 2
+			continue
+		}
+
+		// Let the observer know that we've given up.
+		getObserver().OnLockFailure(err)
+		releaseLocked(len(b))
+
+		if policy == LockBestEffort {
+			return false, nil
+		}
+		return false, err
+	}
+}
+
+// Check whether an error from locking memory means that the limit on locked memory was reached, rather than that locking can't work at all.
+func isTransientLockError(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ENOMEM) || errors.Is(err, syscall.Errno(1453)) // ERROR_WORKING_SET_QUOTA on windows.
+}
+
+// Count a number of bytes of memory that are about to be locked, unless that would take the total over the limit set with SetMemoryLimit.
+func reserveLocked(n int) error {
+	memoryLimitMutex.Lock()
+	defer memoryLimitMutex.Unlock()
+
+	if memoryLimit > 0 && n > memoryLimit-memoryLocked {
+		return ErrMemoryLimitExceeded
+	}
+	memoryLocked += n
+	return nil
+}
+
+// Stop counting a number of bytes of memory that are no longer locked.
+func releaseLocked(n int) {
+	memoryLimitMutex.Lock()
+	defer memoryLimitMutex.Unlock()
+
+	memoryLocked -= n
+}
+
+// Check whether new memory should be wiped in the children of a fork.
+func getWipeOnFork() bool {
+	wipeOnForkMutex.Lock()
+	defer wipeOnForkMutex.Unlock()
+
+	return wipeOnFork
+}
+
+// Check whether New and NewFromFunc should create mutable LockedBuffers.
+func getDefaultMutability() bool {
+	defaultMutableMutex.Lock()
+	defer defaultMutableMutex.Unlock()
+
+	return defaultMutable
+}
+
 // Round a length to a multiple of the system page size.
 func roundToPageSize(length int) int {
 	return (length + (pageSize - 1)) & (^(pageSize - 1))
 }
 
-// Get a slice that describes all memory related to a LockedBuffer.
-func getAllMemory(b *container) []byte {
-	// Calculate the size of the entire container's memory.
-	roundedBufLen := roundToPageSize(len(b.buffer) + 32)
+// Get the length of the guard pages to put on either side of a new LockedBuffer.
+func getGuardLen() int {
+	guardPageCountMutex.Lock()
+	defer guardPageCountMutex.Unlock()
 
-	// Calculate the address of the start of the memory.
-	memAddr := uintptr(unsafe.Pointer(&b.buffer[0])) - uintptr((roundedBufLen-len(b.buffer))+pageSize)
+	return guardPageCount * pageSize
+}
+
+// Get the canary length and reference value to use for a new LockedBuffer.
+func getCanarySettings() (int, []byte) {
+	canarySettingMutex.Lock()
+	defer canarySettingMutex.Unlock()
+
+	if canaryPattern != nil {
+		return canarySize, canaryPattern
+	}
+	return canarySize, canary
+}
+
+// Fill a slice with repetitions of a reference canary value.
+func fillCanary(c, ref []byte) {
+	for i := 0; i < len(c); i += len(ref) {
+		n := len(c) - i
+		if n > len(ref) {
+			n = len(ref)
+		}
+		subtle.ConstantTimeCopy(1, c[i:i+n], ref[:n])
+	}
+}
+
+// Check that the canary value preceding a LockedBuffer's data is intact.
+func canaryIntact(b *container) bool {
+	// The canary sits immediately before the data.
+	c := getBytes(uintptr(unsafe.Pointer(&b.buffer[0]))-uintptr(b.canaryLen), b.canaryLen)
+
+	// Compare it to repetitions of the reference value in constant time.
+	intact := 1
+	for i := 0; i < len(c); i += len(b.canaryRef) {
+		n := len(c) - i
+		if n > len(b.canaryRef) {
+			n = len(b.canaryRef)
+		}
+		intact &= subtle.ConstantTimeCompare(c[i:i+n], b.canaryRef[:n])
+	}
+	if intact != 1 || canaryMismatchInjected() {
+		getObserver().OnCanaryViolation()
+		return false
+	}
+	return true
+}
+
+// Lock two containers in a consistent order (by address) so that concurrent calls with the arguments swapped cannot deadlock. A container is only locked once if both arguments are the same.
+func lockPair(a, b *container) {
+	if a == b {
+		a.Lock()
+		return
+	}
+	if uintptr(unsafe.Pointer(a)) > uintptr(unsafe.Pointer(b)) {
+		a, b = b, a
+	}
+	a.Lock()
+	b.Lock()
+}
+
+// Unlock two containers that were locked with lockPair.
+func unlockPair(a, b *container) {
+	a.Unlock()
+	if a != b {
+		b.Unlock()
+	}
+}
+
+// Read-lock two containers in a consistent order (by address), in the same way as lockPair.
+func rlockPair(a, b *container) {
+	if a == b {
+		a.RLock()
+		return
+	}
+	if uintptr(unsafe.Pointer(a)) > uintptr(unsafe.Pointer(b)) {
+		a, b = b, a
+	}
+	a.RLock()
+	b.RLock()
+}
+
+// Unlock two containers that were read-locked with rlockPair.
+func runlockPair(a, b *container) {
+	a.RUnlock()
+	if a != b {
+		b.RUnlock()
+	}
+}
+
+// Lock any number of containers in a consistent order (by address), locking each one only once even if it appears more than once. The containers that were locked are returned so that they can be given to unlockAll.
+func lockAll(containers []*container) []*container {
+	// Sort a copy of the list, leaving out duplicates.
+	sorted := make([]*container, 0, len(containers))
+	for _, c := range containers {
+		i := sort.Search(len(sorted), func(i int) bool {
+			return uintptr(unsafe.Pointer(sorted[i])) >= uintptr(unsafe.Pointer(c))
+		})
+		if i < len(sorted) && sorted[i] == c {
+			continue
+		}
+		sorted = append(sorted, nil)
+		copy(sorted[i+1:], sorted[i:])
+		sorted[i] = c
+	}
 
-	// Calculate the size of the entire memory.
-	memLen := (pageSize * 2) + roundedBufLen
+	for _, c := range sorted {
+		c.Lock()
+	}
+	return sorted
+}
 
-	// Use this information to generate a slice and return it.
-	return getBytes(memAddr, memLen)
+// Unlock containers that were locked with lockAll.
+func unlockAll(containers []*container) {
+	for _, c := range containers {
+		c.Unlock()
+	}
 }
 
 // Convert a pointer and length to a byte slice that describes that memory.
@@ -87,12 +417,93 @@ func getBytes(ptr uintptr, len int) []byte {
 func fillRandBytes(b []byte) {
 	// Read len(b) bytes into the buffer.
 	if _, err := rand.Read(b); err != nil {
-		panic("memguard.csprng(): could not get random bytes")
+		safePanic("memguard.csprng(): could not get random bytes")
+	}
+}
+
+// Size of a machine word, and whether this architecture can load one from an address that isn't a multiple of it.
+const wordSize = int(unsafe.Sizeof(uintptr(0)))
+const unalignedOK = runtime.GOARCH == "386" || runtime.GOARCH == "amd64" || runtime.GOARCH == "arm64" || runtime.GOARCH == "ppc64" || runtime.GOARCH == "ppc64le" || runtime.GOARCH == "s390x"
+
+// Set dst to the exclusive-or of a and b, which must all be the same length.
+func xorBytes(dst, a, b []byte) {
+	n := len(dst)
+	if n == 0 {
+		return
+	}
+
+	// XOR whole words at a time when it's safe to do so.
+	var i int
+	if unalignedOK || (uintptr(unsafe.Pointer(&dst[0]))|uintptr(unsafe.Pointer(&a[0]))|uintptr(unsafe.Pointer(&b[0])))%uintptr(wordSize) == 0 {
+		for ; i+wordSize <= n; i += wordSize {
+			*(*uintptr)(unsafe.Pointer(&dst[i])) = *(*uintptr)(unsafe.Pointer(&a[i])) ^ *(*uintptr)(unsafe.Pointer(&b[i]))
+		}
+	}
+
+	// Finish off the remaining bytes.
+	for ; i < n; i++ {
+		dst[i] = a[i] ^ b[i]
 	}
 }
 
+// If wipe verification is enabled, read back a wiped byte slice and panic if any of it is not zero.
+func verifyWiped(buf []byte) {
+	wipeVerificationMutex.Lock()
+	enabled := wipeVerification
+	wipeVerificationMutex.Unlock()
+	if !enabled {
+		return
+	}
+
+	var x byte
+	for _, v := range buf {
+		x |= v
+	}
+	if x != 0 {
+		safePanic("memguard.Destroy(): memory was not wiped")
+	}
+}
+
+// Wipe the bytes behind a string. This is only safe for strings that were built at runtime, since string constants live in read-only memory.
+func wipeString(s string) {
+	if len(s) == 0 {
+		return
+	}
+	wipeBytes(getBytes(*(*uintptr)(unsafe.Pointer(&s)), len(s)))
+}
+
+// Wipe the bytes behind a string if they can be written to, reporting whether they were. Faults from trying to write to read-only memory, where string constants live, are caught and turned into a false result.
+func tryWipeString(s string) (wiped bool) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if recover() != nil {
+			wiped = false
+		}
+	}()
+
+	wipeString(s)
+	return true
+}
+
+// Length of the chunks that wipes are split into, so that wiping a very large buffer doesn't hold up the scheduler for long.
+const wipeChunkSize = 256 * 1024
+
+// Value that is written atomically after every chunk of a wipe, purely to act as a memory barrier.
+var wipeBarrier uint32
+
 // Wipes a byte slice with zeroes.
 func wipeBytes(buf []byte) {
+	for len(buf) > wipeChunkSize {
+		wipeChunk(buf[:wipeChunkSize])
+		buf = buf[wipeChunkSize:]
+	}
+	wipeChunk(buf)
+}
+
+// Wipe a single chunk. This is kept out of line so that the compiler can't reason about what happens to the memory afterwards, and the atomic store stops the zeroes from being reordered past the end of the wipe.
+//
+//go:noinline
+func wipeChunk(buf []byte) {
 	if len(buf) == 0 {
 		return
 	}
@@ -100,4 +511,5 @@ func wipeBytes(buf []byte) {
 	for bp := 1; bp < len(buf); bp *= 2 {
 		copy(buf[bp:], buf[:bp])
 	}
+	atomic.StoreUint32(&wipeBarrier, 0)
 }
@@ -0,0 +1,388 @@
+package memguard
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"io"
+)
+
+// Returned by Reader.Seek when given a whence that isn't one of the io.Seek constants.
+var errInvalidWhence = errors.New("memguard.Reader.Seek: invalid whence")
+
+/*
+Reader implements the io.Reader and io.Seeker interfaces on top of a LockedBuffer, allowing its contents to be streamed into anything that accepts an io.Reader (such as a hash function) or an io.ReadSeeker (such as many parsers) without exposing the whole buffer.
+
+The LockedBuffer is only accessed while holding its mutex. Since reading does not modify the LockedBuffer, it is safe to use a Reader on one that is immutable.
+*/
+type Reader struct {
+	b      *LockedBuffer // The LockedBuffer being read from.
+	offset int           // Index of the next byte to be read.
+}
+
+/*
+NewReader returns a Reader that reads from the start of a given LockedBuffer.
+*/
+func NewReader(b *LockedBuffer) *Reader {
+	return &Reader{b: b}
+}
+
+/*
+Read reads up to len(p) bytes from the LockedBuffer into p and returns the number of bytes read. Once the end of the LockedBuffer has been reached, it returns io.EOF.
+
+If the LockedBuffer is destroyed, even part of the way through the stream, the call will return an ErrDestroyed.
+*/
+func (r *Reader) Read(p []byte) (int, error) {
+	// Get a mutex lock on the LockedBuffer.
+	r.b.Lock()
+	defer r.b.Unlock()
+
+	// Check if it's destroyed.
+	if len(r.b.buffer) == 0 {
+		return 0, ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if r.b.hidden {
+		return 0, ErrHidden
+	}
+
+	// Check if there is anything left to read.
+	if r.offset >= len(r.b.buffer) {
+		return 0, io.EOF
+	}
+
+	// Copy the next chunk across and advance the offset.
+	n := copy(p, r.b.buffer[r.offset:])
+	r.offset += n
+
+	return n, nil
+}
+
+/*
+Seek sets the offset of the next Read, interpreted according to whence in the usual way: io.SeekStart means relative to the start of the LockedBuffer, io.SeekCurrent means relative to the current offset, and io.SeekEnd means relative to the end. It returns the new offset relative to the start.
+
+Unlike seeking in a file, the new offset must lie within the LockedBuffer, although it may be at the very end. If it doesn't, the call will return an ErrOutOfRange and the offset is left unchanged. If the LockedBuffer is destroyed, the call will return an ErrDestroyed.
+*/
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	// Get a mutex lock on the LockedBuffer.
+	r.b.Lock()
+	defer r.b.Unlock()
+
+	// Check if it's destroyed.
+	if len(r.b.buffer) == 0 {
+		return 0, ErrDestroyed
+	}
+
+	// Work out the new offset.
+	var base int64
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		base = int64(r.offset)
+	case io.SeekEnd:
+		base = int64(len(r.b.buffer))
+	default:
+		return 0, errInvalidWhence
+	}
+
+	// Check that it's within the buffer, taking care not to overflow.
+	if offset < -base || offset > int64(len(r.b.buffer))-base {
+		return 0, ErrOutOfRange
+	}
+
+	r.offset = int(base + offset)
+	return base + offset, nil
+}
+
+/*
+Writer implements the io.Writer interface on top of a LockedBuffer, allowing it to be filled from a stream (such as with io.Copy) without exposing the underlying slice.
+
+Bytes are written at an advancing offset starting from the beginning of the LockedBuffer. The LockedBuffer is never grown.
+*/
+type Writer struct {
+	b      *LockedBuffer // The LockedBuffer being written to.
+	offset int           // Index of the next byte to be written.
+}
+
+/*
+NewWriter returns a Writer that writes to the start of a given LockedBuffer.
+*/
+func NewWriter(b *LockedBuffer) *Writer {
+	return &Writer{b: b}
+}
+
+/*
+Write copies bytes from p into the LockedBuffer in constant-time and returns the number of bytes written. If there is not enough room left for all of p, as much as fits is written and io.ErrShortWrite is returned.
+
+If the LockedBuffer is immutable, the call will return an ErrImmutable. If it is destroyed, the call will return an ErrDestroyed.
+*/
+func (w *Writer) Write(p []byte) (int, error) {
+	// Get a mutex lock on the LockedBuffer.
+	w.b.Lock()
+	defer w.b.Unlock()
+
+	// Check if it's destroyed.
+	if len(w.b.buffer) == 0 {
+		return 0, ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if w.b.hidden {
+		return 0, ErrHidden
+	}
+
+	// Check if it's immutable.
+	if !w.b.mutable {
+		return 0, ErrImmutable
+	}
+
+	// Work out how much will fit.
+	n := len(w.b.buffer) - w.offset
+	if n > len(p) {
+		n = len(p)
+	}
+
+	// Do a time-constant copying of the bytes and advance the offset.
+	subtle.ConstantTimeCopy(1, w.b.buffer[w.offset:w.offset+n], p[:n])
+	w.offset += n
+
+	// Report if we ran out of room.
+	if n < len(p) {
+		return n, io.ErrShortWrite
+	}
+
+	return n, nil
+}
+
+/*
+ReadFrom implements the io.ReaderFrom interface on a Writer, so that io.Copy reads straight into the protected memory instead of going through an intermediate buffer, unless the source implements io.WriterTo, which io.Copy prefers. It reads into the LockedBuffer from the current offset until either it is full or r returns io.EOF, and returns the number of bytes read. Reaching the end of r is not an error, and nothing more is read from r once the LockedBuffer is full.
+
+If the LockedBuffer is immutable, the call will return an ErrImmutable. If it is destroyed, the call will return an ErrDestroyed.
+*/
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	// Get a mutex lock on the LockedBuffer.
+	w.b.Lock()
+	defer w.b.Unlock()
+
+	// Fill it from the current offset, and advance the offset.
+	n, err := w.b.readFrom(r, w.offset)
+	w.offset += int(n)
+
+	return n, err
+}
+
+/*
+ReadFrom fills a LockedBuffer from the beginning with data read from an io.Reader, implementing the io.ReaderFrom interface. It reads until either the LockedBuffer is full or r returns io.EOF, and returns the number of bytes read. Reaching the end of r is not an error, and the LockedBuffer is never grown, so nothing more is read from r once it is full. The mutex lock is held for the whole read.
+
+If the LockedBuffer is immutable, the call will return an ErrImmutable. If it is destroyed, the call will return an ErrDestroyed.
+*/
+func (b *container) ReadFrom(r io.Reader) (int64, error) {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	return b.readFrom(r, 0)
+}
+
+// Read from an io.Reader into a LockedBuffer that the caller holds the mutex lock on, starting at a given offset.
+func (b *container) readFrom(r io.Reader, offset int) (int64, error) {
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		return 0, ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if b.hidden {
+		return 0, ErrHidden
+	}
+
+	// Check if it's immutable.
+	if !b.mutable {
+		return 0, ErrImmutable
+	}
+
+	// Read until it's full or we run out of data.
+	n, err := io.ReadFull(r, b.buffer[offset:])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	return int64(n), err
+}
+
+/*
+WriteTo writes the contents of a LockedBuffer to an io.Writer, implementing the io.WriterTo interface. The mutex lock is held for the whole write, so the LockedBuffer cannot be destroyed or modified by another goroutine part of the way through.
+
+The io.Writer is handed a slice that references the protected memory directly, so it must not keep hold of it after Write returns. If the LockedBuffer is destroyed, the call will return an ErrDestroyed.
+*/
+func (b *container) WriteTo(w io.Writer) (int64, error) {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	return b.writeTo(w)
+}
+
+/*
+DrainTo writes the contents of a LockedBuffer to an io.Writer and then destroys it, without releasing the mutex lock in between, which is handy for passing a secret to something like the standard input of a subprocess.
+
+The LockedBuffer is destroyed even if the write fails, in which case the error is returned. If the LockedBuffer has already been destroyed, the call will return an ErrDestroyed.
+*/
+func DrainTo(b *LockedBuffer, w io.Writer) (int64, error) {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	// Write it out and then get rid of it.
+	n, err := b.writeTo(w)
+	b.destroy()
+
+	return n, err
+}
+
+// Write the contents of a LockedBuffer that the caller holds the mutex lock on to an io.Writer.
+func (b *container) writeTo(w io.Writer) (int64, error) {
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		return 0, ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if b.hidden {
+		return 0, ErrHidden
+	}
+
+	// Write it all out.
+	n, err := w.Write(b.buffer)
+	if err == nil && n < len(b.buffer) {
+		err = io.ErrShortWrite
+	}
+
+	return int64(n), err
+}
+
+/*
+LineReader reads lines from an io.Reader, such as a file containing one secret per line, directly into LockedBuffers.
+
+Data is read from the underlying reader into a LockedBuffer of its own, and each line is copied from there into a freshly allocated LockedBuffer, so no part of the input is ever held in regular memory by the LineReader. Bytes are wiped from the read buffer as soon as they have been copied out. The underlying reader may of course keep copies of its own.
+*/
+type LineReader struct {
+	r          io.Reader     // The source of the lines.
+	buf        *LockedBuffer // Holds data that has been read but not yet returned.
+	start, end int           // The region of buf that holds unconsumed data.
+	err        error         // The error returned by the last read, if any.
+}
+
+/*
+NewLineReader returns a LineReader that reads lines from a given io.Reader. Its read buffer is allocated on the first call to Next, and should be released by calling Destroy once the LineReader is no longer needed.
+*/
+func NewLineReader(r io.Reader) *LineReader {
+	return &LineReader{r: r}
+}
+
+/*
+Next returns the next line as a new, mutable LockedBuffer, without the trailing end-of-line marker ("\n" or "\r\n"). The final line is returned even if it does not end in a newline. Since LockedBuffers cannot be empty, empty lines are skipped.
+
+Once there are no lines left, the call will return io.EOF. If reading fails for any other reason, or a LockedBuffer cannot be allocated, the error is returned and the partial line is destroyed.
+*/
+func (l *LineReader) Next() (*LockedBuffer, error) {
+	// Allocate the read buffer if we haven't done so already.
+	if l.buf == nil {
+		buf, err := NewMutable(4096)
+		if err != nil {
+			return nil, err
+		}
+		l.buf = buf
+	}
+
+	var line *LockedBuffer
+	for {
+		// Look for the end of the line in what we have so far.
+		pending := l.buf.buffer[l.start:l.end]
+		i := bytes.IndexByte(pending, '\n')
+		if i < 0 {
+			i = len(pending)
+		}
+
+		// Move everything up to the end of the line across.
+		if i > 0 {
+			var err error
+			if line, err = appendLine(line, pending[:i]); err != nil {
+				return nil, err
+			}
+		}
+		if i < len(pending) {
+			wipeBytes(pending[i : i+1])
+			l.start += i + 1
+
+			// Return the line unless it's empty.
+			if line, err := trimLine(line); line != nil || err != nil {
+				return line, err
+			}
+			line = nil
+			continue
+		}
+		l.start, l.end = 0, 0
+
+		// Stop if the last read failed.
+		if l.err != nil {
+			// Return what's left of the final line.
+			if l.err == io.EOF {
+				if line, err := trimLine(line); line != nil || err != nil {
+					return line, err
+				}
+			} else if line != nil {
+				line.Destroy()
+			}
+			return nil, l.err
+		}
+
+		// Read some more.
+		l.end, l.err = l.r.Read(l.buf.buffer)
+	}
+}
+
+/*
+Destroy destroys the LineReader's read buffer, including any data that has been read but not yet returned by Next.
+*/
+func (l *LineReader) Destroy() {
+	if l.buf != nil {
+		l.buf.Destroy()
+	}
+}
+
+// Add some bytes to the end of a line, creating it if necessary. The bytes are wiped afterwards.
+func appendLine(line *LockedBuffer, p []byte) (*LockedBuffer, error) {
+	// Start a new line.
+	if line == nil {
+		return NewMutableFromBytes(p)
+	}
+
+	// Make room and move the bytes across.
+	size := line.Size()
+	grown, err := Resize(line, size+len(p))
+	if err != nil {
+		line.Destroy()
+		return nil, err
+	}
+	grown.MoveAt(p, size)
+
+	return grown, nil
+}
+
+// Remove a trailing carriage return from a line, destroying it if that leaves it empty.
+func trimLine(line *LockedBuffer) (*LockedBuffer, error) {
+	if line == nil || line.buffer[len(line.buffer)-1] != '\r' {
+		return line, nil
+	}
+	if line.Size() == 1 {
+		line.Destroy()
+		return nil, nil
+	}
+	trimmed, err := Resize(line, line.Size()-1)
+	if err != nil {
+		line.Destroy()
+	}
+	return trimmed, err
+}
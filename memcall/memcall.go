@@ -0,0 +1,42 @@
+package memcall
+
+import (
+	"os"
+	"sync"
+)
+
+var (
+	// Result of probing whether memory can be locked, and associated sync object.
+	lockSupported     bool
+	lockSupportedErr  error
+	lockSupportedOnce sync.Once
+)
+
+// Backend reports which implementation of the system calls is in use: "x/sys/unix" on Unix-like systems and "x/sys/windows" on Windows. Both call straight into the kernel through golang.org/x/sys without going through cgo, so this package builds with CGO_ENABLED=0 and when cross-compiling.
+func Backend() string {
+	return backend
+}
+
+// LockSupported reports whether this process is able to lock memory at all, by trying to lock a single page. The probe is only done once and the result is cached, so it does not reflect later changes to the limit. If locking is not possible, the error from Lock is returned alongside false.
+func LockSupported() (bool, error) {
+	lockSupportedOnce.Do(func() {
+		// Allocate a page to try it out on.
+		b, err := Alloc(os.Getpagesize())
+		if err != nil {
+			lockSupportedErr = err
+			return
+		}
+		defer Free(b)
+
+		// Try to lock it.
+		if err := Lock(b); err != nil {
+			lockSupportedErr = err
+			return
+		}
+		Unlock(b)
+
+		lockSupported = true
+	})
+
+	return lockSupported, lockSupportedErr
+}
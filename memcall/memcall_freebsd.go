@@ -8,15 +8,17 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-// Lock is a wrapper for unix.Mlock(), with extra precautions.
-func Lock(b []byte) {
-	// Advise the kernel not to dump. Ignore failure.
-	unix.Madvise(b, unix.MADV_NOCORE)
+// Name of the system call backend, as reported by Backend.
+const backend = "x/sys/unix"
 
+// Lock is a wrapper for unix.Mlock(), with extra precautions.
+func Lock(b []byte) error {
 	// Call mlock.
 	if err := unix.Mlock(b); err != nil {
-		panic(fmt.Sprintf("memguard.memcall.Lock(): could not acquire lock on %p, limit reached? [Err: %s]", &b[0], err))
+		return fmt.Errorf("memguard.memcall.Lock(): could not acquire lock on %p, limit reached? [Err: %w]", &b[0], err)
 	}
+
+	return nil
 }
 
 // Unlock is a wrapper for unix.Munlock().
@@ -26,12 +28,39 @@ func Unlock(b []byte) {
 	}
 }
 
+// LockAll is a wrapper for unix.Mlockall(), locking all current and future memory of the process.
+func LockAll() error {
+	if err := unix.Mlockall(unix.MCL_CURRENT | unix.MCL_FUTURE); err != nil {
+		return fmt.Errorf("memguard.memcall.LockAll(): could not lock process memory, limit reached? [Err: %w]", err)
+	}
+
+	return nil
+}
+
+// UnlockAll is a wrapper for unix.Munlockall(). Note that this unlocks all memory, including that locked with Lock.
+func UnlockAll() error {
+	if err := unix.Munlockall(); err != nil {
+		return fmt.Errorf("memguard.memcall.UnlockAll(): could not unlock process memory [Err: %w]", err)
+	}
+
+	return nil
+}
+
+// DontDump advises the kernel to leave a specified byte slice out of core dumps, using madvise(MADV_NOCORE).
+func DontDump(b []byte) error {
+	if err := unix.Madvise(b, unix.MADV_NOCORE); err != nil {
+		return fmt.Errorf("memguard.memcall.DontDump(): could not exclude %p from core dumps [Err: %w]", &b[0], err)
+	}
+
+	return nil
+}
+
 // Alloc allocates a byte slice of length n and returns it.
-func Alloc(n int) []byte {
+func Alloc(n int) ([]byte, error) {
 	// Allocate the memory.
 	b, err := unix.Mmap(-1, 0, n, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_NOCORE)
 	if err != nil {
-		panic(fmt.Sprintf("memguard.memcall.Alloc(): could not allocate [Err: %s]", err))
+		return nil, fmt.Errorf("memguard.memcall.Alloc(): could not allocate [Err: %w]", err)
 	}
 
 	// Fill memory with weird bytes in order to help catch bugs due to uninitialized data.
@@ -40,7 +69,7 @@ func Alloc(n int) []byte {
 	}
 
 	// Return the allocated memory.
-	return b
+	return b, nil
 }
 
 // Free unallocates the byte slice specified.
@@ -70,6 +99,18 @@ func Protect(b []byte, read, write bool) {
 	}
 }
 
+// LockLimit returns the number of bytes of memory that the process is allowed to lock, as set by RLIMIT_MEMLOCK, or -1 if there is no limit.
+func LockLimit() (int, error) {
+	var rlim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_MEMLOCK, &rlim); err != nil {
+		return 0, fmt.Errorf("memguard.memcall.LockLimit(): could not get rlimit [Err: %w]", err)
+	}
+	if uint64(rlim.Cur) == uint64(unix.RLIM_INFINITY) || uint64(rlim.Cur) > uint64(^uint(0)>>1) {
+		return -1, nil
+	}
+	return int(rlim.Cur), nil
+}
+
 // DisableCoreDumps disables core dumps on Unix systems.
 func DisableCoreDumps() {
 	// Disable core dumps.
@@ -0,0 +1,118 @@
+// +build linux,amd64 linux,arm64 linux,ppc64 linux,ppc64le linux,s390x linux,mips64 linux,mips64le
+
+package memcall
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// Size of a huge page, and associated sync object.
+	hugePageSize     int
+	hugePageSizeOnce sync.Once
+)
+
+// HugePageSize returns the size of the default huge page, as reported by /proc/meminfo, or zero if it cannot be determined.
+func HugePageSize() int {
+	hugePageSizeOnce.Do(func() {
+		f, err := os.Open("/proc/meminfo")
+		if err != nil {
+			return
+		}
+		defer f.Close()
+
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) == 3 && fields[0] == "Hugepagesize:" && fields[2] == "kB" {
+				if n, err := strconv.Atoi(fields[1]); err == nil {
+					hugePageSize = n * 1024
+				}
+				return
+			}
+		}
+	})
+
+	return hugePageSize
+}
+
+// AllocHuge allocates a region made up of n bytes of huge pages with guardLen bytes of normal, inaccessible pages on either side, and returns all of it. n must be a multiple of HugePageSize, and guardLen a multiple of the normal page size. The region must be freed with FreeHuge.
+func AllocHuge(n, guardLen int) ([]byte, error) {
+	// Check that the sizes make sense.
+	huge := HugePageSize()
+	if huge == 0 || n < 1 || n%huge != 0 {
+		return nil, errors.New("memguard.memcall.AllocHuge(): huge pages are not available for this size")
+	}
+
+	// Reserve enough address space to be able to align the huge pages.
+	total := guardLen + n + guardLen
+	reserved := total + huge
+	addr, err := mmap(0, reserved, unix.PROT_NONE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_NORESERVE)
+	if err != nil {
+		return nil, fmt.Errorf("memguard.memcall.AllocHuge(): could not reserve memory [Err: %w]", err)
+	}
+
+	// Map the huge pages over the aligned part of the reservation.
+	inner := (addr + uintptr(guardLen) + uintptr(huge-1)) &^ uintptr(huge-1)
+	if _, err := mmap(inner, n, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_FIXED|unix.MAP_HUGETLB); err != nil {
+		munmap(addr, reserved)
+		return nil, fmt.Errorf("memguard.memcall.AllocHuge(): could not allocate huge pages [Err: %w]", err)
+	}
+
+	// Give back the parts of the reservation that aren't needed.
+	start := inner - uintptr(guardLen)
+	if start > addr {
+		munmap(addr, int(start-addr))
+	}
+	if end := start + uintptr(total); end < addr+uintptr(reserved) {
+		munmap(end, int(addr+uintptr(reserved)-end))
+	}
+
+	// Fill memory with weird bytes in order to help catch bugs due to uninitialized data.
+	b := _getBytes(start, total)
+	for i := guardLen; i < guardLen+n; i++ {
+		b[i] = byte(0xdb)
+	}
+
+	return b, nil
+}
+
+// FreeHuge unallocates a region allocated with AllocHuge.
+func FreeHuge(b []byte) {
+	if err := munmap(uintptr(unsafe.Pointer(&b[0])), len(b)); err != nil {
+		panic(fmt.Sprintf("memguard.memcall.FreeHuge(): could not unallocate %p [Err: %s]", &b[0], err))
+	}
+}
+
+func mmap(addr uintptr, length, prot, flags int) (uintptr, error) {
+	r, _, errno := unix.Syscall6(unix.SYS_MMAP, addr, uintptr(length), uintptr(prot), uintptr(flags), ^uintptr(0), 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return r, nil
+}
+
+func munmap(addr uintptr, length int) error {
+	if _, _, errno := unix.Syscall(unix.SYS_MUNMAP, addr, uintptr(length), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func _getBytes(ptr uintptr, len int) []byte {
+	var sl = struct {
+		addr uintptr
+		len  int
+		cap  int
+	}{ptr, len, len}
+	return *(*[]byte)(unsafe.Pointer(&sl))
+}
@@ -0,0 +1,18 @@
+// +build !linux !amd64,!arm64,!ppc64,!ppc64le,!s390x,!mips64,!mips64le
+
+package memcall
+
+import "errors"
+
+// HugePageSize is included for compatibility reasons. Huge pages are only supported on 64-bit Linux, so elsewhere it always returns zero.
+func HugePageSize() int {
+	return 0
+}
+
+// AllocHuge is included for compatibility reasons. Huge pages are only supported on 64-bit Linux, so elsewhere it always returns an error.
+func AllocHuge(n, guardLen int) ([]byte, error) {
+	return nil, errors.New("memguard.memcall.AllocHuge(): huge pages are not supported on this platform")
+}
+
+// FreeHuge is included for compatibility reasons. Since AllocHuge never succeeds on this platform, there is never anything to free.
+func FreeHuge(b []byte) {}
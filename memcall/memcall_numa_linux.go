@@ -0,0 +1,39 @@
+// +build linux
+
+package memcall
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Memory policy and flags for mbind, from linux/mempolicy.h.
+const (
+	mpolBind     = 2
+	mpolMfStrict = 1 << 0
+	mpolMfMove   = 1 << 1
+)
+
+// Bind binds memory to a given NUMA node with mbind, so that its pages are only ever allocated from that node. Pages that have already been touched are moved there. b must start on a page boundary.
+func Bind(b []byte, node int) error {
+	if node < 0 || len(b) == 0 {
+		return errors.New("memguard.memcall.Bind(): invalid node or region")
+	}
+
+	// Build a mask with just the one node set. The kernel ignores the last bit of maxnode.
+	mask := make([]uint, node/bits.UintSize+1)
+	mask[node/bits.UintSize] = 1 << uint(node%bits.UintSize)
+	maxnode := len(mask)*bits.UintSize + 1
+
+	// Call mbind.
+	_, _, errno := unix.Syscall6(unix.SYS_MBIND, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), mpolBind, uintptr(unsafe.Pointer(&mask[0])), uintptr(maxnode), mpolMfStrict|mpolMfMove)
+	if errno != 0 {
+		return fmt.Errorf("memguard.memcall.Bind(): could not bind %p to node %d [Err: %w]", &b[0], node, errno)
+	}
+
+	return nil
+}
@@ -0,0 +1,10 @@
+// +build !linux
+
+package memcall
+
+import "errors"
+
+// Bind is included for compatibility reasons. Binding memory to a NUMA node is only supported on Linux, so elsewhere it always returns an error.
+func Bind(b []byte, node int) error {
+	return errors.New("memguard.memcall.Bind(): NUMA binding is not supported on this platform")
+}
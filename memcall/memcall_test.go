@@ -1,10 +1,21 @@
 package memcall
 
-import "testing"
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"unsafe"
+)
 
 func TestCycle(t *testing.T) {
 	DisableCoreDumps()
-	buffer := Alloc(32)
+	buffer, err := Alloc(32)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
 
 	// Test if the whole memory is filled with 0xdb.
 	for i := 0; i < 32; i++ {
@@ -14,16 +25,159 @@ func TestCycle(t *testing.T) {
 	}
 
 	Protect(buffer, true, true)
-	Lock(buffer)
+	if err := Lock(buffer); err != nil {
+		t.Error("unexpected error:", err)
+	}
 	Unlock(buffer)
 	Free(buffer)
 }
 
 func TestProtect(t *testing.T) {
-	buffer := Alloc(32)
+	buffer, _ := Alloc(32)
 	Protect(buffer, true, true)
 	Protect(buffer, true, false)
 	Protect(buffer, false, true)
 	Protect(buffer, false, false)
 	Free(buffer)
 }
+
+func TestLockAll(t *testing.T) {
+	// This can legitimately fail if the limit on locked memory is too low.
+	if err := LockAll(); err != nil {
+		t.Log("could not lock all memory:", err)
+	}
+	if err := UnlockAll(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestLockSupported(t *testing.T) {
+	ok, err := LockSupported()
+	if ok != (err == nil) {
+		t.Error("inconsistent result;", ok, err)
+	}
+
+	// The result should be cached.
+	if ok2, err2 := LockSupported(); ok2 != ok || err2 != err {
+		t.Error("result changed;", ok2, err2)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	want := "x/sys/unix"
+	if runtime.GOOS == "windows" {
+		want = "x/sys/windows"
+	}
+	if Backend() != want {
+		t.Error("unexpected backend;", Backend())
+	}
+}
+
+func TestLockLimit(t *testing.T) {
+	limit, err := LockLimit()
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if limit < -1 {
+		t.Error("unexpected limit;", limit)
+	}
+}
+
+func TestBind(t *testing.T) {
+	buffer, _ := Alloc(4096)
+	defer Free(buffer)
+
+	// Node 0 always exists, but the kernel may not support NUMA or may not let us use it.
+	if err := Bind(buffer, 0); err != nil {
+		t.Log("could not bind to node 0:", err)
+	}
+	if err := Bind(buffer, 1<<20); err == nil {
+		t.Error("expected error for nonexistent node")
+	}
+	if err := Bind(buffer, -1); err == nil {
+		t.Error("expected error for negative node")
+	}
+}
+
+func TestDontDump(t *testing.T) {
+	buffer, _ := Alloc(4096)
+	defer Free(buffer)
+
+	if err := DontDump(buffer); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	// On Linux, check that the kernel has flagged the mapping.
+	if runtime.GOOS != "linux" {
+		return
+	}
+	f, err := os.Open("/proc/self/smaps")
+	if err != nil {
+		t.Skip("could not read smaps:", err)
+	}
+	defer f.Close()
+
+	// Find the mapping that starts at our buffer, and then its flags.
+	start := fmt.Sprintf("%x-", uintptr(unsafe.Pointer(&buffer[0])))
+	var found bool
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, start) {
+			found = true
+		}
+		if found && strings.HasPrefix(line, "VmFlags:") {
+			if !strings.Contains(line, " dd") {
+				t.Error("mapping not flagged as dont-dump;", line)
+			}
+			return
+		}
+	}
+	t.Error("could not find mapping")
+}
+
+func TestAllocHuge(t *testing.T) {
+	huge := HugePageSize()
+	if huge == 0 {
+		if _, err := AllocHuge(4096, 4096); err == nil {
+			t.Error("expected error")
+		}
+		return
+	}
+
+	// The size has to be a multiple of the huge page size.
+	if _, err := AllocHuge(huge+1, os.Getpagesize()); err == nil {
+		t.Error("expected error")
+	}
+
+	// This can legitimately fail if no huge pages have been reserved.
+	guard := os.Getpagesize()
+	b, err := AllocHuge(huge, guard)
+	if err != nil {
+		t.Log("could not allocate huge pages:", err)
+		return
+	}
+	if len(b) != huge+2*guard {
+		t.Error("unexpected length;", len(b))
+	}
+	if uintptr(unsafe.Pointer(&b[guard]))%uintptr(huge) != 0 {
+		t.Error("huge pages not aligned")
+	}
+	for i := guard; i < guard+huge; i++ {
+		if b[i] != byte(0xdb) {
+			t.Error("unexpected byte:", b[i])
+			break
+		}
+	}
+
+	// The usual operations should work on a mixture of page sizes.
+	Protect(b[:guard], false, false)
+	Protect(b[guard+huge:], false, false)
+	if err := Lock(b[guard : guard+huge]); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	Protect(b[guard:guard+huge], true, false)
+	Protect(b, true, true)
+	Unlock(b[guard : guard+huge])
+	FreeHuge(b)
+}
@@ -3,20 +3,26 @@
 package memcall
 
 import (
+	"errors"
 	"fmt"
 	"unsafe"
 
 	"golang.org/x/sys/windows"
 )
 
+// Name of the system call backend, as reported by Backend.
+const backend = "x/sys/windows"
+
 // Placeholder variable for when we need a valid pointer to zero bytes.
 var _zero uintptr
 
 // Lock is a wrapper for windows.VirtualLock()
-func Lock(b []byte) {
+func Lock(b []byte) error {
 	if err := windows.VirtualLock(_getPtr(b), uintptr(len(b))); err != nil {
-		panic(fmt.Sprintf("memguard.memcall.Lock(): could not acquire lock on %p, limit reached? [Err: %s]", &b[0], err))
+		return fmt.Errorf("memguard.memcall.Lock(): could not acquire lock on %p, limit reached? [Err: %w]", &b[0], err)
 	}
+
+	return nil
 }
 
 // Unlock is a wrapper for windows.VirtualUnlock()
@@ -26,12 +32,27 @@ func Unlock(b []byte) {
 	}
 }
 
+// LockAll is included for compatibility reasons. Windows has no way of locking all of the memory of a process, so it always returns an error.
+func LockAll() error {
+	return errors.New("memguard.memcall.LockAll(): not supported on windows")
+}
+
+// UnlockAll is included for compatibility reasons. On windows it is a no-op function.
+func UnlockAll() error {
+	return nil
+}
+
+// DontDump is included for compatibility reasons. Windows has no way of excluding individual regions from crash dumps, so it is a no-op function.
+func DontDump(b []byte) error {
+	return nil
+}
+
 // Alloc allocates a byte slice of length n and returns it.
-func Alloc(n int) []byte {
+func Alloc(n int) ([]byte, error) {
 	// Allocate the memory.
 	ptr, err := windows.VirtualAlloc(_zero, uintptr(n), 0x1000|0x2000, 0x4)
 	if err != nil {
-		panic(fmt.Sprintf("memguard.memcall.Alloc(): could not allocate [Err: %s]", err))
+		return nil, fmt.Errorf("memguard.memcall.Alloc(): could not allocate [Err: %w]", err)
 	}
 
 	// Convert into a byte slice.
@@ -43,7 +64,7 @@ func Alloc(n int) []byte {
 	}
 
 	// Return the allocated memory.
-	return b
+	return b, nil
 }
 
 // Free unallocates the byte slice specified.
@@ -71,6 +92,11 @@ func Protect(b []byte, read, write bool) {
 	}
 }
 
+// LockLimit is included for compatibility reasons. Windows limits locked memory by the size of the working set, which Lock grows as needed, so it always returns -1.
+func LockLimit() (int, error) {
+	return -1, nil
+}
+
 // DisableCoreDumps is included for compatibility reasons. On windows it is a no-op function.
 func DisableCoreDumps() {}
 
@@ -0,0 +1,21 @@
+// +build linux
+
+package memcall
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// MADV_WIPEONFORK, from linux/mman.h, which is missing from golang.org/x/sys/unix.
+const madvWipeOnFork = 18
+
+// WipeOnFork asks the kernel to give the children of a fork zeroed pages in place of b, while the parent keeps its contents. This needs Linux 4.14 or later; older kernels return an error.
+func WipeOnFork(b []byte) error {
+	if err := unix.Madvise(b, madvWipeOnFork); err != nil {
+		return fmt.Errorf("memguard.memcall.WipeOnFork(): could not mark %p to be wiped on fork [Err: %w]", &b[0], err)
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+// +build linux,amd64
+
+package memcall
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestWipeOnFork(t *testing.T) {
+	buffer, _ := Alloc(4096)
+	defer Free(buffer)
+	for i := range buffer {
+		buffer[i] = 0xdb
+	}
+
+	if err := WipeOnFork(buffer); err != nil {
+		t.Skip("wiping on fork is not supported:", err)
+	}
+
+	// Fork, and have the child report whether its copy is all zeroes. Nothing but raw system calls can be used in the child.
+	pid, _, errno := syscall.RawSyscall(syscall.SYS_FORK, 0, 0, 0)
+	if errno != 0 {
+		t.Skip("could not fork:", errno)
+	}
+	if pid == 0 {
+		var x byte
+		for _, v := range buffer {
+			x |= v
+		}
+		syscall.RawSyscall(syscall.SYS_EXIT_GROUP, uintptr(x), 0, 0)
+	}
+
+	var status syscall.WaitStatus
+	if _, err := syscall.Wait4(int(pid), &status, 0, nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !status.Exited() || status.ExitStatus() != 0 {
+		t.Error("expected child's copy to be wiped;", status)
+	}
+
+	// The parent should keep its contents.
+	if buffer[0] != 0xdb || buffer[4095] != 0xdb {
+		t.Error("parent's copy was wiped")
+	}
+}
@@ -0,0 +1,10 @@
+// +build !linux
+
+package memcall
+
+import "errors"
+
+// WipeOnFork is included for compatibility reasons. Wiping memory in the children of a fork is only supported on Linux, so elsewhere it always returns an error.
+func WipeOnFork(b []byte) error {
+	return errors.New("memguard.memcall.WipeOnFork(): wiping on fork is not supported on this platform")
+}
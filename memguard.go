@@ -1,11 +1,20 @@
 package memguard
 
 import (
-	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/awnumar/memguard/memcall"
@@ -16,7 +25,7 @@ NewImmutable creates a new, immutable LockedBuffer of a specified size.
 
 The mutability can later be toggled with the MakeImmutable and MakeMutable methods.
 
-If the given length is less than one, the call will return an ErrInvalidLength.
+If the given length is less than one, the call will return an ErrInvalidLength, and if it is too large, the call will return an ErrSizeTooLarge. If the memory could not be allocated or locked, for example because the limit that the kernel places on locked memory has been reached, the underlying error is returned and nothing is left allocated. If this process cannot lock memory at all, the call will return an ErrLockUnavailable.
 */
 func NewImmutable(size int) (*LockedBuffer, error) {
 	return newContainer(size, false)
@@ -27,29 +36,61 @@ NewMutable creates a new, mutable LockedBuffer of a specified length.
 
 The mutability can later be toggled with the MakeImmutable and MakeMutable methods.
 
-If the given length is less than one, the call will return an ErrInvalidLength.
+If the given length is less than one, the call will return an ErrInvalidLength, and if it is too large, the call will return an ErrSizeTooLarge. If the memory could not be allocated or locked, for example because the limit that the kernel places on locked memory has been reached, the underlying error is returned and nothing is left allocated. If this process cannot lock memory at all, the call will return an ErrLockUnavailable.
 */
 func NewMutable(size int) (*LockedBuffer, error) {
 	return newContainer(size, true)
 }
 
+/*
+SetDefaultMutability sets whether the LockedBuffers created by New and NewFromFunc are mutable. It is true by default. Programs that only ever read their secrets once they've been set up can make it false, so that MakeMutable has to be called before anything can be written and stray writes crash instead of silently corrupting a secret.
+
+LockedBuffers that already exist, and those created by the constructors that name their mutability, are not affected.
+*/
+func SetDefaultMutability(mutable bool) {
+	defaultMutableMutex.Lock()
+	defer defaultMutableMutex.Unlock()
+
+	defaultMutable = mutable
+}
+
+/*
+New creates a new LockedBuffer of a specified length, which is identical to one created by NewMutable or NewImmutable depending on what was last given to SetDefaultMutability.
+
+If the given length is less than one, the call will return an ErrInvalidLength. Otherwise the errors are the same as for NewMutable.
+*/
+func New(size int) (*LockedBuffer, error) {
+	return newContainer(size, getDefaultMutability())
+}
+
+/*
+FillFunc sets the initial contents of a new LockedBuffer. It is given the whole buffer, which is writable and zeroed, and must not keep hold of it after returning.
+*/
+type FillFunc func(buf []byte) error
+
+/*
+NewFromFunc is identical to New but for the fact that fill is called to set the contents of the LockedBuffer before it is returned. This happens before it is made immutable, so an immutable LockedBuffer can be given its contents without ever passing through a mutable state. An immutable one is always given pages of its own, so that its immutability is enforced by the kernel even when the slab allocator is enabled.
+
+If fill returns an error, the LockedBuffer is destroyed and that error is returned.
+*/
+func NewFromFunc(size int, fill FillFunc) (*LockedBuffer, error) {
+	return newFilledContainer(size, getDefaultMutability(), false, fill)
+}
+
 /*
 NewImmutableFromBytes is identical to NewImmutable but for the fact that the created LockedBuffer is of the same length and has the same contents as a given slice. The slice is wiped after the bytes have been copied over.
 
+The contents are copied in before the LockedBuffer is made immutable, so there is never a mutable handle to it, and it is always given pages of its own so that its immutability is enforced by the kernel even when the slab allocator is enabled.
+
 If the size of the slice is zero, the call will return an ErrInvalidLength.
 */
 func NewImmutableFromBytes(buf []byte) (*LockedBuffer, error) {
-	// Create a new LockedBuffer.
-	b, err := NewMutableFromBytes(buf)
-	if err != nil {
-		return nil, err
-	}
-
-	// Mark as immutable.
-	b.MakeImmutable()
-
-	// Return a pointer to the LockedBuffer.
-	return b, nil
+	// Create a new LockedBuffer, copying the bytes from buf and wiping afterwards.
+	return newFilledContainer(len(buf), false, false, func(b []byte) error {
+		subtle.ConstantTimeCopy(1, b, buf)
+		wipeBytes(buf)
+		return nil
+	})
 }
 
 /*
@@ -72,22 +113,52 @@ func NewMutableFromBytes(buf []byte) (*LockedBuffer, error) {
 }
 
 /*
-NewImmutableRandom is identical to NewImmutable but for the fact that the created LockedBuffer is filled with cryptographically-secure pseudo-random bytes instead of zeroes. Therefore a LockedBuffer created with NewImmutableRandom can safely be used as an encryption key.
+NewImmutableFromString is identical to NewImmutableFromBytes but for the fact that the contents are copied from a string. Go strings can't normally be changed, but the bytes behind s are wiped afterwards where that is possible, which it is for any string that was built at runtime, such as one read from a file or decoded from a request.
+
+This relies on reaching underneath the string with the unsafe package, so it is a best effort only: string constants are compiled into read-only memory and are left alone, although they are visible in the program binary anyway, and the runtime may already have made other copies of the string, such as when it was converted from a slice, which can't be found and wiped.
+
+If the string is empty, the call will return an ErrInvalidLength.
 */
-func NewImmutableRandom(size int) (*LockedBuffer, error) {
-	// Create a new LockedBuffer for the key.
-	b, err := NewMutableRandom(size)
+func NewImmutableFromString(s string) (*LockedBuffer, error) {
+	return newFromString(s, false)
+}
+
+/*
+NewMutableFromString is identical to NewImmutableFromString but for the fact that the created LockedBuffer is mutable.
+*/
+func NewMutableFromString(s string) (*LockedBuffer, error) {
+	return newFromString(s, true)
+}
+
+// Copy a string into a new LockedBuffer, and then wipe it if we can.
+func newFromString(s string, mutable bool) (*LockedBuffer, error) {
+	// Create a new LockedBuffer, copying the string into it.
+	b, err := newFilledContainer(len(s), mutable, false, func(buf []byte) error {
+		copy(buf, s)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	// Mark as immutable if specified.
-	b.MakeImmutable()
+	// Wipe the original if we can.
+	tryWipeString(s)
 
-	// Return the LockedBuffer.
+	// Return a pointer to the LockedBuffer.
 	return b, nil
 }
 
+/*
+NewImmutableRandom is identical to NewImmutable but for the fact that the created LockedBuffer is filled with cryptographically-secure pseudo-random bytes instead of zeroes. Therefore a LockedBuffer created with NewImmutableRandom can safely be used as an encryption key.
+*/
+func NewImmutableRandom(size int) (*LockedBuffer, error) {
+	// Create a new LockedBuffer for the key, filling it with random data.
+	return newFilledContainer(size, false, false, func(b []byte) error {
+		fillRandBytes(b)
+		return nil
+	})
+}
+
 /*
 NewMutableRandom is identical to NewMutable but for the fact that the created LockedBuffer is filled with cryptographically-secure pseudo-random bytes instead of zeroes. Therefore a LockedBuffer created with NewMutableRandom can safely be used as an encryption key.
 */
@@ -105,6 +176,163 @@ func NewMutableRandom(size int) (*LockedBuffer, error) {
 	return b, nil
 }
 
+/*
+NewImmutableHugePages is identical to NewImmutable, except that the memory holding the data is made up of huge pages where the system supports them, which reduces the cost of locking and protecting the memory and the pressure on the TLB for LockedBuffers that are several megabytes in size. The guard pages either side are still normal pages.
+
+Huge pages are currently only used on 64-bit Linux, and only if some have been reserved by the administrator, such as through /proc/sys/vm/nr_hugepages. Otherwise the call falls back to normal pages and is no different to NewImmutable. Since the data takes up a whole number of huge pages, small LockedBuffers are better off using normal pages.
+*/
+func NewImmutableHugePages(size int) (*LockedBuffer, error) {
+	return newFilledContainer(size, false, true, nil)
+}
+
+/*
+NewMutableHugePages is identical to NewImmutableHugePages but for the fact that the created LockedBuffer is mutable.
+*/
+func NewMutableHugePages(size int) (*LockedBuffer, error) {
+	return newFilledContainer(size, true, true, nil)
+}
+
+/*
+NewImmutableOnNode is identical to NewImmutable but for the fact that the pages that hold the data of the created LockedBuffer are bound to a given NUMA node, so that a multi-socket machine can keep a frequently used secret close to the processor that uses it. The guard pages and the canary work as normal, and the LockedBuffer is always given pages of its own.
+
+Binding is only supported on Linux, with the default Allocator. If the node doesn't exist, or the memory could not be bound to it, that error is returned, and on other platforms the call always returns an error. If a custom Allocator is in use, the call will return an ErrUnsupported.
+*/
+func NewImmutableOnNode(size, node int) (*LockedBuffer, error) {
+	return newOnNode(size, node, false)
+}
+
+/*
+NewMutableOnNode is identical to NewImmutableOnNode but for the fact that the created LockedBuffer is mutable.
+*/
+func NewMutableOnNode(size, node int) (*LockedBuffer, error) {
+	return newOnNode(size, node, true)
+}
+
+// Create a new LockedBuffer on a given NUMA node.
+func newOnNode(size, node int, mutable bool) (*LockedBuffer, error) {
+	// Only the default Allocator hands out memory that mbind understands.
+	if !isDefaultAllocator(getAllocator()) {
+		return nil, ErrUnsupported
+	}
+	if node < 0 {
+		return nil, ErrOutOfRange
+	}
+
+	return newNodeContainer(size, mutable, false, node, nil)
+}
+
+/*
+NewFromMmap creates a LockedBuffer that refers to a region of memory that memguard did not allocate, such as part of a secret file that has been mapped with mmap, so that it can be compared, hashed, and so on with the rest of the API without being copied out. The LockedBuffer does not take ownership of the region: memguard does not lock it, protect it, or surround it with guard pages or a canary, and when the LockedBuffer is destroyed the region is neither unlocked nor freed. That remains the job of whoever allocated it, and it must stay mapped until the LockedBuffer has been destroyed.
+
+If writable is true, the LockedBuffer starts off mutable and the region is wiped when it is destroyed. Otherwise the region is assumed to be read-only, so the LockedBuffer is immutable, MakeMutable returns an ErrUnsupported, and the region is left as it is when the LockedBuffer is destroyed. Since the region isn't ours to protect, MakeImmutable on a writable one and Hide on either return an ErrUnsupported.
+
+If the region is empty, the call will return an ErrInvalidLength.
+*/
+func NewFromMmap(region []byte, writable bool) (*LockedBuffer, error) {
+	// Return an error if length < 1.
+	if len(region) < 1 {
+		return nil, ErrInvalidLength
+	}
+
+	// Wrap the region, making sure that it can't be extended with append.
+	b := &LockedBuffer{new(container), new(littleBird)}
+	b.buffer = region[:len(region):len(region)]
+	b.inner = b.buffer
+	b.foreign = true
+	b.readOnly = !writable
+	b.mutable = writable
+
+	// Start keeping track of it.
+	track(b)
+
+	// Return a pointer to the LockedBuffer.
+	return b, nil
+}
+
+/*
+NewImmutableFromReader is identical to NewImmutable but for the fact that the created LockedBuffer is filled with exactly size bytes read from a given io.Reader, so that the data never has to pass through a regular slice on its way into protected memory.
+
+If the reader runs out of data before the LockedBuffer is full, the call will return io.ErrUnexpectedEOF, or io.EOF if nothing could be read at all. Any other read error is returned as it is. In every case the partially filled LockedBuffer is destroyed.
+*/
+func NewImmutableFromReader(r io.Reader, size int) (*LockedBuffer, error) {
+	// Create a new LockedBuffer, filling it from the reader.
+	return newFilledContainer(size, false, false, func(b []byte) error {
+		_, err := io.ReadFull(r, b)
+		return err
+	})
+}
+
+/*
+NewMutableFromReader is identical to NewMutable but for the fact that the created LockedBuffer is filled with exactly size bytes read from a given io.Reader, so that the data never has to pass through a regular slice on its way into protected memory.
+
+If the reader runs out of data before the LockedBuffer is full, the call will return io.ErrUnexpectedEOF, or io.EOF if nothing could be read at all. Any other read error is returned as it is. In every case the partially filled LockedBuffer is destroyed.
+*/
+func NewMutableFromReader(r io.Reader, size int) (*LockedBuffer, error) {
+	// Create a new LockedBuffer.
+	b, err := newContainer(size, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fill it from the reader.
+	if _, err := io.ReadFull(r, b.buffer); err != nil {
+		b.Destroy()
+		return nil, err
+	}
+
+	// Return a pointer to the LockedBuffer.
+	return b, nil
+}
+
+/*
+NewImmutableFromEnv is identical to NewImmutable but for the fact that the created LockedBuffer holds the value of a given environment variable, which is then removed from the environment. This is meant for secrets that are handed to a service through its environment.
+
+The copy of the value that Go keeps is wiped, as far as is possible, once it has been copied over. Note that the environment block that the process was started with, as seen in /proc/self/environ on Linux, is not affected; removing the variable only stops it from being seen by this process through the os package and from being passed on to child processes.
+
+If the variable is not set, the call will return an ErrEnvNotSet. If it is empty, the call will return an ErrInvalidLength. If the variable could not be removed, that error is returned and the LockedBuffer is destroyed.
+*/
+func NewImmutableFromEnv(key string) (*LockedBuffer, error) {
+	return newFromEnv(key, false)
+}
+
+/*
+NewMutableFromEnv is identical to NewImmutableFromEnv but for the fact that the created LockedBuffer is mutable.
+*/
+func NewMutableFromEnv(key string) (*LockedBuffer, error) {
+	return newFromEnv(key, true)
+}
+
+// Move the value of an environment variable into a new LockedBuffer.
+func newFromEnv(key string, mutable bool) (*LockedBuffer, error) {
+	// Look up the variable.
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return nil, ErrEnvNotSet
+	}
+	if len(value) == 0 {
+		return nil, ErrInvalidLength
+	}
+
+	// Create a new LockedBuffer, copying the value in.
+	b, err := newFilledContainer(len(value), mutable, false, func(buf []byte) error {
+		copy(buf, value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove the variable from the environment, and then wipe what's left of it.
+	if err := os.Unsetenv(key); err != nil {
+		b.Destroy()
+		return nil, err
+	}
+	wipeString(value)
+
+	// Return a pointer to the LockedBuffer.
+	return b, nil
+}
+
 /*
 Buffer returns a slice that references the secure, protected portion of memory.
 
@@ -122,6 +350,76 @@ func (b *container) Buffer() []byte {
 	return b.buffer
 }
 
+/*
+Slice returns a slice that references just a region of the protected memory, starting at an offset and ending after a given number of bytes, so that only the part that is needed, such as a nonce, has to be passed on. The capacity of the slice is limited to its length, so appending to it can never spill over into the rest of the LockedBuffer.
+
+Just like with Buffer, the slice is only valid until the LockedBuffer is destroyed, and it can only be written to if the LockedBuffer is mutable. Use WithSlice to hold the mutex lock while the region is in use.
+
+If the LockedBuffer has been destroyed, the call will return an ErrDestroyed. If the region does not lie entirely within the LockedBuffer, the call will return an ErrOutOfRange.
+*/
+func (b *container) Slice(offset, length int) ([]byte, error) {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	return b.slice(offset, length)
+}
+
+// Get a region of the buffer, checking that it is within bounds. The mutex must be held.
+func (b *container) slice(offset, length int) ([]byte, error) {
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		return nil, ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if b.hidden {
+		return nil, ErrHidden
+	}
+
+	// Check that the region is within bounds, which also keeps it clear of the canary.
+	if offset < 0 || length < 0 || length > len(b.buffer)-offset {
+		return nil, ErrOutOfRange
+	}
+
+	return b.buffer[offset : offset+length : offset+length], nil
+}
+
+/*
+CopyOut copies the contents of a LockedBuffer into a regular byte slice and returns the number of bytes copied. Just like Golang's built-in copy function, CopyOut only copies up to the smallest of the two buffers.
+
+WARNING: dst is not protected in any way, so the copy can be swapped to disk, included in core dumps, and left behind in memory long after it is no longer needed. CopyOut exists for passing secrets to APIs that cannot accept a LockedBuffer, and you should call WipeBytes on dst as soon as you are done with it. Every call is counted, and the total is available from ExposureCount, to make it easier to audit how often secrets leave protected memory.
+
+If the LockedBuffer is destroyed, the call will return an ErrDestroyed.
+*/
+func (b *container) CopyOut(dst []byte) (int, error) {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		return 0, ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if b.hidden {
+		return 0, ErrHidden
+	}
+
+	// Count the exposure.
+	atomic.AddUint64(&exposureCount, 1)
+
+	// Do a time-constant copying of the bytes.
+	n := len(dst)
+	if n > len(b.buffer) {
+		n = len(b.buffer)
+	}
+	subtle.ConstantTimeCopy(1, dst[:n], b.buffer[:n])
+
+	return n, nil
+}
+
 /*
 Uint8 returns a slice (of type []uint8) that references the secure, protected portion of memory.
 
@@ -137,6 +435,11 @@ func (b *container) Uint8() ([]uint8, error) {
 		return nil, ErrDestroyed
 	}
 
+	// Check to see if it's hidden.
+	if b.hidden {
+		return nil, ErrHidden
+	}
+
 	// Return the slice.
 	return []uint8(b.buffer), nil
 }
@@ -156,6 +459,11 @@ func (b *container) Uint16() ([]uint16, error) {
 		return nil, ErrDestroyed
 	}
 
+	// Check to see if it's hidden.
+	if b.hidden {
+		return nil, ErrHidden
+	}
+
 	// Check to see if it's an appropriate length.
 	if len(b.buffer)%2 != 0 {
 		return nil, ErrInvalidConversion
@@ -187,6 +495,11 @@ func (b *container) Uint32() ([]uint32, error) {
 		return nil, ErrDestroyed
 	}
 
+	// Check to see if it's hidden.
+	if b.hidden {
+		return nil, ErrHidden
+	}
+
 	// Check to see if it's an appropriate length.
 	if len(b.buffer)%4 != 0 {
 		return nil, ErrInvalidConversion
@@ -218,6 +531,11 @@ func (b *container) Uint64() ([]uint64, error) {
 		return nil, ErrDestroyed
 	}
 
+	// Check to see if it's hidden.
+	if b.hidden {
+		return nil, ErrHidden
+	}
+
 	// Check to see if it's an appropriate length.
 	if len(b.buffer)%8 != 0 {
 		return nil, ErrInvalidConversion
@@ -247,6 +565,11 @@ func (b *container) Int8() ([]int8, error) {
 		return nil, ErrDestroyed
 	}
 
+	// Check to see if it's hidden.
+	if b.hidden {
+		return nil, ErrHidden
+	}
+
 	// Perform the conversion.
 	var sl = struct {
 		addr uintptr
@@ -273,6 +596,11 @@ func (b *container) Int16() ([]int16, error) {
 		return nil, ErrDestroyed
 	}
 
+	// Check to see if it's hidden.
+	if b.hidden {
+		return nil, ErrHidden
+	}
+
 	// Check to see if it's an appropriate length.
 	if len(b.buffer)%2 != 0 {
 		return nil, ErrInvalidConversion
@@ -304,6 +632,11 @@ func (b *container) Int32() ([]int32, error) {
 		return nil, ErrDestroyed
 	}
 
+	// Check to see if it's hidden.
+	if b.hidden {
+		return nil, ErrHidden
+	}
+
 	// Check to see if it's an appropriate length.
 	if len(b.buffer)%4 != 0 {
 		return nil, ErrInvalidConversion
@@ -335,6 +668,11 @@ func (b *container) Int64() ([]int64, error) {
 		return nil, ErrDestroyed
 	}
 
+	// Check to see if it's hidden.
+	if b.hidden {
+		return nil, ErrHidden
+	}
+
 	// Check to see if it's an appropriate length.
 	if len(b.buffer)%8 != 0 {
 		return nil, ErrInvalidConversion
@@ -352,123 +690,172 @@ func (b *container) Int64() ([]int64, error) {
 }
 
 /*
-IsMutable returns a boolean value indicating if a LockedBuffer is marked read-only.
+Uint32At reads four bytes from the LockedBuffer, starting at a specified offset, and returns them as a big-endian uint32.
+
+If the four bytes do not lie entirely within the LockedBuffer, the call will return an ErrOutOfRange.
 */
-func (b *container) IsMutable() bool {
-	// Get a mutex lock on this LockedBuffer.
+func (b *container) Uint32At(offset int) (uint32, error) {
+	// Attain the mutex lock.
 	b.Lock()
 	defer b.Unlock()
 
-	return b.mutable
-}
+	// Check to see if it's destroyed.
+	if len(b.buffer) == 0 {
+		return 0, ErrDestroyed
+	}
 
-/*
-IsDestroyed returns a boolean value indicating if a LockedBuffer has been destroyed.
-*/
-func (b *container) IsDestroyed() bool {
-	// Get a mutex lock on this LockedBuffer.
-	b.Lock()
-	defer b.Unlock()
+	// Check to see if it's hidden.
+	if b.hidden {
+		return 0, ErrHidden
+	}
 
-	// Return the appropriate value.
-	return len(b.buffer) == 0
+	// Check that the value is within bounds.
+	if offset < 0 || offset > len(b.buffer)-4 {
+		return 0, ErrOutOfRange
+	}
+
+	// Return the value.
+	return binary.BigEndian.Uint32(b.buffer[offset:]), nil
 }
 
 /*
-EqualBytes compares a LockedBuffer to a byte slice in constant time.
+Uint64At reads eight bytes from the LockedBuffer, starting at a specified offset, and returns them as a big-endian uint64.
+
+If the eight bytes do not lie entirely within the LockedBuffer, the call will return an ErrOutOfRange.
 */
-func (b *container) EqualBytes(buf []byte) (bool, error) {
-	// Get a mutex lock on this LockedBuffer.
+func (b *container) Uint64At(offset int) (uint64, error) {
+	// Attain the mutex lock.
 	b.Lock()
 	defer b.Unlock()
 
-	// Check if it's destroyed.
+	// Check to see if it's destroyed.
 	if len(b.buffer) == 0 {
-		return false, ErrDestroyed
+		return 0, ErrDestroyed
 	}
 
-	// Do a time-constant comparison.
-	if subtle.ConstantTimeCompare(b.buffer, buf) == 1 {
-		// They're equal.
-		return true, nil
+	// Check to see if it's hidden.
+	if b.hidden {
+		return 0, ErrHidden
 	}
 
-	// They're not equal.
-	return false, nil
+	// Check that the value is within bounds.
+	if offset < 0 || offset > len(b.buffer)-8 {
+		return 0, ErrOutOfRange
+	}
+
+	// Return the value.
+	return binary.BigEndian.Uint64(b.buffer[offset:]), nil
 }
 
 /*
-MakeImmutable asks the kernel to mark the LockedBuffer's memory as immutable. Any subsequent attempts to modify this memory will result in the process crashing with a SIGSEGV memory violation.
+PutUint32At writes a uint32 into the LockedBuffer in big-endian byte order, starting at a specified offset.
 
-To make the memory mutable again, MakeMutable is called.
+If the LockedBuffer is immutable, the call will return an ErrImmutable. If the four bytes do not lie entirely within the LockedBuffer, the call will return an ErrOutOfRange.
 */
-func (b *container) MakeImmutable() error {
-	// Get a mutex lock on this LockedBuffer.
+func (b *container) PutUint32At(offset int, v uint32) error {
+	// Attain the mutex lock.
 	b.Lock()
 	defer b.Unlock()
 
-	// Check if it's destroyed.
+	// Check to see if it's destroyed.
 	if len(b.buffer) == 0 {
 		return ErrDestroyed
 	}
 
-	if b.mutable {
-		// Mark the memory as mutable.
-		memcall.Protect(getAllMemory(b)[pageSize:pageSize+roundToPageSize(len(b.buffer)+32)], true, false)
+	// Check to see if it's hidden.
+	if b.hidden {
+		return ErrHidden
+	}
 
-		// Tell everyone about the change we made.
-		b.mutable = false
+	// Check if it's immutable.
+	if !b.mutable {
+		return ErrImmutable
+	}
+
+	// Check that the value is within bounds.
+	if offset < 0 || offset > len(b.buffer)-4 {
+		return ErrOutOfRange
 	}
 
+	// Write the value.
+	binary.BigEndian.PutUint32(b.buffer[offset:], v)
+
 	// Everything went well.
 	return nil
 }
 
 /*
-MakeMutable asks the kernel to mark the LockedBuffer's memory as mutable.
+PutUint64At writes a uint64 into the LockedBuffer in big-endian byte order, starting at a specified offset.
 
-To make the memory immutable again, MakeImmutable is called.
+If the LockedBuffer is immutable, the call will return an ErrImmutable. If the eight bytes do not lie entirely within the LockedBuffer, the call will return an ErrOutOfRange.
 */
-func (b *container) MakeMutable() error {
-	// Get a mutex lock on this LockedBuffer.
+func (b *container) PutUint64At(offset int, v uint64) error {
+	// Attain the mutex lock.
 	b.Lock()
 	defer b.Unlock()
 
-	// Check if it's destroyed.
+	// Check to see if it's destroyed.
 	if len(b.buffer) == 0 {
 		return ErrDestroyed
 	}
 
+	// Check to see if it's hidden.
+	if b.hidden {
+		return ErrHidden
+	}
+
+	// Check if it's immutable.
 	if !b.mutable {
-		// Mark the memory as mutable.
-		memcall.Protect(getAllMemory(b)[pageSize:pageSize+roundToPageSize(len(b.buffer)+32)], true, true)
+		return ErrImmutable
+	}
 
-		// Tell everyone about the change we made.
-		b.mutable = true
+	// Check that the value is within bounds.
+	if offset < 0 || offset > len(b.buffer)-8 {
+		return ErrOutOfRange
 	}
 
+	// Write the value.
+	binary.BigEndian.PutUint64(b.buffer[offset:], v)
+
 	// Everything went well.
 	return nil
 }
 
 /*
-Copy copies bytes from a byte slice into a LockedBuffer in constant-time. Just like Golang's built-in copy function, Copy only copies up to the smallest of the two buffers.
-
-It does not wipe the original slice so using Copy is less secure than using Move. Therefore Move should be favoured unless you have a good reason.
+BigInt interprets the contents of the LockedBuffer as a big-endian unsigned integer and returns it as a big.Int, for doing modular arithmetic with secret values.
 
-You should aim to call WipeBytes on the original slice as soon as possible.
+WARNING: the big.Int keeps its own copy of the value on the regular heap, where it is not protected in any way, and big.Int operations make further copies that can't be wiped. BigInt is the one place where this conversion should happen so that it's easy to audit; every call is counted in ExposureCount, just like CopyOut. Use PutBigInt to write the result back into protected memory.
 
-If the LockedBuffer is marked as read-only, the call will fail and return an ErrReadOnly.
+If the LockedBuffer is destroyed, the call will return an ErrDestroyed.
 */
-func (b *container) Copy(buf []byte) error {
-	// Just call CopyAt with a zero offset.
-	return b.CopyAt(buf, 0)
+func (b *container) BigInt() (*big.Int, error) {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		return nil, ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if b.hidden {
+		return nil, ErrHidden
+	}
+
+	// Count the exposure.
+	atomic.AddUint64(&exposureCount, 1)
+
+	// Convert the value.
+	return new(big.Int).SetBytes(b.buffer), nil
 }
 
 /*
-CopyAt is identical to Copy but it copies into the LockedBuffer at a specified offset.
+PutBigInt writes a non-negative big.Int into a LockedBuffer as a big-endian unsigned integer, padded with leading zeroes to fill the whole LockedBuffer. The temporary copy of the bytes that this requires is wiped before returning.
+
+If the LockedBuffer is immutable, the call will return an ErrImmutable. If x is negative or does not fit into the LockedBuffer, the call will return an ErrOutOfRange. If the LockedBuffer is destroyed, the call will return an ErrDestroyed.
 */
-func (b *container) CopyAt(buf []byte, offset int) error {
+func PutBigInt(b *LockedBuffer, x *big.Int) error {
 	// Get a mutex lock on this LockedBuffer.
 	b.Lock()
 	defer b.Unlock()
@@ -478,63 +865,95 @@ func (b *container) CopyAt(buf []byte, offset int) error {
 		return ErrDestroyed
 	}
 
+	// Check if it's hidden.
+	if b.hidden {
+		return ErrHidden
+	}
+
 	// Check if it's immutable.
 	if !b.mutable {
 		return ErrImmutable
 	}
 
-	// Do a time-constant copying of the bytes, copying only up to the length of the buffer.
-	if len(b.buffer[offset:]) > len(buf) {
-		subtle.ConstantTimeCopy(1, b.buffer[offset:offset+len(buf)], buf)
-	} else if len(b.buffer[offset:]) < len(buf) {
-		subtle.ConstantTimeCopy(1, b.buffer[offset:], buf[:len(b.buffer[offset:])])
-	} else {
-		subtle.ConstantTimeCopy(1, b.buffer[offset:], buf)
+	// Check that the value fits.
+	if x.Sign() < 0 || (x.BitLen()+7)/8 > len(b.buffer) {
+		return ErrOutOfRange
 	}
 
+	// Write the value, padded on the left, and wipe the temporary copy.
+	v := x.Bytes()
+	pad := len(b.buffer) - len(v)
+	wipeBytes(b.buffer[:pad])
+	copy(b.buffer[pad:], v)
+	wipeBytes(v)
+
+	// Everything went well.
 	return nil
 }
 
 /*
-Move moves bytes from a byte slice into a LockedBuffer in constant-time. Just like Golang's built-in copy function, Move only moves up to the smallest of the two buffers.
+IsMutable returns a boolean value indicating if a LockedBuffer is marked read-only.
+*/
+func (b *container) IsMutable() bool {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
 
-Unlike Copy, Move wipes the entire original slice after copying the appropriate number of bytes over, and so it should be favoured unless you have a good reason.
+	return b.mutable
+}
 
-If the LockedBuffer is marked as read-only, the call will fail and return an ErrReadOnly.
+/*
+IsDestroyed returns a boolean value indicating if a LockedBuffer has been destroyed.
 */
-func (b *container) Move(buf []byte) error {
-	// Just call MoveAt with a zero offset.
-	return b.MoveAt(buf, 0)
+func (b *container) IsDestroyed() bool {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	// Return the appropriate value.
+	return len(b.buffer) == 0
 }
 
 /*
-MoveAt is identical to Move but it copies into the LockedBuffer at a specified offset.
+AssertAlive returns an ErrDestroyed if a LockedBuffer has been destroyed, and nil otherwise. Unlike IsDestroyed, it also accepts a nil pointer or a LockedBuffer that was never created by this package, treating them as destroyed, so it can be used to guard code paths that might be handed a LockedBuffer that isn't usable, and to turn lifecycle bugs into a clear error rather than a nil dereference or an index out of range panic.
 */
-func (b *container) MoveAt(buf []byte, offset int) error {
-	// Copy buf into the LockedBuffer.
-	if err := b.CopyAt(buf, offset); err != nil {
-		return err
+func AssertAlive(b *LockedBuffer) error {
+	if b == nil || b.container == nil || b.IsDestroyed() {
+		return ErrDestroyed
 	}
+	return nil
+}
 
-	// Wipe the old bytes.
-	wipeBytes(buf)
+/*
+IsHidden returns a boolean value indicating if a LockedBuffer's memory has been made inaccessible with Hide.
+*/
+func (b *container) IsHidden() bool {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
 
-	// Everything went well.
-	return nil
+	// Return the appropriate value.
+	return b.hidden
 }
 
 /*
-FillRandomBytes fills a LockedBuffer with cryptographically-secure pseudo-random bytes.
+IsLocked returns a boolean value indicating if a LockedBuffer's memory is locked into RAM, so that it cannot be swapped out to disk. This is always true unless the lock policy set with SetLockPolicy allowed it to be created without locking.
 */
-func (b *container) FillRandomBytes() error {
-	// Just call FillRandomBytesAt.
-	return b.FillRandomBytesAt(0, b.Size())
+func (b *container) IsLocked() bool {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	// Return the appropriate value.
+	return b.locked
 }
 
 /*
-FillRandomBytesAt fills a LockedBuffer with cryptographically-secure pseudo-random bytes, starting at an offset and ending after a given number of bytes.
+SetTTL arranges for a LockedBuffer to be destroyed automatically once a specified duration has passed, as a backstop against secrets that are accidentally kept around for longer than they should be. Calling SetTTL again replaces the previous deadline, so it can be used to extend the lifetime of a LockedBuffer that is still in use, and calling it with a duration that is zero or negative cancels it.
+
+The timer is stopped if the LockedBuffer is destroyed before it fires. If the LockedBuffer has already been destroyed, the call will return an ErrDestroyed.
 */
-func (b *container) FillRandomBytesAt(offset, length int) error {
+func (b *container) SetTTL(d time.Duration) error {
 	// Get a mutex lock on this LockedBuffer.
 	b.Lock()
 	defer b.Unlock()
@@ -544,278 +963,1404 @@ func (b *container) FillRandomBytesAt(offset, length int) error {
 		return ErrDestroyed
 	}
 
-	// Check if it's immutable.
-	if !b.mutable {
-		return ErrImmutable
+	// Stop the previous timer, if there is one.
+	if b.ttl != nil {
+		b.ttl.Stop()
+		b.ttl = nil
 	}
 
-	// Fill with random bytes.
-	fillRandBytes(b.buffer[offset : offset+length])
+	// Start a new one, unless we're cancelling.
+	if d > 0 {
+		var t *time.Timer
+		t = time.AfterFunc(d, func() {
+			b.Lock()
+			defer b.Unlock()
+
+			// Make sure that the timer wasn't replaced while we were waiting for the lock.
+			if b.ttl == t {
+				b.destroy()
+			}
+		})
+		b.ttl = t
+	}
 
 	// Everything went well.
 	return nil
 }
 
 /*
-Destroy verifies that no buffer underflows occurred and then wipes, unlocks, and frees all related memory. If a buffer underflow is detected, the process panics.
-
-This function must be called on all LockedBuffers before exiting. DestroyAll is designed for this purpose, as is CatchInterrupt and SafeExit. We recommend using all of them together.
+SetLabel attaches a name to a LockedBuffer, making it easier to tell LockedBuffers apart when debugging. The label is included in the output of String and can be searched for with FindByLabel.
 
-If the LockedBuffer has already been destroyed then the call makes no changes.
+The label is stored alongside the LockedBuffer's metadata in regular memory, not in the protected region, so it should never contain anything sensitive.
 */
-func (b *container) Destroy() {
-	// Attain a mutex lock on this LockedBuffer.
+func (b *container) SetLabel(name string) {
+	// Get a mutex lock on this LockedBuffer.
 	b.Lock()
 	defer b.Unlock()
 
-	// Return if it's already destroyed.
-	if len(b.buffer) == 0 {
-		return
-	}
+	b.label = name
+}
 
-	// Remove this one from global slice.
-	allLockedBuffersMutex.Lock()
-	for i, v := range allLockedBuffers {
-		if v == b {
-			allLockedBuffers = append(allLockedBuffers[:i], allLockedBuffers[i+1:]...)
-			break
-		}
-	}
-	allLockedBuffersMutex.Unlock()
+/*
+Label returns the name that was attached to a LockedBuffer with SetLabel, or an empty string if there is none.
+*/
+func (b *container) Label() string {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
 
-	// Get all of the memory related to this LockedBuffer.
-	memory := getAllMemory(b)
+	return b.label
+}
 
-	// Get the total size of all the pages between the guards.
-	roundedLength := len(memory) - (pageSize * 2)
+/*
+String implements the fmt.Stringer interface. It returns a redacted description of the LockedBuffer that contains only its label, size, and state, never its contents, so that accidentally printing or logging a LockedBuffer does not leak the secret it holds.
+*/
+func (b *container) String() string {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
 
-	// Verify the canary.
-	if !bytes.Equal(memory[pageSize+roundedLength-len(b.buffer)-32:pageSize+roundedLength-len(b.buffer)], canary) {
-		panic("memguard.Destroy(): buffer overflow detected")
+	// Include the label if there is one.
+	name := "memguard::LockedBuffer"
+	if b.label != "" {
+		name += fmt.Sprintf(" %q", b.label)
 	}
 
-	// Make all of the memory readable and writable.
-	memcall.Protect(memory, true, true)
-
-	// Wipe the pages that hold our data.
-	wipeBytes(memory[pageSize : pageSize+roundedLength])
+	// Destroyed LockedBuffers have no size or state to speak of.
+	if len(b.buffer) == 0 {
+		return fmt.Sprintf("<%s destroyed>", name)
+	}
 
-	// Unlock the pages that hold our data.
-	memcall.Unlock(memory[pageSize : pageSize+roundedLength])
+	return fmt.Sprintf("<%s redacted (%d bytes, mutable=%t)>", name, len(b.buffer), b.mutable)
+}
 
-	// Free all related memory.
-	memcall.Free(memory)
+/*
+GoString implements the fmt.GoStringer interface, so that the %#v verb is redacted in the same way as String.
+*/
+func (b *container) GoString() string {
+	return b.String()
+}
 
-	// Set the metadata appropriately.
-	b.mutable = false
+/*
+MarshalJSON implements the json.Marshaler interface. It always returns an ErrCannotMarshal.
 
-	// Set the buffer to nil.
-	b.buffer = nil
+This is intentional: it means that a LockedBuffer that finds its way into a structure being marshaled, for example as part of an API response or a structured log entry, causes the encoding to fail loudly instead of the secret being exposed.
+*/
+func (b *container) MarshalJSON() ([]byte, error) {
+	return nil, ErrCannotMarshal
 }
 
 /*
-Size returns an integer representing the total length, in bytes, of a LockedBuffer.
-
-If this size is zero, it is safe to assume that the LockedBuffer has been destroyed.
+UnmarshalJSON implements the json.Unmarshaler interface. It always returns an ErrCannotMarshal, since decoding a secret would mean that it had been sitting in unprotected memory.
 */
-func (b *container) Size() int {
-	return len(b.buffer)
+func (b *container) UnmarshalJSON([]byte) error {
+	return ErrCannotMarshal
 }
 
 /*
-Wipe wipes a LockedBuffer's contents by overwriting the buffer with zeroes.
+EqualBytes compares a LockedBuffer to a byte slice in constant time, which makes it suitable for checking things like passwords and MACs.
+
+The time taken depends only on the length of the slice. It does not depend on the contents of either, on where they differ, or even on the length of the LockedBuffer, so comparing a guess against a secret reveals nothing about the secret other than whether the guess was right.
+
+If the LockedBuffer has been destroyed, the call will return an ErrDestroyed.
 */
-func (b *container) Wipe() error {
+func (b *container) EqualBytes(buf []byte) (bool, error) {
 	// Get a mutex lock on this LockedBuffer.
 	b.Lock()
 	defer b.Unlock()
 
 	// Check if it's destroyed.
 	if len(b.buffer) == 0 {
-		return ErrDestroyed
+		return false, ErrDestroyed
 	}
 
-	// Check if it's immutable.
-	if !b.mutable {
-		return ErrImmutable
+	// Check if it's hidden.
+	if b.hidden {
+		return false, ErrHidden
 	}
 
-	// Wipe the buffer.
-	wipeBytes(b.buffer)
+	// Compare every byte of the slice against the buffer, wrapping around the buffer if the slice is longer, so that the work done only depends on the length of the slice.
+	var diff byte
+	for i, j := 0, 0; i < len(buf); i++ {
+		diff |= buf[i] ^ b.buffer[j]
 
-	// Everything went well.
-	return nil
+		// Move on to the next byte, going back to the start at the end. The comparison is done at full width, since subtle.ConstantTimeEq would truncate to 32 bits.
+		x := uint64((j + 1) ^ len(b.buffer))
+		j = subtle.ConstantTimeSelect(1^int((x|-x)>>63), 0, j+1)
+	}
+
+	// Take the lengths into account too.
+	l := uint64(len(buf)) ^ uint64(len(b.buffer))
+	sameLength := 1 ^ int((l|-l)>>63)
+
+	// They're equal if the lengths match and no byte differed.
+	return sameLength&subtle.ConstantTimeByteEq(diff, 0) == 1, nil
 }
 
 /*
-Concatenate takes two LockedBuffers and concatenates them.
+Fingerprint returns a digest of the contents of a LockedBuffer that is safe to log or compare, which is useful for things like noticing that a secret has changed without handling the plaintext. LockedBuffers with the same contents have the same fingerprint.
 
-If one of the given LockedBuffers is immutable, the resulting LockedBuffer will also be immutable. The original LockedBuffers are not destroyed.
+The digest is an HMAC-SHA256 under a key that is randomly generated for each process, so that a fingerprint cannot be checked against guesses of the contents by anyone who only sees the fingerprint, even if the possible contents are few. As a consequence, fingerprints can only be compared with others from the same process, and since DestroyAll destroys the key along with everything else, not with ones taken before a call to DestroyAll.
+
+If the LockedBuffer has been destroyed, the call will return an ErrDestroyed.
 */
-func Concatenate(a, b *LockedBuffer) (*LockedBuffer, error) {
-	// Get a mutex lock on the LockedBuffers.
-	a.Lock()
+func (b *container) Fingerprint() ([]byte, error) {
+	// Get a mutex lock on this LockedBuffer.
 	b.Lock()
-	defer a.Unlock()
 	defer b.Unlock()
 
-	// Check if either are destroyed.
-	if len(a.buffer) == 0 || len(b.buffer) == 0 {
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
 		return nil, ErrDestroyed
 	}
 
-	// Create a new LockedBuffer to hold the concatenated value.
-	c, _ := NewMutable(len(a.buffer) + len(b.buffer))
+	// Check if it's hidden.
+	if b.hidden {
+		return nil, ErrHidden
+	}
+
+	// Get a mutex lock on the key.
+	fingerprintKeyMutex.Lock()
+	defer fingerprintKeyMutex.Unlock()
 
-	// Copy the values across.
-	c.Copy(a.buffer)
-	c.CopyAt(b.buffer, len(a.buffer))
+	// Generate a new key if we need to.
+	if fingerprintKey == nil || fingerprintKey.IsDestroyed() {
+		key, err := NewImmutableRandom(32)
+		if err != nil {
+			return nil, err
+		}
+		key.SetLabel("memguard.fingerprint-key")
+		fingerprintKey = key
+	}
 
-	// Set permissions accordingly.
-	if !a.mutable || !b.mutable {
-		c.MakeImmutable()
+	// Stop the key from being destroyed while we use it.
+	fingerprintKey.Lock()
+	defer fingerprintKey.Unlock()
+	if len(fingerprintKey.buffer) == 0 {
+		return nil, ErrDestroyed
 	}
 
-	// Return the resulting LockedBuffer.
-	return c, nil
+	// Compute the digest. Note that this copies the padded key into regular memory.
+	mac := hmac.New(sha256.New, fingerprintKey.buffer)
+	mac.Write(b.buffer)
+	return mac.Sum(nil), nil
 }
 
 /*
-Duplicate takes a LockedBuffer and creates a new one with the same contents and mutability state as the original.
+ReadAll calls a function with the contents of a LockedBuffer, holding a read lock on it for the duration of the call, and returns whatever error the function returns. This is the safe way for many goroutines to read the same LockedBuffer at once: any number of calls to ReadAll can run concurrently, but the LockedBuffer cannot be destroyed, modified, made mutable, or hidden until they have all returned. Likewise, everything done to the LockedBuffer by methods that returned before ReadAll was called is visible to the function.
+
+The slice references the protected memory directly. The function must not modify it or keep hold of it after returning, and it must not call methods on the same LockedBuffer other than through ReadAll, since they would wait for the read lock to be released.
+
+If the LockedBuffer has been destroyed, the function is not called and ReadAll returns an ErrDestroyed.
 */
-func Duplicate(b *LockedBuffer) (*LockedBuffer, error) {
-	// Get a mutex lock on this LockedBuffer.
-	b.Lock()
-	defer b.Unlock()
+func (b *container) ReadAll(f func([]byte) error) error {
+	// Get a read lock on this LockedBuffer.
+	b.RLock()
+	defer b.RUnlock()
 
 	// Check if it's destroyed.
 	if len(b.buffer) == 0 {
-		return nil, ErrDestroyed
+		return ErrDestroyed
 	}
 
-	// Create new LockedBuffer.
-	newBuf, _ := NewMutable(b.Size())
-
-	// Copy bytes into it.
-	newBuf.Copy(b.buffer)
-
-	// Set permissions accordingly.
-	if !b.mutable {
-		newBuf.MakeImmutable()
+	// Check if it's hidden.
+	if b.hidden {
+		return ErrHidden
 	}
 
-	// Return duplicated.
-	return newBuf, nil
+	return f(b.buffer)
 }
 
 /*
-Equal compares the contents of two LockedBuffers in constant time.
+VerifyHashed checks a secret, such as a password, against a stored hash of it by calling verify with the contents of the LockedBuffer, and returns whatever verify returns. This lets password hashing functions like bcrypt.CompareHashAndPassword be used without copying the secret out of protected memory first, as long as verify does the comparison in constant time.
+
+A read lock is held for the duration of the call, in the same way as ReadAll. The slice references the protected memory directly, so verify must not modify it or keep hold of it, or anything derived from it, after returning, and it must not call methods on the same LockedBuffer other than through ReadAll.
+
+If the LockedBuffer has been destroyed, verify is not called and the call will return an ErrDestroyed.
 */
-func Equal(a, b *LockedBuffer) (bool, error) {
-	// Get a mutex lock on the LockedBuffers.
-	a.Lock()
-	b.Lock()
-	defer a.Unlock()
-	defer b.Unlock()
+func VerifyHashed(secret *LockedBuffer, verify func(plaintext []byte) (bool, error)) (bool, error) {
+	// Get a read lock on this LockedBuffer.
+	secret.RLock()
+	defer secret.RUnlock()
 
-	// Check if either are destroyed.
-	if len(a.buffer) == 0 || len(b.buffer) == 0 {
+	// Check if it's destroyed.
+	if len(secret.buffer) == 0 {
 		return false, ErrDestroyed
 	}
 
-	// Do a time-constant comparison on the two buffers.
-	if subtle.ConstantTimeCompare(a.buffer, b.buffer) == 1 {
-		// They're equal.
-		return true, nil
+	// Check if it's hidden.
+	if secret.hidden {
+		return false, ErrHidden
 	}
 
-	// They're not equal.
-	return false, nil
+	return verify(secret.buffer)
 }
 
 /*
-Split takes a LockedBuffer, splits it at a specified offset, and then returns the two newly created LockedBuffers. The mutability state of the original is preserved in the new LockedBuffers, and the original LockedBuffer is not destroyed.
+WithExposed calls a function with the contents of a LockedBuffer that is normally kept hidden with Hide, making it accessible for just the duration of the call, and returns whatever error the function returns. The LockedBuffer is hidden again afterwards, even if the function panics, so the secret is only readable for as short a time as possible. If the LockedBuffer was suspended, its memory is also locked for the duration of the call.
+
+A LockedBuffer that isn't hidden is left as it is. The mutex lock is held for the whole call, so the function must not call methods on the same LockedBuffer, and it must not keep hold of the slice after returning. Whether the slice can be written to depends on whether the LockedBuffer is mutable.
+
+If the LockedBuffer has been destroyed, the function is not called and the call will return an ErrDestroyed. If a suspended LockedBuffer can't be locked, the function is not called and that error is returned.
 */
-func Split(b *LockedBuffer, offset int) (*LockedBuffer, *LockedBuffer, error) {
+func WithExposed(b *LockedBuffer, f func([]byte) error) error {
 	// Get a mutex lock on this LockedBuffer.
 	b.Lock()
 	defer b.Unlock()
 
 	// Check if it's destroyed.
 	if len(b.buffer) == 0 {
-		return nil, nil, ErrDestroyed
+		return ErrDestroyed
 	}
 
-	// Create two new LockedBuffers.
-	firstBuf, err := NewMutable(len(b.buffer[:offset]))
-	if err != nil {
-		return nil, nil, err
-	}
+	if b.hidden {
+		// Lock the memory for the time being if it was suspended.
+		if b.suspended {
+			locked, err := lockMemory(b.alloc, b.inner)
+			if err != nil {
+				return err
+			}
+			if locked {
+				defer unlockMemory(b.alloc, b.inner)
+			}
+		}
 
-	secondBuf, err := NewMutable(len(b.buffer[offset:]))
-	if err != nil {
-		firstBuf.Destroy()
-		return nil, nil, err
+		// Restore the previous protection until the function returns.
+		protectMemory(b.alloc, b.inner, true, b.mutable)
+		defer protectMemory(b.alloc, b.inner, false, false)
 	}
 
-	// Copy the values into them.
-	firstBuf.Copy(b.buffer[:offset])
-	secondBuf.Copy(b.buffer[offset:])
+	return f(b.buffer)
+}
 
-	// Copy over permissions.
-	if !b.mutable {
-		firstBuf.MakeImmutable()
-		secondBuf.MakeImmutable()
+/*
+WithSlice calls a function with a region of a LockedBuffer, as returned by Slice, and returns whatever error the function returns. The mutex lock is held for the whole call, so the LockedBuffer can't be destroyed or changed by anything else in the meantime, but the function must not call methods on the same LockedBuffer, and it must not keep hold of the slice after returning.
+
+If the LockedBuffer has been destroyed, or the region does not lie entirely within it, the function is not called and the call will return an ErrDestroyed or an ErrOutOfRange respectively.
+*/
+func WithSlice(b *LockedBuffer, offset, length int, f func([]byte) error) error {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	// Get the region.
+	region, err := b.slice(offset, length)
+	if err != nil {
+		return err
 	}
 
-	// Return the new LockedBuffers.
-	return firstBuf, secondBuf, nil
+	return f(region)
 }
 
 /*
-Trim shortens a LockedBuffer according to the given specifications. The mutability state of the original is preserved in the new LockedBuffer, and the original LockedBuffer is not destroyed.
+MakeImmutable asks the kernel to mark the LockedBuffer's memory as immutable. Any subsequent attempts to modify this memory will result in the process crashing with a SIGSEGV memory violation.
 
-Trim takes an offset and a size as arguments. The resulting LockedBuffer starts at index [offset] and ends at index [offset+size].
+To make the memory mutable again, MakeMutable is called. If the LockedBuffer shares its pages with others in a slab, or refers to memory that it was created from with NewFromMmap, the kernel can't be asked to protect it on its own, so the call will return an ErrUnsupported and the LockedBuffer stays mutable. Use one of the constructors that creates an immutable LockedBuffer instead.
 */
-func Trim(b *LockedBuffer, offset, size int) (*LockedBuffer, error) {
+func (b *container) MakeImmutable() error {
 	// Get a mutex lock on this LockedBuffer.
 	b.Lock()
 	defer b.Unlock()
 
 	// Check if it's destroyed.
 	if len(b.buffer) == 0 {
-		return nil, ErrDestroyed
+		return ErrDestroyed
 	}
 
-	// Create new LockedBuffer and copy over the old.
-	newBuf, err := NewMutable(size)
-	if err != nil {
-		return nil, err
-	}
-	newBuf.Copy(b.buffer[offset : offset+size])
+	if b.mutable {
+		// Slabs are shared and foreign memory isn't ours, so the kernel can't be asked to protect them.
+		if b.memory == nil {
+			return ErrUnsupported
+		}
 
-	// Copy over permissions.
-	if !b.mutable {
-		newBuf.MakeImmutable()
+		// Mark the memory as immutable, unless it's hidden in which case Reveal will do it.
+		if !b.hidden {
+			protectMemory(b.alloc, b.inner, true, false)
+		}
+
+		// Tell everyone about the change we made.
+		b.mutable = false
 	}
 
-	// Return the new LockedBuffer.
-	return newBuf, nil
+	// Everything went well.
+	return nil
 }
 
 /*
-WipeBytes zeroes out a given byte slice. It is recommended that you call WipeBytes on slices after utilizing the Copy or CopyAt methods.
+MakeMutable asks the kernel to mark the LockedBuffer's memory as mutable.
 
-Due to the nature of memory allocated by the Go runtime, WipeBytes cannot guarantee that the data does not exist elsewhere in memory. Therefore, your program should aim to (when possible) store sensitive data only in LockedBuffers.
+To make the memory immutable again, MakeImmutable is called. If the LockedBuffer refers to memory that it was created from with NewFromMmap and is immutable, the call will return an ErrUnsupported.
 */
-func WipeBytes(b []byte) {
-	wipeBytes(b)
-}
-
-/*
-DestroyAll calls Destroy on all LockedBuffers that have not already been destroyed.
+func (b *container) MakeMutable() error {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
 
-CatchInterrupt and SafeExit both call DestroyAll before exiting.
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		return ErrDestroyed
+	}
+
+	// Check if it can be written to at all.
+	if b.readOnly {
+		return ErrUnsupported
+	}
+
+	if !b.mutable {
+		// Slabs are shared and foreign memory isn't ours, so the kernel can't be asked to change them.
+		if b.memory == nil {
+			return ErrUnsupported
+		}
+
+		// Mark the memory as mutable, unless it's hidden in which case Reveal will do it.
+		if !b.hidden {
+			protectMemory(b.alloc, b.inner, true, true)
+		}
+
+		// Tell everyone about the change we made.
+		b.mutable = true
+	}
+
+	// Everything went well.
+	return nil
+}
+
+/*
+Hide asks the kernel to mark the LockedBuffer's memory as inaccessible, so that any attempt to read from or write to it directly, such as through a slice returned by Buffer, will result in the process crashing with a SIGSEGV memory violation. This is useful for secrets that are kept around but are not actively being used.
+
+The methods and functions of this package that access the contents check for this first, and return an ErrHidden instead of touching the memory, so a hidden LockedBuffer must be revealed with Reveal, or accessed through WithExposed, before it can be used. Calling MakeMutable or MakeImmutable on a hidden LockedBuffer only records the new state, which is applied when Reveal is called. Destroy and Verify work as normal on hidden LockedBuffers.
+*/
+func (b *container) Hide() error {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		return ErrDestroyed
+	}
+
+	// Slabs are shared and foreign memory isn't ours, so they can't be hidden.
+	if b.memory == nil {
+		return ErrUnsupported
+	}
+
+	if !b.hidden {
+		// Mark the memory as inaccessible.
+		protectMemory(b.alloc, b.inner, false, false)
+
+		// Tell everyone about the change we made.
+		b.hidden = true
+	}
+
+	// Everything went well.
+	return nil
+}
+
+/*
+Reveal makes the memory of a LockedBuffer that was hidden with Hide accessible again, restoring it to either mutable or immutable as appropriate. If the LockedBuffer was suspended, Reveal is identical to Resume.
+*/
+func (b *container) Reveal() error {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		return ErrDestroyed
+	}
+
+	if b.hidden {
+		// Restore the previous protection.
+		protectMemory(b.alloc, b.inner, true, b.mutable)
+
+		// Lock the memory again if it was suspended, hiding it again if we can't.
+		if b.suspended {
+			locked, err := lockMemory(b.alloc, b.inner)
+			if err != nil {
+				protectMemory(b.alloc, b.inner, false, false)
+				return err
+			}
+			b.locked = locked
+			b.suspended = false
+		}
+
+		// Tell everyone about the change we made.
+		b.hidden = false
+	}
+
+	// Everything went well.
+	return nil
+}
+
+/*
+Suspend hides a LockedBuffer in the same way as Hide, and also unlocks its memory so that the kernel is free to swap it out. This trades some security for memory headroom, and is meant for services that are short on locked memory and have LockedBuffers that sit idle for long periods. Just as with Hide, any attempt to access a suspended LockedBuffer directly will crash the process, the methods of this package return an ErrHidden, and Destroy works as normal.
+
+Slabs are shared, memory passed to NewFromMmap is not owned by memguard, and the memory of a batch created with NewMutableBatch is only unlocked once every LockedBuffer in it has been destroyed, so calling Suspend on those LockedBuffers returns an ErrUnsupported.
+*/
+func (b *container) Suspend() error {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		return ErrDestroyed
+	}
+
+	// Slabs are shared and foreign memory isn't ours, so they can't be suspended, and batches are unlocked all at once.
+	if b.memory == nil || b.batch != nil {
+		return ErrUnsupported
+	}
+
+	// Mark the memory as inaccessible.
+	if !b.hidden {
+		protectMemory(b.alloc, b.inner, false, false)
+		b.hidden = true
+	}
+
+	// Unlock it.
+	if b.locked {
+		unlockMemory(b.alloc, b.inner)
+		b.locked = false
+	}
+
+	// Tell everyone about the change we made.
+	b.suspended = true
+
+	// Everything went well.
+	return nil
+}
+
+/*
+Resume locks the memory of a LockedBuffer that was suspended with Suspend, and then makes it accessible again. Whether the memory must be locked follows the policy set with SetLockPolicy, so by default if it can't be locked the error is returned and the LockedBuffer stays suspended.
+*/
+func (b *container) Resume() error {
+	return b.Reveal()
+}
+
+/*
+IsSuspended returns a boolean value indicating if a LockedBuffer has been suspended with Suspend.
+*/
+func (b *container) IsSuspended() bool {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	// Return the appropriate value.
+	return b.suspended
+}
+
+/*
+Copy copies bytes from a byte slice into a LockedBuffer in constant-time. Just like Golang's built-in copy function, Copy only copies up to the smallest of the two buffers.
+
+It does not wipe the original slice so using Copy is less secure than using Move. Therefore Move should be favoured unless you have a good reason.
+
+You should aim to call WipeBytes on the original slice as soon as possible.
+
+If the LockedBuffer is marked as read-only, the call will fail and return an ErrReadOnly.
+*/
+func (b *container) Copy(buf []byte) error {
+	// Just call CopyAt with a zero offset.
+	return b.CopyAt(buf, 0)
+}
+
+/*
+CopyAt is identical to Copy but it copies into the LockedBuffer at a specified offset.
+*/
+func (b *container) CopyAt(buf []byte, offset int) error {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		return ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if b.hidden {
+		return ErrHidden
+	}
+
+	// Check if it's immutable.
+	if !b.mutable {
+		return ErrImmutable
+	}
+
+	// Do a time-constant copying of the bytes, copying only up to the length of the buffer.
+	if len(b.buffer[offset:]) > len(buf) {
+		subtle.ConstantTimeCopy(1, b.buffer[offset:offset+len(buf)], buf)
+	} else if len(b.buffer[offset:]) < len(buf) {
+		subtle.ConstantTimeCopy(1, b.buffer[offset:], buf[:len(b.buffer[offset:])])
+	} else {
+		subtle.ConstantTimeCopy(1, b.buffer[offset:], buf)
+	}
+
+	return nil
+}
+
+/*
+Grow extends a LockedBuffer by n bytes without allocating any new memory. Since memory is allocated in whole pages, most LockedBuffers have room to spare in front of their canary, and Grow moves the canary and the data into that room so that the new bytes can be added at the end. The new bytes are zeroed. This avoids the system calls that Resize has to make when a LockedBuffer only needs to grow a little.
+
+Slices previously returned by Buffer no longer refer to the data after a successful call, so Buffer must be called again.
+
+If there is not enough room, the call will return an ErrNoSlack and the LockedBuffer is unchanged, in which case Resize can be used instead. If the LockedBuffer is immutable, the call will return an ErrImmutable. If n is negative, the call will return an ErrInvalidLength. If the canary has been overwritten, the call will return an ErrCanaryViolation rather than hide the overflow by rewriting it.
+*/
+func (b *container) Grow(n int) error {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		return ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if b.hidden {
+		return ErrHidden
+	}
+
+	// Check if it's immutable.
+	if !b.mutable {
+		return ErrImmutable
+	}
+
+	// Check the length.
+	if n < 0 {
+		return ErrInvalidLength
+	}
+
+	// Check that there is enough room in front of the canary.
+	size := len(b.buffer)
+	if n > len(b.inner)-size-b.canaryLen {
+		return ErrNoSlack
+	}
+
+	// Make sure we aren't about to paper over an overflow.
+	if !canaryIntact(b) {
+		return ErrCanaryViolation
+	}
+
+	// Move the data down, zero the new bytes at the end, and rewrite the canary in front of it.
+	start := len(b.inner) - size - n
+	copy(b.inner[start:start+size], b.buffer)
+	wipeBytes(b.inner[start+size:])
+	fillCanary(b.inner[start-b.canaryLen:start], b.canaryRef)
+
+	// Point the buffer at the new region.
+	b.buffer = getBytes(uintptr(unsafe.Pointer(&b.inner[start])), size+n)
+
+	// Everything went well.
+	return nil
+}
+
+/*
+Move moves bytes from a byte slice into a LockedBuffer in constant-time. Just like Golang's built-in copy function, Move only moves up to the smallest of the two buffers.
+
+Unlike Copy, Move wipes the entire original slice after copying the appropriate number of bytes over, and so it should be favoured unless you have a good reason.
+
+If the LockedBuffer is marked as read-only, the call will fail and return an ErrReadOnly.
+*/
+func (b *container) Move(buf []byte) error {
+	// Just call MoveAt with a zero offset.
+	return b.MoveAt(buf, 0)
+}
+
+/*
+MoveAt is identical to Move but it copies into the LockedBuffer at a specified offset.
+*/
+func (b *container) MoveAt(buf []byte, offset int) error {
+	// Copy buf into the LockedBuffer.
+	if err := b.CopyAt(buf, offset); err != nil {
+		return err
+	}
+
+	// Wipe the old bytes.
+	wipeBytes(buf)
+
+	// Everything went well.
+	return nil
+}
+
+/*
+MoveTo moves the contents of a LockedBuffer into another LockedBuffer in constant-time. Just like Golang's built-in copy function, MoveTo only moves up to the smallest of the two buffers. The entire source LockedBuffer is wiped afterwards.
+
+Since both LockedBuffers are modified, the call will return an ErrImmutable if either of them is immutable. If either of them is destroyed, the call will return an ErrDestroyed.
+*/
+func (b *container) MoveTo(dst *LockedBuffer) error {
+	// Get a mutex lock on both LockedBuffers.
+	lockPair(b, dst.container)
+	defer unlockPair(b, dst.container)
+
+	// Check if either are destroyed.
+	if len(b.buffer) == 0 || len(dst.buffer) == 0 {
+		return ErrDestroyed
+	}
+
+	// Check if either are hidden.
+	if b.hidden || dst.hidden {
+		return ErrHidden
+	}
+
+	// Check if either are immutable.
+	if !b.mutable || !dst.mutable {
+		return ErrImmutable
+	}
+
+	// Moving a LockedBuffer into itself is a no-op.
+	if b == dst.container {
+		return nil
+	}
+
+	// Work out how much to copy.
+	n := len(b.buffer)
+	if len(dst.buffer) < n {
+		n = len(dst.buffer)
+	}
+
+	// Do a time-constant copying of the bytes and wipe the source.
+	subtle.ConstantTimeCopy(1, dst.buffer[:n], b.buffer[:n])
+	wipeBytes(b.buffer)
+
+	// Everything went well.
+	return nil
+}
+
+/*
+FillRandomBytes fills a LockedBuffer with cryptographically-secure pseudo-random bytes.
+*/
+func (b *container) FillRandomBytes() error {
+	// Just call FillRandomBytesAt.
+	return b.FillRandomBytesAt(0, b.Size())
+}
+
+/*
+FillRandomBytesAt fills a LockedBuffer with cryptographically-secure pseudo-random bytes, starting at an offset and ending after a given number of bytes.
+*/
+func (b *container) FillRandomBytesAt(offset, length int) error {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		return ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if b.hidden {
+		return ErrHidden
+	}
+
+	// Check if it's immutable.
+	if !b.mutable {
+		return ErrImmutable
+	}
+
+	// Fill with random bytes.
+	fillRandBytes(b.buffer[offset : offset+length])
+
+	// Everything went well.
+	return nil
+}
+
+/*
+Verify checks that the canary value guarding the LockedBuffer has not been overwritten, without destroying it. This allows buffer overflows into long-lived LockedBuffers to be caught early, rather than only when Destroy is eventually called.
+
+If the canary has been modified, the call will return an ErrCanaryViolation. If the LockedBuffer has been destroyed, the call will return an ErrDestroyed.
+*/
+func (b *container) Verify() error {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		return ErrDestroyed
+	}
+
+	// Temporarily make hidden memory readable so that the canary can be checked.
+	if b.hidden {
+		protectMemory(b.alloc, b.inner, true, false)
+		defer protectMemory(b.alloc, b.inner, false, false)
+	}
+
+	// Check the canary.
+	if !canaryIntact(b) {
+		return ErrCanaryViolation
+	}
+
+	// Everything went well.
+	return nil
+}
+
+/*
+Destroy verifies that no buffer underflows occurred and then wipes, unlocks, and frees all related memory. If a buffer underflow is detected, the process panics. Freeing the memory can be delayed with SetQuarantine, to catch anything that goes on using it.
+
+This function must be called on all LockedBuffers before exiting. DestroyAll is designed for this purpose, as is CatchInterrupt and SafeExit. We recommend using all of them together.
+
+If the LockedBuffer has already been destroyed then the call makes no changes.
+*/
+func (b *container) Destroy() {
+	// Attain a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	b.destroy()
+}
+
+/*
+TryDestroy is the best effort variant of Destroy, for paths such as a bulk shutdown where it is better to report problems than to crash on the first one. It does everything that Destroy does, but instead of panicking it returns an error, while still wiping, unlocking, and freeing as much of the memory as it can.
+
+If the canary has been overwritten, the LockedBuffer is destroyed anyway and the call will return an ErrCanaryViolation. If a system call fails, the steps that depend on it are skipped, the rest are carried out, and the first such error is returned. The only case in which the LockedBuffer is left alone is when it is hidden and can't be made readable again, in which case that error is returned.
+
+If the LockedBuffer has already been destroyed then the call makes no changes and returns nil.
+*/
+func (b *container) TryDestroy() error {
+	// Attain a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	return b.teardown(false)
+}
+
+// Destroy a LockedBuffer that the caller already holds the mutex lock on.
+func (b *container) destroy() {
+	if err := b.teardown(true); err != nil {
+		safePanic(err)
+	}
+}
+
+// Wipe, unlock, and free the memory of a LockedBuffer that the caller already holds the mutex lock on, returning the first error from a system call. If strict is set, an overwritten canary causes a panic that leaves the LockedBuffer alone, and otherwise it is destroyed anyway and reported as an ErrCanaryViolation.
+func (b *container) teardown(strict bool) (err error) {
+	// Return if it's already destroyed.
+	if len(b.buffer) == 0 {
+		return nil
+	}
+
+	// Make hidden memory readable so that the canary can be checked.
+	if b.hidden {
+		if err := b.alloc.Protect(b.inner, true, false); err != nil {
+			return err
+		}
+	}
+
+	// Verify the canary.
+	if !canaryIntact(b) {
+		if strict {
+			safePanic("memguard.Destroy(): buffer overflow detected")
+		}
+		err = ErrCanaryViolation
+	}
+
+	// Keep hold of the first error, carrying on regardless.
+	record := func(e error) {
+		if err == nil {
+			err = e
+		}
+	}
+
+	// Remove this one from global slice.
+	untrack(b)
+
+	if b.foreign {
+		// Wipe the memory if we can, but leave everything else to its owner.
+		if !b.readOnly {
+			wipeSecret(b.inner)
+			verifyWiped(b.inner)
+		}
+	} else if b.slab != nil {
+		// Wipe our slot and hand it back to the slab.
+		wipeSecret(b.inner)
+		verifyWiped(b.inner)
+		record(b.slab.release(b.inner))
+	} else if b.batch != nil {
+		// Wipe our pages, make them inaccessible along with the guard pages, and let the batch know. The guard pages may be shared with our neighbours, so they are left as they are, and the batch takes care of unlocking and freeing all of the memory at once.
+		if e := b.alloc.Protect(b.inner, true, true); e != nil {
+			record(e)
+		} else {
+			wipeSecret(b.inner)
+			verifyWiped(b.inner)
+			record(b.alloc.Protect(b.inner, false, false))
+		}
+		record(b.batch.release())
+	} else {
+		// Make all of the memory readable and writable, and wipe the pages that hold our data.
+		if e := b.alloc.Protect(b.memory, true, true); e != nil {
+			record(e)
+		} else {
+			wipeSecret(b.inner)
+			verifyWiped(b.inner)
+		}
+
+		// Unlock the pages that hold our data.
+		if b.locked {
+			record(tryUnlockMemory(b.alloc, b.inner))
+		}
+
+		// Free all related memory, or quarantine it until it's time to.
+		free := b.alloc.Free
+		if b.huge {
+			free = func(m []byte) error { memcall.FreeHuge(m); return nil }
+		}
+		record(quarantineMemory(b.alloc, b.memory, free))
+	}
+
+	// Stop the timer, if there is one.
+	if b.ttl != nil {
+		b.ttl.Stop()
+		b.ttl = nil
+	}
+
+	// Set the metadata appropriately.
+	b.mutable = false
+	b.hidden = false
+	b.locked = false
+	b.huge = false
+	b.suspended = false
+	b.foreign, b.readOnly = false, false
+	b.memory, b.inner, b.slab, b.batch = nil, nil, nil, nil
+
+	// Set the buffer to nil.
+	b.buffer = nil
+
+	return err
+}
+
+/*
+Size returns an integer representing the total length, in bytes, of a LockedBuffer.
+
+If this size is zero, it is safe to assume that the LockedBuffer has been destroyed.
+*/
+func (b *container) Size() int {
+	return len(b.buffer)
+}
+
+/*
+Wipe wipes a LockedBuffer's contents by overwriting the buffer with zeroes, after any other passes that are called for by the WipeStrategy.
+*/
+func (b *container) Wipe() error {
+	// Just call WipeAt.
+	return b.WipeAt(0, b.Size())
+}
+
+/*
+WipeAt is identical to Wipe but it only overwrites a region of the LockedBuffer, starting at an offset and ending after a given number of bytes.
+
+If the region does not lie entirely within the LockedBuffer, the call will return an ErrOutOfRange.
+*/
+func (b *container) WipeAt(offset, length int) error {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		return ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if b.hidden {
+		return ErrHidden
+	}
+
+	// Check if it's immutable.
+	if !b.mutable {
+		return ErrImmutable
+	}
+
+	// Check that the region is within bounds.
+	if offset < 0 || length < 0 || length > len(b.buffer)-offset {
+		return ErrOutOfRange
+	}
+
+	// Wipe the region.
+	wipeSecret(b.buffer[offset : offset+length])
+
+	// Everything went well.
+	return nil
+}
+
+/*
+Concatenate takes any number of LockedBuffers and concatenates them, in the order given. The same LockedBuffer may be given more than once.
+
+If one of the given LockedBuffers is immutable, the resulting LockedBuffer will also be immutable, and it is filled in before it is made immutable, in the same way as NewImmutableFromBytes, so there is never a mutable handle to it. The original LockedBuffers are not destroyed, since existing callers rely on that, so call Destroy on them afterwards if they are no longer needed.
+
+If no LockedBuffers are given, the call will return an ErrInvalidLength. If any of them have been destroyed, the call will return an ErrDestroyed.
+*/
+func Concatenate(bufs ...*LockedBuffer) (*LockedBuffer, error) {
+	// Check that there is something to concatenate.
+	if len(bufs) == 0 {
+		return nil, ErrInvalidLength
+	}
+
+	// Get a mutex lock on the LockedBuffers.
+	containers := make([]*container, len(bufs))
+	for i, b := range bufs {
+		containers[i] = b.container
+	}
+	locked := lockAll(containers)
+	defer unlockAll(locked)
+
+	// Check if any are destroyed, and add up the sizes.
+	var size int
+	mutable := true
+	for _, b := range bufs {
+		if len(b.buffer) == 0 {
+			return nil, ErrDestroyed
+		}
+		if b.hidden {
+			return nil, ErrHidden
+		}
+		size += len(b.buffer)
+		mutable = mutable && b.mutable
+	}
+
+	// Create a new LockedBuffer with the appropriate permissions, copying the values across.
+	return newFilledContainer(size, mutable, false, func(c []byte) error {
+		var offset int
+		for _, b := range bufs {
+			copy(c[offset:], b.buffer)
+			offset += len(b.buffer)
+		}
+		return nil
+	})
+}
+
+/*
+Duplicate takes a LockedBuffer and creates a new one with the same contents and mutability state as the original. A duplicate of an immutable LockedBuffer is filled in before it is made immutable, in the same way as NewImmutableFromBytes, so there is never a mutable handle to it.
+
+If the LockedBuffer has been destroyed, the call will return an ErrDestroyed.
+*/
+func Duplicate(b *LockedBuffer) (*LockedBuffer, error) {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		return nil, ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if b.hidden {
+		return nil, ErrHidden
+	}
+
+	// Create new LockedBuffer with the same mutability, copying bytes into it.
+	return newFilledContainer(len(b.buffer), b.mutable, false, func(buf []byte) error {
+		subtle.ConstantTimeCopy(1, buf, b.buffer)
+		return nil
+	})
+}
+
+/*
+DuplicateMutable is identical to Duplicate, except that the new LockedBuffer is always mutable, whatever the mutability of the original. This is handy for handing an independent copy of a secret to another goroutine that will modify or destroy it on its own schedule. Only a read lock is held on the original, so it can be duplicated alongside ReadAll and other readers.
+
+The copy has its own pages and its own canary, which is checked on its own by Verify and Destroy, so an overflow in one of them is never masked by the other. Like every LockedBuffer, the canary is made up of the value set for the process.
+
+If the LockedBuffer has been destroyed, the call will return an ErrDestroyed. If it is hidden, the call will return an ErrHidden.
+*/
+func DuplicateMutable(b *LockedBuffer) (*LockedBuffer, error) {
+	// Get a read lock on this LockedBuffer.
+	b.RLock()
+	defer b.RUnlock()
+
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		return nil, ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if b.hidden {
+		return nil, ErrHidden
+	}
+
+	// Create a new mutable LockedBuffer, copying bytes into it.
+	return newFilledContainer(len(b.buffer), true, false, func(buf []byte) error {
+		subtle.ConstantTimeCopy(1, buf, b.buffer)
+		return nil
+	})
+}
+
+/*
+Equal compares the contents of two LockedBuffers in constant time. LockedBuffers of differing lengths are reported as not equal.
+
+The time taken for LockedBuffers of equal length does not depend on their contents or on where they differ, and only the lengths can be learnt from timing when they differ.
+*/
+func Equal(a, b *LockedBuffer) (bool, error) {
+	// Get a read lock on both LockedBuffers, in a consistent order.
+	rlockPair(a.container, b.container)
+	defer runlockPair(a.container, b.container)
+
+	// Check if either are destroyed.
+	if len(a.buffer) == 0 || len(b.buffer) == 0 {
+		return false, ErrDestroyed
+	}
+
+	// Check if either are hidden.
+	if a.hidden || b.hidden {
+		return false, ErrHidden
+	}
+
+	// Do a time-constant comparison on the two buffers.
+	if subtle.ConstantTimeCompare(a.buffer, b.buffer) == 1 {
+		// They're equal.
+		return true, nil
+	}
+
+	// They're not equal.
+	return false, nil
+}
+
+/*
+SecureCompare compares the contents of two LockedBuffers in constant time in the same way as Equal, but first checks that the canaries of both are intact, so that comparing secrets doubles as a check that neither has been overflowed. Only read locks are taken, so it can run alongside ReadAll and other calls to SecureCompare.
+
+If either canary has been overwritten, no comparison is made and the call will return an ErrCanaryViolation. If either LockedBuffer has been destroyed, the call will return an ErrDestroyed.
+*/
+func SecureCompare(a, b *LockedBuffer) (bool, error) {
+	// Get a read lock on both LockedBuffers, in a consistent order.
+	rlockPair(a.container, b.container)
+	defer runlockPair(a.container, b.container)
+
+	// Check if either are destroyed.
+	if len(a.buffer) == 0 || len(b.buffer) == 0 {
+		return false, ErrDestroyed
+	}
+
+	// Check if either are hidden.
+	if a.hidden || b.hidden {
+		return false, ErrHidden
+	}
+
+	// Check both canaries before looking at the data.
+	if !canaryIntact(a.container) || !canaryIntact(b.container) {
+		return false, ErrCanaryViolation
+	}
+
+	// Do a time-constant comparison on the two buffers.
+	return subtle.ConstantTimeCompare(a.buffer, b.buffer) == 1, nil
+}
+
+/*
+XOR sets the contents of dst to the exclusive-or of a and b, which is a building block for things like combining key shares or applying a one-time pad without the result ever leaving protected memory. Only as many bytes as the shorter of a and b are processed, and the rest of dst is left untouched. Any of the three LockedBuffers may be the same, so XOR(a, a, b) updates a in place.
+
+If dst is shorter than both a and b, the call will return an ErrInvalidLength. If dst is immutable, the call will return an ErrImmutable. If any of them have been destroyed, the call will return an ErrDestroyed.
+*/
+func XOR(dst, a, b *LockedBuffer) error {
+	// Get a mutex lock on the LockedBuffers.
+	locked := lockAll([]*container{dst.container, a.container, b.container})
+	defer unlockAll(locked)
+
+	// Check if any are destroyed.
+	if len(dst.buffer) == 0 || len(a.buffer) == 0 || len(b.buffer) == 0 {
+		return ErrDestroyed
+	}
+
+	// Check if any are hidden.
+	if dst.hidden || a.hidden || b.hidden {
+		return ErrHidden
+	}
+
+	// Check if the destination is immutable.
+	if !dst.mutable {
+		return ErrImmutable
+	}
+
+	// Do the actual work.
+	return XORBytes(dst.buffer, a.buffer, b.buffer)
+}
+
+/*
+ConstantTimeCopy copies the contents of src over dst if v is 1, and leaves dst as it is if v is 0, in the same way as crypto/subtle.ConstantTimeCopy. The time taken, and the memory that is accessed, does not depend on v or on the contents of either LockedBuffer, which makes it suitable for branch-free cryptographic code. The behaviour is undefined if v takes any other value.
+
+If the LockedBuffers are not the same length, the call will return an ErrLengthMismatch. If dst is immutable, the call will return an ErrImmutable. If either of them have been destroyed, the call will return an ErrDestroyed.
+*/
+func ConstantTimeCopy(v int, dst, src *LockedBuffer) error {
+	// Get a mutex lock on the LockedBuffers.
+	lockPair(dst.container, src.container)
+	defer unlockPair(dst.container, src.container)
+
+	// Check if either are destroyed.
+	if len(dst.buffer) == 0 || len(src.buffer) == 0 {
+		return ErrDestroyed
+	}
+
+	// Check if either are hidden.
+	if dst.hidden || src.hidden {
+		return ErrHidden
+	}
+
+	// Check if the destination is immutable.
+	if !dst.mutable {
+		return ErrImmutable
+	}
+
+	// Check that the lengths match.
+	if len(dst.buffer) != len(src.buffer) {
+		return ErrLengthMismatch
+	}
+
+	// Do the actual work.
+	subtle.ConstantTimeCopy(v, dst.buffer, src.buffer)
+	return nil
+}
+
+/*
+ConstantTimeLookup copies entry number index of a table held in a LockedBuffer into dst, without the index leaking through timing or through which memory is accessed. The table is taken to be a sequence of entries that are entrySize bytes long, and every one of them is read in turn, with only the one that was asked for being copied, so the cache behaves the same whichever entry is wanted. This makes it suitable for secret-dependent lookups such as S-boxes. Only the first entrySize bytes of dst are written to.
+
+The cost grows with the size of the table, since all of it is read on every call. A read lock is held on the table, so any number of lookups can be made at once.
+
+If entrySize is less than one, the length of the table is not a multiple of it, or dst is shorter than it, the call will return an ErrInvalidLength. If index does not refer to an entry in the table, the call will return an ErrOutOfRange. If the table has been destroyed, the call will return an ErrDestroyed.
+*/
+func ConstantTimeLookup(table *LockedBuffer, entrySize, index int, dst []byte) error {
+	// Get a read lock on the table.
+	table.RLock()
+	defer table.RUnlock()
+
+	// Check if it's destroyed.
+	if len(table.buffer) == 0 {
+		return ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if table.hidden {
+		return ErrHidden
+	}
+
+	// Check that the table is made up of whole entries, and that one will fit in dst.
+	if entrySize < 1 || len(table.buffer)%entrySize != 0 || len(dst) < entrySize {
+		return ErrInvalidLength
+	}
+
+	// Check that the entry exists, without multiplying anything that might overflow.
+	if index < 0 || index >= len(table.buffer)/entrySize {
+		return ErrOutOfRange
+	}
+
+	// Go through every entry, copying only the one that matches. The comparison is done with arithmetic, since a branch would depend on the index.
+	for i := 0; i < len(table.buffer)/entrySize; i++ {
+		x := uint64(i ^ index)
+		selected := int(((x | -x) >> 63) ^ 1)
+		subtle.ConstantTimeCopy(selected, dst[:entrySize], table.buffer[i*entrySize:(i+1)*entrySize])
+	}
+
+	// Everything went well.
+	return nil
+}
+
+/*
+Split takes a LockedBuffer, splits it at a specified offset, and then returns the two newly created LockedBuffers. The mutability state of the original is preserved in the new LockedBuffers, and the original LockedBuffer is not destroyed, so call Destroy on it afterwards if the combined form is no longer needed.
+
+If the offset lies outside of the LockedBuffer, the call will return an ErrOutOfRange. If it lies at either end, so that one of the halves would be empty, the call will return an ErrInvalidLength.
+*/
+func Split(b *LockedBuffer, offset int) (*LockedBuffer, *LockedBuffer, error) {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		return nil, nil, ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if b.hidden {
+		return nil, nil, ErrHidden
+	}
+
+	// Check that the offset is within bounds.
+	if offset < 0 || offset > len(b.buffer) {
+		return nil, nil, ErrOutOfRange
+	}
+
+	// Create two new LockedBuffers with the same permissions, copying the values into them before they're made immutable.
+	firstBuf, err := newFilledContainer(len(b.buffer[:offset]), b.mutable, false, func(buf []byte) error {
+		copy(buf, b.buffer[:offset])
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secondBuf, err := newFilledContainer(len(b.buffer[offset:]), b.mutable, false, func(buf []byte) error {
+		copy(buf, b.buffer[offset:])
+		return nil
+	})
+	if err != nil {
+		firstBuf.Destroy()
+		return nil, nil, err
+	}
+
+	// Return the new LockedBuffers.
+	return firstBuf, secondBuf, nil
+}
+
+/*
+Trim shortens a LockedBuffer according to the given specifications. The mutability state of the original is preserved in the new LockedBuffer, and the original LockedBuffer is not destroyed.
+
+Trim takes an offset and a size as arguments. The resulting LockedBuffer starts at index [offset] and ends at index [offset+size].
+*/
+func Trim(b *LockedBuffer, offset, size int) (*LockedBuffer, error) {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		return nil, ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if b.hidden {
+		return nil, ErrHidden
+	}
+
+	// Create a new LockedBuffer with the same permissions, copying over the old before it's made immutable.
+	return newFilledContainer(size, b.mutable, false, func(buf []byte) error {
+		copy(buf, b.buffer[offset:offset+size])
+		return nil
+	})
+}
+
+/*
+Resize allocates a new LockedBuffer of a specified size and moves the contents of the original into it. Just like Golang's built-in copy function, only up to the smallest of the two sizes is copied over. The original LockedBuffer is destroyed afterwards.
+
+If the given LockedBuffer is immutable, the call will return an ErrImmutable. If the new size is less than one, the call will return an ErrInvalidLength.
+*/
+func Resize(b *LockedBuffer, size int) (*LockedBuffer, error) {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		b.Unlock()
+		return nil, ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if b.hidden {
+		b.Unlock()
+		return nil, ErrHidden
+	}
+
+	// Check if it's immutable.
+	if !b.mutable {
+		b.Unlock()
+		return nil, ErrImmutable
+	}
+
+	// Create new LockedBuffer and copy over the old.
+	newBuf, err := NewMutable(size)
+	if err != nil {
+		b.Unlock()
+		return nil, err
+	}
+	newBuf.Copy(b.buffer)
+
+	// Release the lock so that the original can be destroyed.
+	b.Unlock()
+	b.Destroy()
+
+	// Return the new LockedBuffer.
+	return newBuf, nil
+}
+
+/*
+GrowImmutable allocates a new, immutable LockedBuffer of a specified size and moves the contents of the original into it, with the remaining bytes set to zero. The original LockedBuffer is destroyed afterwards.
+
+Unlike making an immutable LockedBuffer mutable so that it can be passed to Resize, the contents are copied into the new LockedBuffer before it is made immutable and handed back, so there is never a writable handle to them. The new LockedBuffer is always given pages of its own, just like one made with NewImmutableFromBytes.
+
+If the LockedBuffer has been destroyed, the call will return an ErrDestroyed. If the new size is smaller than the current size, the call will return an ErrInvalidLength.
+*/
+func GrowImmutable(b *LockedBuffer, size int) (*LockedBuffer, error) {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		b.Unlock()
+		return nil, ErrDestroyed
+	}
+
+	// Check if it's hidden.
+	if b.hidden {
+		b.Unlock()
+		return nil, ErrHidden
+	}
+
+	// Check that it isn't shrinking.
+	if size < len(b.buffer) {
+		b.Unlock()
+		return nil, ErrInvalidLength
+	}
+
+	// Create new LockedBuffer, copying over the old before it's made immutable.
+	newBuf, err := newFilledContainer(size, false, false, func(buf []byte) error {
+		copy(buf, b.buffer)
+		return nil
+	})
+	if err != nil {
+		b.Unlock()
+		return nil, err
+	}
+
+	// Release the lock so that the original can be destroyed.
+	b.Unlock()
+	b.Destroy()
+
+	// Return the new LockedBuffer.
+	return newBuf, nil
+}
+
+/*
+WipeBytes zeroes out a given byte slice. It is recommended that you call WipeBytes on slices after utilizing the Copy or CopyAt methods.
+
+The wipe is never optimised away, even if the slice is not used again afterwards, and the zeroes are written to memory before WipeBytes returns, in the same way as explicit_bzero in C. Large slices are wiped a chunk at a time, so that other goroutines are not held up for long. Destroy uses the same wipe.
+
+Due to the nature of memory allocated by the Go runtime, WipeBytes cannot guarantee that the data does not exist elsewhere in memory. Therefore, your program should aim to (when possible) store sensitive data only in LockedBuffers.
+*/
+func WipeBytes(b []byte) {
+	wipeBytes(b)
+}
+
+/*
+ScrambleBytes overwrites a given byte slice with cryptographically-secure pseudo-random bytes instead of zeroes, so that it is not obvious from looking at the memory that it ever held anything. To do the same to a LockedBuffer, use FillRandomBytes.
+
+If random bytes could not be obtained, the error from the system's CSPRNG is returned and the slice may have been left partially overwritten.
+*/
+func ScrambleBytes(b []byte) error {
+	_, err := rand.Read(b)
+	return err
+}
+
+/*
+XORBytes sets dst[i] to a[i] ^ b[i] for every index of the shorter of a and b, working a whole machine word at a time where possible. The slices may overlap exactly, so XORBytes(a, a, b) updates a in place. To do the same with LockedBuffers, use XOR.
+
+If dst is shorter than both a and b, the call will return an ErrInvalidLength and dst is left untouched.
+*/
+func XORBytes(dst, a, b []byte) error {
+	// Work out how much to process.
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+
+	// Check that there's room for it.
+	if len(dst) < n {
+		return ErrInvalidLength
+	}
+
+	xorBytes(dst[:n], a[:n], b[:n])
+	return nil
+}
+
+/*
+DestroyAll calls Destroy on all LockedBuffers that have not already been destroyed.
+
+CatchInterrupt and SafeExit both call DestroyAll before exiting.
 */
 func DestroyAll() {
 	// Get a Mutex lock on allLockedBuffers, and get a copy.
@@ -829,6 +2374,324 @@ func DestroyAll() {
 	}
 }
 
+/*
+MakeImmutableAll calls MakeImmutable on all LockedBuffers that have not been destroyed, such as before a checkpoint or a fork, so that nothing can change any of them for the time being, and returns the errors from any calls that failed. LockedBuffers in a slab, or created with NewFromMmap, can't be made immutable, so they are reported with an ErrUnsupported.
+
+It works on a snapshot of the active LockedBuffers, taking the mutex lock of each one in turn, so it is not atomic: LockedBuffers that are created part of the way through are not affected, and ones that are destroyed part of the way through are skipped.
+*/
+func MakeImmutableAll() []error {
+	return forEachContainer((*container).MakeImmutable)
+}
+
+/*
+MakeMutableAll calls MakeMutable on all LockedBuffers that have not been destroyed, in the same way as MakeImmutableAll, and returns the errors from any calls that failed.
+
+Note that this includes LockedBuffers that were created immutable and have never been mutable, such as the keys that memguard uses internally, so it does not undo MakeImmutableAll so much as make everything writable. Read-only memory from NewFromMmap can't be made mutable, so each such LockedBuffer results in an ErrUnsupported.
+*/
+func MakeMutableAll() []error {
+	return forEachContainer((*container).MakeMutable)
+}
+
+// Call a method on a snapshot of the active containers, collecting the errors and skipping any that have been destroyed.
+func forEachContainer(f func(*container) error) []error {
+	// Get a Mutex lock on allLockedBuffers, and get a copy.
+	allLockedBuffersMutex.Lock()
+	containers := make([]*container, len(allLockedBuffers))
+	copy(containers, allLockedBuffers)
+	allLockedBuffersMutex.Unlock()
+
+	var errs []error
+	for _, b := range containers {
+		if err := f(b); err != nil && err != ErrDestroyed {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+/*
+ActiveBuffers returns the number of LockedBuffers that have been created but not yet destroyed.
+*/
+func ActiveBuffers() int {
+	// Get a Mutex lock on allLockedBuffers.
+	allLockedBuffersMutex.Lock()
+	defer allLockedBuffersMutex.Unlock()
+
+	return len(allLockedBuffers)
+}
+
+/*
+ForEach calls a function on each of the active LockedBuffers in turn, stopping early if the function returns false. It works on a snapshot of the active LockedBuffers, so the function is free to create or destroy LockedBuffers, and any that are destroyed by someone else part of the way through will simply report that they have been destroyed.
+
+Just like the values returned by FindByLabel, the LockedBuffers passed to the function do not stop the originals from being garbage collected.
+*/
+func ForEach(f func(*LockedBuffer) bool) {
+	// Get a Mutex lock on allLockedBuffers, and get a copy.
+	allLockedBuffersMutex.Lock()
+	containers := make([]*container, len(allLockedBuffers))
+	copy(containers, allLockedBuffers)
+	allLockedBuffersMutex.Unlock()
+
+	for _, b := range containers {
+		if !f(&LockedBuffer{b, new(littleBird)}) {
+			return
+		}
+	}
+}
+
+/*
+FindByLabel returns all of the active LockedBuffers that have been given a specified label with SetLabel.
+
+The returned values refer to the same protected memory as the originals, but they do not stop the originals from being garbage collected. If the original LockedBuffer is collected, its memory is destroyed as usual and the value returned here will report that it has been destroyed.
+*/
+func FindByLabel(name string) []*LockedBuffer {
+	// Get a Mutex lock on allLockedBuffers, and get a copy.
+	allLockedBuffersMutex.Lock()
+	containers := make([]*container, len(allLockedBuffers))
+	copy(containers, allLockedBuffers)
+	allLockedBuffersMutex.Unlock()
+
+	var found []*LockedBuffer
+	for _, b := range containers {
+		if b.Label() == name {
+			found = append(found, &LockedBuffer{b, new(littleBird)})
+		}
+	}
+
+	return found
+}
+
+/*
+LeakCheck calls a function and returns the LockedBuffers that were created while it ran and were still active when it returned, which makes it easy for tests to check that some code destroys everything that it creates. LockedBuffers that were created and destroyed within the function are not reported, and neither are ones that existed beforehand, even if the function destroyed them.
+
+Since every active LockedBuffer is considered, any created by other goroutines while the function is running are reported as well. Just like the values returned by FindByLabel, the returned LockedBuffers do not stop the originals from being garbage collected.
+*/
+func LeakCheck(f func()) []*LockedBuffer {
+	// Take note of the LockedBuffers that already exist.
+	allLockedBuffersMutex.Lock()
+	before := make(map[*container]bool, len(allLockedBuffers))
+	for _, b := range allLockedBuffers {
+		before[b] = true
+	}
+	allLockedBuffersMutex.Unlock()
+
+	f()
+
+	// Find the ones that have appeared since.
+	allLockedBuffersMutex.Lock()
+	defer allLockedBuffersMutex.Unlock()
+
+	var leaked []*LockedBuffer
+	for _, b := range allLockedBuffers {
+		if !before[b] {
+			leaked = append(leaked, &LockedBuffer{b, new(littleBird)})
+		}
+	}
+
+	return leaked
+}
+
+/*
+SetMaxAllocSize sets the largest amount of memory, in bytes, that a single LockedBuffer may use, including its guard pages and the padding that rounds it up to a multiple of the page size. Requests for anything larger return an ErrSizeTooLarge. The default is 1 GiB.
+*/
+func SetMaxAllocSize(n int) {
+	maxAllocSizeMutex.Lock()
+	defer maxAllocSizeMutex.Unlock()
+
+	maxAllocSize = n
+}
+
+/*
+SetMemoryLimit caps the total amount of memory, in bytes, that memguard will keep locked at any one time, so that one runaway component can't use up the whole of the limit that the kernel places on the process. This is a soft quota that is kept entirely by memguard, independently of RLIMIT_MEMLOCK. Everything that locks memory counts towards it, including slabs, batches, idle LockedBuffers in a Pool, and LockedBuffers that are resumed after being suspended, and it is given back when the memory is unlocked.
+
+Once the limit is reached, anything that would lock more memory fails with an ErrMemoryLimitExceeded, whatever the lock policy. Lowering the limit below what is already locked doesn't affect existing LockedBuffers. Calling SetMemoryLimit with zero or less, which is the default, removes the limit.
+*/
+func SetMemoryLimit(n int) {
+	memoryLimitMutex.Lock()
+	defer memoryLimitMutex.Unlock()
+
+	if n < 0 {
+		n = 0
+	}
+	memoryLimit = n
+}
+
+// LockPolicy describes what should happen when the memory of a new LockedBuffer cannot be locked into RAM. See SetLockPolicy.
+type LockPolicy int
+
+const (
+	// LockRequired makes the creation of a LockedBuffer fail if its memory cannot be locked. This is the default.
+	LockRequired LockPolicy = iota
+
+	// LockBestEffort tries to lock the memory of each LockedBuffer, but carries on without locking it if that fails.
+	LockBestEffort
+
+	// LockDisabled never locks the memory of LockedBuffers.
+	LockDisabled
+)
+
+/*
+SetLockPolicy sets what happens to LockedBuffers created from now on when their memory cannot be locked, which lets memguard be used in environments such as unprivileged containers where the limit on locked memory is zero. Guard pages, canaries, and wiping on destruction are unaffected, so a degraded LockedBuffer is still better protected than a regular slice, but its contents may end up being written to swap. Use IsLocked to find out whether a particular LockedBuffer is locked.
+
+LockedBuffers that already exist are not affected.
+*/
+func SetLockPolicy(policy LockPolicy) {
+	lockPolicyMutex.Lock()
+	defer lockPolicyMutex.Unlock()
+
+	lockPolicy = policy
+}
+
+/*
+SetLockRetryPolicy makes memguard try again, up to a specified number of times, when locking the memory of a new LockedBuffer fails because the limit on locked memory has been reached. Under bursty load that limit can be exceeded momentarily while other LockedBuffers are still being destroyed, so waiting briefly is often enough for the lock to succeed. The delay before the first retry is given, and it doubles with each retry after that.
+
+Failures for any other reason are not retried. By default no retries are made, and calling SetLockRetryPolicy with an attempts value less than one restores that.
+*/
+func SetLockRetryPolicy(attempts int, delay time.Duration) {
+	lockRetryMutex.Lock()
+	defer lockRetryMutex.Unlock()
+
+	if attempts < 0 {
+		attempts = 0
+	}
+	lockRetryAttempts, lockRetryDelay = attempts, delay
+}
+
+/*
+SetWipeVerification turns on or off an extra check when LockedBuffers are destroyed, which reads back the memory after it has been wiped and panics if any of it is not zero. This guards against the wipe having been optimised away by the compiler, or not having reached the memory for some other reason, at the cost of reading through all of the memory a second time. It is off by default.
+*/
+func SetWipeVerification(enabled bool) {
+	wipeVerificationMutex.Lock()
+	defer wipeVerificationMutex.Unlock()
+
+	wipeVerification = enabled
+}
+
+/*
+SetGuardPageCount sets how many inaccessible guard pages are placed on either side of the data of LockedBuffers created from now on. More guard pages make it more likely that an overflow which skips over memory, rather than writing every byte in turn, still hits one and crashes the process, at the cost of more address space. LockedBuffers that already exist keep the guard pages that they were created with. The guard pages count towards the limit set with SetMaxAllocSize.
+
+If n is less than one, the default of one guard page is used.
+*/
+func SetGuardPageCount(n int) {
+	guardPageCountMutex.Lock()
+	defer guardPageCountMutex.Unlock()
+
+	// Keep the size calculations from overflowing.
+	if n < 1 {
+		n = 1
+	} else if n > maxInt/(4*pageSize) {
+		n = maxInt / (4 * pageSize)
+	}
+	guardPageCount = n
+}
+
+/*
+SetCanarySize sets the length, in bytes, of the canary placed in front of the data of LockedBuffers created from now on. A longer canary makes it more likely that a partial overflow into the canary is caught. LockedBuffers that already exist keep the canary that they were created with.
+
+If n is less than one, the default length of 32 bytes is used.
+*/
+func SetCanarySize(n int) {
+	canarySettingMutex.Lock()
+	defer canarySettingMutex.Unlock()
+
+	if n < 1 {
+		n = 32
+	}
+	canarySize = n
+}
+
+/*
+SetCanaryPattern makes LockedBuffers created from now on use canaries made up of repetitions of a fixed pattern, instead of the random value that is generated for each process. A known pattern is easy to search for in a core dump, but it is also easy for an attacker to reproduce, so only use it for debugging. LockedBuffers that already exist keep the canary that they were created with.
+
+Calling SetCanaryPattern with an empty pattern goes back to using the random value.
+*/
+func SetCanaryPattern(pattern []byte) {
+	canarySettingMutex.Lock()
+	defer canarySettingMutex.Unlock()
+
+	if len(pattern) == 0 {
+		canaryPattern = nil
+		return
+	}
+	canaryPattern = make([]byte, len(pattern))
+	copy(canaryPattern, pattern)
+}
+
+/*
+ExposureCount returns the number of times that the contents of a LockedBuffer have been copied out into regular memory with CopyOut or BigInt since the program started.
+*/
+func ExposureCount() uint64 {
+	return atomic.LoadUint64(&exposureCount)
+}
+
+/*
+PageSize returns the size, in bytes, of a page of memory on this system, as reported by the kernel. Every LockedBuffer takes up a whole number of pages, plus a guard page on either side, so sizes that are a multiple of this waste the least memory. It is not always 4096; arm64 and ppc64 systems commonly use 16 or 64 KiB pages.
+*/
+func PageSize() int {
+	return pageSize
+}
+
+/*
+RoundToPageSize rounds a length up to the nearest multiple of the page size, which is how much locked memory a LockedBuffer of that length would use if it had no canary.
+*/
+func RoundToPageSize(n int) int {
+	return roundToPageSize(n)
+}
+
+/*
+LockedMemory returns the total number of bytes of memory that are currently locked by active LockedBuffers. This includes the padding needed to round each LockedBuffer up to a multiple of the page size, as well as the whole of every slab in use, and so it can be compared against the limit that the system kernel places on the process. Memory that was left unlocked because of the lock policy is not counted.
+*/
+func LockedMemory() int {
+	// Sum the sizes of the locked regions that aren't part of a slab, reading each one under its read lock since Suspend and Resume can change them.
+	var total int
+	forEachContainer(func(b *container) error {
+		b.RLock()
+		defer b.RUnlock()
+
+		if b.slab == nil && b.locked {
+			total += len(b.inner)
+		}
+		return nil
+	})
+
+	// Add on the slabs.
+	allSlabsMutex.Lock()
+	for _, s := range allSlabs {
+		if s.locked {
+			total += len(s.inner)
+		}
+	}
+	allSlabsMutex.Unlock()
+
+	return total
+}
+
+/*
+CheckMemlockBudget checks that LockedBuffers with a given number of bytes of memory between them can still be locked, without going over the limit that the kernel places on the process (RLIMIT_MEMLOCK on Unix systems). It is meant to be called at startup or in health checks, so that a limit that is too low is reported straight away, rather than on the first allocation deep inside of a request.
+
+The amount needed is rounded up to a multiple of the page size, and compared against what is left of the limit after the memory that is already locked, as reported by LockedMemory. Memory that has been locked in other ways, such as with DisableSwap, is not taken into account. Windows has no fixed limit, so the check always passes there.
+
+If there isn't enough room left, the call will return an ErrMemlockBudget. If the limit could not be read, that error is returned.
+*/
+func CheckMemlockBudget(needed int) error {
+	// Get the limit.
+	limit, err := memcall.LockLimit()
+	if err != nil {
+		return err
+	}
+	if limit < 0 {
+		return nil
+	}
+
+	// Compare it against what we need on top of what's already locked.
+	if needed > limit || roundToPageSize(needed) > limit-LockedMemory() {
+		return ErrMemlockBudget
+	}
+
+	// Everything went well.
+	return nil
+}
+
 /*
 CatchInterrupt starts a goroutine that monitors for interrupt signals. It accepts a function of type func() and executes that before calling SafeExit(0).
 
@@ -852,8 +2715,46 @@ func CatchInterrupt(f func()) {
 	})
 }
 
+/*
+CatchSignal starts a goroutine that monitors for the given signals, defaulting to interrupts and SIGTERM if none are given. When one arrives, every LockedBuffer is destroyed with DestroyAll and then the handler is called with the signal that was received.
+
+If the handler is nil, the process then exits with an exit-code of 1. Otherwise exiting is left up to the handler: if it returns, the process carries on running (for example so that it can shut down gracefully), but without any of its LockedBuffers. Only the first signal is caught, and the signals go back to being handled as they were before CatchSignal was called, so a second interrupt still stops a process whose handler got stuck.
+
+If CatchSignal is called multiple times, only the first call is executed and all subsequent calls are ignored.
+*/
+func CatchSignal(handler func(os.Signal), signals ...os.Signal) {
+	// Only do this if it hasn't been done before.
+	catchSignalOnce.Do(func() {
+		// Fall back to the same signals as CatchInterrupt.
+		if len(signals) == 0 {
+			signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+		}
+
+		// Create a channel to listen on.
+		c := make(chan os.Signal, 2)
+
+		// Notify the channel if we receive a signal.
+		signal.Notify(c, signals...)
+
+		// Start a goroutine to listen on the channel.
+		go func() {
+			s := <-c       // Wait for signal.
+			signal.Stop(c) // Stop catching signals, since nothing reads them from now on.
+			DestroyAll()   // Cleanup protected memory.
+
+			// Hand over to the user, or exit if there's no-one to hand over to.
+			if handler == nil {
+				os.Exit(1)
+			}
+			handler(s)
+		}()
+	})
+}
+
 /*
 SafeExit exits the program with a specified exit-code, but calls DestroyAll first.
+
+It is safe to call SafeExit from deferred functions and signal handlers at the same time, since Destroy does nothing to LockedBuffers that have already been destroyed and so no memory is ever freed twice.
 */
 func SafeExit(c int) {
 	// Cleanup protected memory.
@@ -863,6 +2764,51 @@ func SafeExit(c int) {
 	os.Exit(c)
 }
 
+/*
+SetPanicHandler registers a function that is called with the panic value whenever memguard is about to panic, such as when Destroy detects a buffer overflow. This gives the program a last chance to, for example, flush audit logs before it goes down.
+
+The panic still happens after the handler returns, and also if the handler itself panics. Calling SetPanicHandler with nil removes the handler.
+*/
+func SetPanicHandler(f func(interface{})) {
+	panicHandlerMutex.Lock()
+	defer panicHandlerMutex.Unlock()
+
+	panicHandler = f
+}
+
+/*
+SetLeakLogger registers a logger that is told about every LockedBuffer that is garbage collected without having been destroyed first. Such LockedBuffers are always destroyed when they are collected, but since that could be a long time after they were last used, a leak usually means that a call to Destroy is missing somewhere.
+
+Calling SetLeakLogger with nil, which is the default, stops leaks from being reported.
+*/
+func SetLeakLogger(l *log.Logger) {
+	leakLoggerMutex.Lock()
+	defer leakLoggerMutex.Unlock()
+
+	leakLogger = l
+}
+
+/*
+DisableSwap asks the kernel to lock all of the memory of the process, both what is in use now and anything allocated in the future, so that none of it can be swapped to disk. This covers the regular Go heap, which briefly holds secrets before they make their way into LockedBuffers, in addition to the LockedBuffers themselves.
+
+The locked memory counts towards the limit that the kernel places on the process (RLIMIT_MEMLOCK on Unix systems), which is usually far too low for a whole Go program, so in practice the limit has to be raised or the process has to be privileged for this to succeed. Once it has succeeded, any allocation that would take the process over the limit fails, which the Go runtime treats as fatal. Windows has no equivalent, so it always returns an error there.
+*/
+func DisableSwap() error {
+	return memcall.LockAll()
+}
+
+/*
+SetWipeOnFork sets whether the memory of new LockedBuffers is marked with MADV_WIPEONFORK, so that the child of a fork sees it as zeroed while the parent keeps its contents. This stops a forked child from holding a second copy of every secret. It is enabled by default.
+
+Go programs rarely fork without immediately calling exec, which replaces the memory of the child anyway, so this mostly matters when fork is called directly or from C code. It is only supported on Linux 4.14 or later, with the default Allocator, and has no effect elsewhere. LockedBuffers that already exist are not affected.
+*/
+func SetWipeOnFork(enabled bool) {
+	wipeOnForkMutex.Lock()
+	defer wipeOnForkMutex.Unlock()
+
+	wipeOnFork = enabled
+}
+
 /*
 DisableUnixCoreDumps disables core-dumps.
 
@@ -2,10 +2,28 @@ package memguard
 
 import (
 	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"os/exec"
 	"runtime"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
+	"testing/iotest"
+	"time"
 	"unsafe"
+
+	"github.com/awnumar/memguard/memcall"
 )
 
 func TestNew(t *testing.T) {
@@ -37,6 +55,34 @@ func TestNew(t *testing.T) {
 		t.Error("unexpected state")
 	}
 	a.Destroy()
+
+	// An allocation this large should be refused rather than crash the process.
+	for _, size := range []int{maxInt, maxInt - 31, maxInt - 32 - 3*pageSize, 1 << 30} {
+		d, err := NewMutable(size)
+		if err != ErrSizeTooLarge {
+			t.Error("expected ErrSizeTooLarge;", size, err)
+		}
+		if d != nil {
+			t.Error("expected nil, got *LockedBuffer")
+		}
+	}
+}
+
+func TestSetMaxAllocSize(t *testing.T) {
+	defer SetMaxAllocSize(1 << 30)
+	SetMaxAllocSize(4 * pageSize)
+
+	// Two guard pages plus two pages of data is fine.
+	b, err := NewMutable(pageSize)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	b.Destroy()
+
+	// A third page of data is not.
+	if _, err := NewMutable(2*pageSize - 31); err != ErrSizeTooLarge {
+		t.Error("expected ErrSizeTooLarge;", err)
+	}
 }
 
 func TestNewFromBytes(t *testing.T) {
@@ -68,6 +114,280 @@ func TestNewFromBytes(t *testing.T) {
 		t.Error("unexpected state")
 	}
 	a.Destroy()
+
+	src := []byte("yellow submarine")
+	d, err := NewImmutableFromBytes(src)
+	if err != nil {
+		t.Error("unexpected error")
+	}
+	if !bytes.Equal(src, make([]byte, 16)) {
+		t.Error("source slice was not wiped;", src)
+	}
+	if !bytes.Equal(d.Buffer(), []byte("yellow submarine")) {
+		t.Error("d.Buffer() != required")
+	}
+	d.Destroy()
+}
+
+func TestSetDefaultMutability(t *testing.T) {
+	defer SetDefaultMutability(true)
+
+	// New LockedBuffers should be mutable by default.
+	a, err := New(16)
+	if err != nil || !a.IsMutable() {
+		t.Error("unexpected result;", err)
+	}
+	a.Destroy()
+
+	// Until that's changed.
+	SetDefaultMutability(false)
+	b, err := New(16)
+	if err != nil || b.IsMutable() {
+		t.Error("unexpected result;", err)
+	}
+	if err := b.Copy([]byte("yellow submarine")); err != ErrImmutable {
+		t.Error("expected ErrImmutable; got", err)
+	}
+	b.MakeMutable()
+	if err := b.Copy([]byte("yellow submarine")); err != nil {
+		t.Error("unexpected error;", err)
+	}
+	b.Destroy()
+
+	// Filling should happen before it's made immutable.
+	c, err := NewFromFunc(16, func(buf []byte) error {
+		copy(buf, "yellow submarine")
+		return nil
+	})
+	if err != nil || c.IsMutable() || !bytes.Equal(c.Buffer(), []byte("yellow submarine")) {
+		t.Error("unexpected result;", err)
+	}
+	c.Destroy()
+
+	// Errors from the fill function should be passed on, without leaving anything behind.
+	before := ActiveBuffers()
+	failure := errors.New("fill failed")
+	if d, err := NewFromFunc(16, func(buf []byte) error { return failure }); d != nil || err != failure {
+		t.Error("unexpected result;", err)
+	}
+	if ActiveBuffers() != before {
+		t.Error("failed LockedBuffer was left behind")
+	}
+
+	if _, err := NewFromFunc(0, nil); err != ErrInvalidLength {
+		t.Error("expected ErrInvalidLength; got", err)
+	}
+}
+
+func TestNewFromString(t *testing.T) {
+	// Strings built at runtime should be wiped.
+	src := strings.Repeat("x", 16)
+	b, err := NewImmutableFromString(src)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !bytes.Equal(b.Buffer(), bytes.Repeat([]byte("x"), 16)) || b.IsMutable() {
+		t.Error("unexpected result;", b.Buffer())
+	}
+	if src != string(make([]byte, 16)) {
+		t.Error("source not wiped;", src)
+	}
+	b.Destroy()
+
+	// Constants should be copied and left alone.
+	b, err = NewMutableFromString("yellow submarine")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if string(b.Buffer()) != "yellow submarine" || !b.IsMutable() {
+		t.Error("unexpected result;", b.Buffer())
+	}
+	b.Destroy()
+
+	if _, err := NewMutableFromString(""); err != ErrInvalidLength {
+		t.Error("expected ErrInvalidLength; got", err)
+	}
+}
+
+func TestNewHugePages(t *testing.T) {
+	size := 3 << 20
+	a, err := NewMutableHugePages(size)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	b, err := NewImmutableHugePages(size)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if !a.IsMutable() || b.IsMutable() {
+		t.Error("unexpected state")
+	}
+	if a.Size() != size || !bytes.Equal(b.Buffer(), make([]byte, size)) {
+		t.Error("unexpected buffer")
+	}
+	if !a.huge {
+		t.Log("huge pages not available; fell back to normal pages")
+	}
+
+	// Everything should work as usual.
+	fillRandBytes(a.Buffer())
+	if err := a.Verify(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	a.MakeImmutable()
+	a.MakeMutable()
+	if err := a.Hide(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	a.Reveal()
+	a.Buffer()[size-1] = 1
+	a.Destroy()
+	b.Destroy()
+
+	// Even small ones, or ones that would otherwise use a slab.
+	EnableSlabAllocator(32)
+	defer EnableSlabAllocator(0)
+	c, _ := NewMutableHugePages(16)
+	if c.slab != nil {
+		t.Error("expected pages of its own")
+	}
+	c.Destroy()
+
+	if _, err := NewMutableHugePages(0); err != ErrInvalidLength {
+		t.Error("expected ErrInvalidLength; got", err)
+	}
+}
+
+func TestNewOnNode(t *testing.T) {
+	// Node 0 always exists, but the kernel may not support NUMA or may not let us use it.
+	b, err := NewMutableOnNode(32, 0)
+	if err != nil {
+		t.Log("could not allocate on node 0:", err)
+	} else {
+		if len(b.Buffer()) != 32 || !b.IsMutable() || b.memory == nil || b.slab != nil {
+			t.Error("unexpected state")
+		}
+		b.Destroy()
+	}
+	if err == nil {
+		b, err := NewImmutableOnNode(32, 0)
+		if err != nil || b.IsMutable() {
+			t.Error("unexpected result;", err)
+		}
+		b.Destroy()
+	}
+
+	if _, err := NewMutableOnNode(32, 1<<20); err == nil {
+		t.Error("expected error for nonexistent node")
+	}
+	if _, err := NewMutableOnNode(32, -1); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange; got", err)
+	}
+	if _, err := NewMutableOnNode(0, 0); err != ErrInvalidLength {
+		t.Error("expected ErrInvalidLength; got", err)
+	}
+
+	// Only the default Allocator is supported.
+	SetAllocator(&MockAllocator{})
+	defer SetAllocator(nil)
+	if _, err := NewMutableOnNode(32, 0); err != ErrUnsupported {
+		t.Error("expected ErrUnsupported; got", err)
+	}
+}
+
+func TestNewFromMmap(t *testing.T) {
+	region, _ := memcall.Alloc(pageSize)
+	defer memcall.Free(region)
+	copy(region, "yellow submarine")
+
+	// A writable region.
+	b, err := NewFromMmap(region[:16], true)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if !b.IsMutable() || b.IsLocked() {
+		t.Error("unexpected state")
+	}
+	if &b.Buffer()[0] != &region[0] || cap(b.Buffer()) != 16 {
+		t.Error("expected the region itself")
+	}
+	if ok, _ := b.EqualBytes([]byte("yellow submarine")); !ok {
+		t.Error("unexpected contents;", b.Buffer())
+	}
+	if err := b.Verify(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if err := b.MakeImmutable(); err != ErrUnsupported || !b.IsMutable() {
+		t.Error("expected ErrUnsupported; got", err)
+	}
+	if err := b.MakeMutable(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if err := b.Hide(); err != ErrUnsupported {
+		t.Error("expected ErrUnsupported; got", err)
+	}
+
+	// Destroying it wipes the region but leaves it mapped.
+	b.Destroy()
+	if !bytes.Equal(region[:16], make([]byte, 16)) {
+		t.Error("region not wiped;", region[:16])
+	}
+
+	// A read-only region is left alone.
+	copy(region, "yellow submarine")
+	memcall.Protect(region, true, false)
+	c, _ := NewFromMmap(region[:16], false)
+	if c.IsMutable() {
+		t.Error("expected immutable")
+	}
+	if err := c.MakeMutable(); err != ErrUnsupported {
+		t.Error("expected ErrUnsupported; got", err)
+	}
+	p := NewPool(1)
+	p.Put(c)
+	if !c.IsDestroyed() || !bytes.Equal(region[:16], []byte("yellow submarine")) {
+		t.Error("unexpected state after destroying")
+	}
+	memcall.Protect(region, true, true)
+
+	if _, err := NewFromMmap(nil, true); err != ErrInvalidLength {
+		t.Error("expected ErrInvalidLength; got", err)
+	}
+}
+
+func TestNewFromEnv(t *testing.T) {
+	const key = "MEMGUARD_TEST_SECRET"
+
+	for _, mutable := range []bool{false, true} {
+		constructor := NewImmutableFromEnv
+		if mutable {
+			constructor = NewMutableFromEnv
+		}
+
+		// The value should be moved out of the environment.
+		os.Setenv(key, "yellow submarine")
+		b, err := constructor(key)
+		if err != nil {
+			t.Error("unexpected error:", err)
+		}
+		if !bytes.Equal(b.Buffer(), []byte("yellow submarine")) || b.IsMutable() != mutable {
+			t.Error("unexpected value;", b.Buffer(), b.IsMutable())
+		}
+		if _, ok := os.LookupEnv(key); ok {
+			t.Error("expected variable to be unset")
+		}
+		b.Destroy()
+
+		// Unset or empty variables.
+		if _, err := constructor(key); err != ErrEnvNotSet {
+			t.Error("expected ErrEnvNotSet; got", err)
+		}
+		os.Setenv(key, "")
+		if _, err := constructor(key); err != ErrInvalidLength {
+			t.Error("expected ErrInvalidLength; got", err)
+		}
+		os.Unsetenv(key)
+	}
 }
 
 func TestNewRandom(t *testing.T) {
@@ -330,498 +650,4362 @@ func TestInt64(t *testing.T) {
 	}
 }
 
-func TestGetMetadata(t *testing.T) {
-	b, _ := NewMutable(8)
+func TestUintAt(t *testing.T) {
+	b, _ := NewMutable(12)
 
-	if b.IsMutable() != true {
-		t.Error("incorrect value")
+	if err := b.PutUint32At(0, 0xdeadbeef); err != nil {
+		t.Error("unexpected error:", err)
 	}
-	if b.IsDestroyed() != false {
-		t.Error("incorrect value")
+	if err := b.PutUint64At(4, 0x0102030405060708); err != nil {
+		t.Error("unexpected error:", err)
 	}
-
-	b.MakeImmutable()
-	if b.IsMutable() != false {
-		t.Error("incorrect value")
+	if !bytes.Equal(b.Buffer(), []byte{0xde, 0xad, 0xbe, 0xef, 1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Error("unexpected value;", b.Buffer())
 	}
 
-	b.Destroy()
-	if b.IsDestroyed() != true {
-		t.Error("incorrect value")
+	if v, err := b.Uint32At(0); v != 0xdeadbeef || err != nil {
+		t.Error("unexpected return values;", v, err)
 	}
-}
-
-func TestEqualTo(t *testing.T) {
-	a, _ := NewImmutableFromBytes([]byte("test"))
-
-	equal, err := a.EqualBytes([]byte("test"))
-	if err != nil {
-		t.Error("unexpected error")
+	if v, err := b.Uint32At(8); v != 0x05060708 || err != nil {
+		t.Error("unexpected return values;", v, err)
 	}
-
-	if !equal {
-		t.Error("should be equal")
+	if v, err := b.Uint64At(4); v != 0x0102030405060708 || err != nil {
+		t.Error("unexpected return values;", v, err)
 	}
 
-	equal, err = a.EqualBytes([]byte("toast"))
-	if err != nil {
-		t.Error("unexpected error")
+	if _, err := b.Uint32At(9); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange")
 	}
-
-	if equal {
-		t.Error("should not be equal")
+	if _, err := b.Uint64At(-1); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange")
 	}
-
-	a.Destroy()
-
-	if equal, err := a.EqualBytes([]byte("test")); equal || err != ErrDestroyed {
-		t.Error("unexpected return values with destroyed LockedBuffer")
+	if err := b.PutUint32At(10, 1); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange")
+	}
+	if err := b.PutUint64At(5, 1); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange")
 	}
-}
-
-func TestReadOnly(t *testing.T) {
-	b, _ := NewMutable(8)
 
-	if err := b.MakeImmutable(); err != nil {
-		t.Error("unexpected error")
+	// Offsets so large that adding to them overflows shouldn't get past the check.
+	for _, offset := range []int{maxInt, maxInt - 3, maxInt - 7} {
+		if _, err := b.Uint32At(offset); err != ErrOutOfRange {
+			t.Error("expected ErrOutOfRange;", offset)
+		}
+		if _, err := b.Uint64At(offset); err != ErrOutOfRange {
+			t.Error("expected ErrOutOfRange;", offset)
+		}
+		if err := b.PutUint32At(offset, 1); err != ErrOutOfRange {
+			t.Error("expected ErrOutOfRange;", offset)
+		}
+		if err := b.PutUint64At(offset, 1); err != ErrOutOfRange {
+			t.Error("expected ErrOutOfRange;", offset)
+		}
 	}
-	if b.IsMutable() {
-		t.Error("unexpected state")
+
+	b.MakeImmutable()
+	if err := b.PutUint32At(0, 1); err != ErrImmutable {
+		t.Error("expected ErrImmutable")
 	}
-	if err := b.MakeMutable(); err != nil {
-		t.Error("unexpected error")
+	if err := b.PutUint64At(0, 1); err != ErrImmutable {
+		t.Error("expected ErrImmutable")
 	}
-	if !b.IsMutable() {
-		t.Error("unexpected state")
+	if v, err := b.Uint32At(0); v != 0xdeadbeef || err != nil {
+		t.Error("unexpected return values;", v, err)
 	}
 
 	b.Destroy()
-
-	if err := b.MakeImmutable(); err != ErrDestroyed {
+	if _, err := b.Uint32At(0); err != ErrDestroyed {
 		t.Error("expected ErrDestroyed")
 	}
-
-	if err := b.MakeMutable(); err != ErrDestroyed {
+	if _, err := b.Uint64At(0); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+	if err := b.PutUint32At(0, 1); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+	if err := b.PutUint64At(0, 1); err != ErrDestroyed {
 		t.Error("expected ErrDestroyed")
 	}
 }
 
-func TestMove(t *testing.T) {
-	// When buf is larger than LockedBuffer.
-	b, _ := NewMutable(16)
-	buf := []byte("this is a very large buffer")
-	b.Move(buf)
-	if !bytes.Equal(buf, make([]byte, len(buf))) {
-		t.Error("expected buf to be nil")
+func TestBigInt(t *testing.T) {
+	b, _ := NewMutableFromBytes([]byte{0, 0, 1, 2, 3, 4})
+
+	count := ExposureCount()
+	x, err := b.BigInt()
+	if err != nil {
+		t.Error("unexpected error:", err)
 	}
-	if !bytes.Equal(b.Buffer(), []byte("this is a very l")) {
-		t.Error("bytes were't copied properly")
+	if x.Int64() != 0x01020304 {
+		t.Error("unexpected value;", x)
+	}
+	if ExposureCount() != count+1 {
+		t.Error("unexpected exposure count;", ExposureCount())
 	}
-	b.Destroy()
 
-	// When buf is smaller than LockedBuffer.
-	b, _ = NewMutable(16)
-	buf = []byte("diz small buf")
-	b.Move(buf)
-	if !bytes.Equal(buf, make([]byte, len(buf))) {
-		t.Error("expected buf to be nil")
+	// Writing it back should pad it with zeroes.
+	x.Add(x, big.NewInt(1))
+	if err := PutBigInt(b, x); err != nil {
+		t.Error("unexpected error:", err)
 	}
-	if !bytes.Equal(b.Buffer()[:len(buf)], []byte("diz small buf")) {
-		t.Error("bytes weren't copied properly")
+	if !bytes.Equal(b.Buffer(), []byte{0, 0, 1, 2, 3, 5}) {
+		t.Error("unexpected value;", b.Buffer())
 	}
-	if !bytes.Equal(b.Buffer()[len(buf):], make([]byte, 16-len(buf))) {
-		t.Error("bytes were't copied properly;", b.Buffer()[len(buf):])
+	if err := PutBigInt(b, big.NewInt(0)); err != nil || !bytes.Equal(b.Buffer(), make([]byte, 6)) {
+		t.Error("unexpected value;", b.Buffer(), err)
 	}
-	b.Destroy()
 
-	// When buf is equal in size to LockedBuffer.
-	b, _ = NewMutable(16)
-	buf = []byte("yellow submarine")
-	b.Move(buf)
-	if !bytes.Equal(buf, make([]byte, len(buf))) {
-		t.Error("expected buf to be nil")
+	// Values that don't fit.
+	if err := PutBigInt(b, new(big.Int).Lsh(big.NewInt(1), 48)); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange; got", err)
 	}
-	if !bytes.Equal(b.Buffer(), []byte("yellow submarine")) {
-		t.Error("bytes were't copied properly")
+	if err := PutBigInt(b, big.NewInt(-1)); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange; got", err)
 	}
 
 	b.MakeImmutable()
-
-	err := b.Move([]byte("test"))
-	if err != ErrImmutable {
-		t.Error("expected ErrImmutable")
+	if err := PutBigInt(b, x); err != ErrImmutable {
+		t.Error("expected ErrImmutable; got", err)
 	}
 
 	b.Destroy()
-
-	if err := b.Move([]byte("test")); err != ErrDestroyed {
-		t.Error("expected ErrDestroyed")
+	if _, err := b.BigInt(); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+	if err := PutBigInt(b, x); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
 	}
 }
 
-func TestFillRandomBytes(t *testing.T) {
-	a, _ := NewMutable(32)
-	a.FillRandomBytes()
+func TestGetMetadata(t *testing.T) {
+	b, _ := NewMutable(8)
 
-	if bytes.Equal(a.Buffer(), make([]byte, 32)) {
-		t.Error("not random")
+	if b.IsMutable() != true {
+		t.Error("incorrect value")
+	}
+	if b.IsDestroyed() != false {
+		t.Error("incorrect value")
 	}
 
-	a.Wipe()
-	a.FillRandomBytesAt(16, 16)
+	b.MakeImmutable()
+	if b.IsMutable() != false {
+		t.Error("incorrect value")
+	}
 
-	if !bytes.Equal(a.Buffer()[:16], make([]byte, 16)) || bytes.Equal(a.Buffer()[16:], make([]byte, 16)) {
-		t.Error("incorrect offset/size;", a.Buffer()[:16], a.Buffer()[16:])
+	b.Destroy()
+	if b.IsDestroyed() != true {
+		t.Error("incorrect value")
 	}
+}
 
-	a.MakeImmutable()
-	if err := a.FillRandomBytes(); err != ErrImmutable {
-		t.Error("expected ErrImmutable")
+func TestAssertAlive(t *testing.T) {
+	b, _ := NewMutable(8)
+	if err := AssertAlive(b); err != nil {
+		t.Error("unexpected error:", err)
 	}
 
-	a.Destroy()
-	if err := a.FillRandomBytes(); err != ErrDestroyed {
-		t.Error("expected ErrDestroyed")
+	b.Destroy()
+	for _, x := range []*LockedBuffer{b, nil, {}} {
+		if err := AssertAlive(x); err != ErrDestroyed {
+			t.Error("expected ErrDestroyed; got", err)
+		}
 	}
 }
 
-func TestDestroyAll(t *testing.T) {
-	b, _ := NewMutable(16)
-	c, _ := NewMutable(16)
-
-	b.Copy([]byte("yellow submarine"))
-	c.Copy([]byte("yellow submarine"))
+func TestString(t *testing.T) {
+	b, _ := NewMutableFromBytes([]byte("yellow submarine"))
 
-	DestroyAll()
+	for _, format := range []string{"%v", "%s", "%#v", "%+v", "%x", "%q"} {
+		out := fmt.Sprintf(format, b)
+		if strings.Contains(out, "yellow") || strings.Contains(out, fmt.Sprintf("%x", "yellow")) {
+			t.Error("contents leaked with", format, "as", out)
+		}
+	}
 
-	if b.Buffer() != nil || c.Buffer() != nil {
-		t.Error("expected buffers to be nil")
+	if b.String() != "<memguard::LockedBuffer redacted (16 bytes, mutable=true)>" {
+		t.Error("unexpected value;", b.String())
+	}
+	if fmt.Sprintf("%#v", b) != b.String() {
+		t.Error("unexpected value;", fmt.Sprintf("%#v", b))
 	}
 
-	if b.IsMutable() || c.IsMutable() {
-		t.Error("expected permissions to be immutable")
+	b.MakeImmutable()
+	if b.String() != "<memguard::LockedBuffer redacted (16 bytes, mutable=false)>" {
+		t.Error("unexpected value;", b.String())
 	}
 
-	if !b.IsDestroyed() || !c.IsDestroyed() {
-		t.Error("expected it to be destroyed")
+	b.Destroy()
+	if b.String() != "<memguard::LockedBuffer destroyed>" {
+		t.Error("unexpected value;", b.String())
 	}
 }
 
-func TestSize(t *testing.T) {
-	b, _ := NewMutable(16)
+func TestForEach(t *testing.T) {
+	n := ActiveBuffers()
 
-	if b.Size() != 16 {
-		t.Error("unexpected size")
+	a, _ := NewMutable(8)
+	b, _ := NewImmutable(8)
+	c, _ := NewMutable(8)
+	if ActiveBuffers() != n+3 {
+		t.Error("unexpected count;", ActiveBuffers())
+	}
+
+	// Every buffer should be visited.
+	seen := map[*container]bool{}
+	ForEach(func(x *LockedBuffer) bool {
+		seen[x.container] = true
+		return true
+	})
+	if len(seen) != n+3 || !seen[a.container] || !seen[b.container] || !seen[c.container] {
+		t.Error("not all buffers visited;", len(seen))
+	}
+
+	// Stopping early.
+	var calls int
+	ForEach(func(*LockedBuffer) bool {
+		calls++
+		return false
+	})
+	if calls != 1 {
+		t.Error("unexpected number of calls;", calls)
+	}
+
+	// Destroying from inside the callback.
+	ForEach(func(x *LockedBuffer) bool {
+		if x.container == b.container {
+			x.Destroy()
+		}
+		return true
+	})
+	if !b.IsDestroyed() || ActiveBuffers() != n+2 {
+		t.Error("unexpected state;", ActiveBuffers())
+	}
+
+	a.Destroy()
+	c.Destroy()
+	if ActiveBuffers() != n {
+		t.Error("unexpected count;", ActiveBuffers())
+	}
+}
+
+func TestLeakCheck(t *testing.T) {
+	existing, _ := NewMutable(8)
+
+	var kept *LockedBuffer
+	leaked := LeakCheck(func() {
+		// Created and destroyed.
+		a, _ := NewMutable(8)
+		a.Destroy()
+
+		// Existing ones being destroyed don't matter either.
+		existing.Destroy()
+
+		// But this one is left behind.
+		kept, _ = NewMutableFromBytes([]byte("yellow submarine"))
+	})
+	if len(leaked) != 1 || leaked[0].container != kept.container {
+		t.Error("unexpected leaks;", leaked)
+	}
+
+	kept.Destroy()
+	if leaked := LeakCheck(func() {}); len(leaked) != 0 {
+		t.Error("unexpected leaks;", leaked)
+	}
+}
+
+func TestSetTTL(t *testing.T) {
+	// Waits up to a second for a buffer to be destroyed.
+	destroyed := func(b *LockedBuffer) bool {
+		for i := 0; i < 100; i++ {
+			if b.IsDestroyed() {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	// Expiring.
+	a, _ := NewMutable(8)
+	if err := a.SetTTL(10 * time.Millisecond); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if !destroyed(a) {
+		t.Error("expected buffer to be destroyed")
+	}
+	if err := a.SetTTL(time.Second); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+
+	// Extending.
+	b, _ := NewMutable(8)
+	b.SetTTL(50 * time.Millisecond)
+	b.SetTTL(time.Hour)
+	time.Sleep(100 * time.Millisecond)
+	if b.IsDestroyed() {
+		t.Error("expected buffer to still be alive")
 	}
 
+	// Destroying early should stop the timer.
+	timer := b.ttl
 	b.Destroy()
+	if b.ttl != nil || timer.Stop() {
+		t.Error("expected timer to be stopped")
+	}
 
-	if b.Size() != 0 {
-		t.Error("unexpected size")
+	// Cancelling.
+	c, _ := NewMutable(8)
+	c.SetTTL(10 * time.Millisecond)
+	c.SetTTL(0)
+	time.Sleep(50 * time.Millisecond)
+	if c.IsDestroyed() || c.ttl != nil {
+		t.Error("expected timer to be cancelled")
 	}
+	c.Destroy()
 }
 
-func TestWipe(t *testing.T) {
+func TestLabel(t *testing.T) {
+	a, _ := NewMutableFromBytes([]byte("yellow submarine"))
+	b, _ := NewImmutable(8)
+	c, _ := NewMutable(8)
+
+	if a.Label() != "" {
+		t.Error("unexpected label;", a.Label())
+	}
+
+	a.SetLabel("tls-key")
+	b.SetLabel("tls-key")
+	c.SetLabel("db-password")
+
+	if a.Label() != "tls-key" {
+		t.Error("unexpected label;", a.Label())
+	}
+	if a.String() != `<memguard::LockedBuffer "tls-key" redacted (16 bytes, mutable=true)>` {
+		t.Error("unexpected value;", a.String())
+	}
+
+	found := FindByLabel("tls-key")
+	if len(found) != 2 {
+		t.Error("unexpected number of results;", len(found))
+	}
+	for _, f := range found {
+		if f.container != a.container && f.container != b.container {
+			t.Error("unexpected result;", f)
+		}
+	}
+	if len(FindByLabel("nothing")) != 0 {
+		t.Error("unexpected results")
+	}
+
+	a.Destroy()
+	if a.String() != `<memguard::LockedBuffer "tls-key" destroyed>` {
+		t.Error("unexpected value;", a.String())
+	}
+
+	found = FindByLabel("tls-key")
+	if len(found) != 1 || found[0].container != b.container {
+		t.Error("unexpected results;", found)
+	}
+
+	b.Destroy()
+	c.Destroy()
+}
+
+func TestJSON(t *testing.T) {
 	b, _ := NewMutableFromBytes([]byte("yellow submarine"))
+	defer b.Destroy()
 
-	if err := b.Wipe(); err != nil {
-		t.Error("failed to wipe:", err)
+	out, err := json.Marshal(struct {
+		Key *LockedBuffer
+	}{b})
+	if !errors.Is(err, ErrCannotMarshal) {
+		t.Error("expected ErrCannotMarshal; got", err)
+	}
+	if out != nil {
+		t.Error("unexpected output;", string(out))
 	}
 
-	if !bytes.Equal(b.Buffer(), make([]byte, 16)) {
-		t.Error("bytes not wiped; b =", b.Buffer())
+	var v struct {
+		Key *LockedBuffer
+	}
+	if err := json.Unmarshal([]byte(`{"Key":"c2VjcmV0"}`), &v); !errors.Is(err, ErrCannotMarshal) {
+		t.Error("expected ErrCannotMarshal; got", err)
+	}
+}
+
+func TestEqualTo(t *testing.T) {
+	a, _ := NewImmutableFromBytes([]byte("test"))
+
+	equal, err := a.EqualBytes([]byte("test"))
+	if err != nil {
+		t.Error("unexpected error")
+	}
+
+	if !equal {
+		t.Error("should be equal")
+	}
+
+	equal, err = a.EqualBytes([]byte("toast"))
+	if err != nil {
+		t.Error("unexpected error")
+	}
+
+	if equal {
+		t.Error("should not be equal")
+	}
+
+	// Prefixes, repetitions, and empty slices shouldn't match either.
+	for _, buf := range [][]byte{[]byte("tes"), []byte("testtest"), []byte("testt"), {}, nil} {
+		if equal, err := a.EqualBytes(buf); equal || err != nil {
+			t.Error("unexpected return values for", buf, equal, err)
+		}
+	}
+
+	a.Destroy()
+
+	if equal, err := a.EqualBytes([]byte("test")); equal || err != ErrDestroyed {
+		t.Error("unexpected return values with destroyed LockedBuffer")
+	}
+}
+
+func TestReadAll(t *testing.T) {
+	b, _ := NewImmutableFromBytes([]byte("yellow submarine"))
+
+	// Lots of readers at once should be able to share it.
+	var wg sync.WaitGroup
+	inside := make(chan struct{})
+	release := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := b.ReadAll(func(buf []byte) error {
+				if !bytes.Equal(buf, []byte("yellow submarine")) {
+					t.Error("unexpected contents;", buf)
+				}
+				inside <- struct{}{}
+				<-release
+				return nil
+			})
+			if err != nil {
+				t.Error("unexpected error:", err)
+			}
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		<-inside
+	}
+
+	// Destroying it has to wait for them all to finish.
+	destroyed := make(chan struct{})
+	go func() {
+		b.Destroy()
+		close(destroyed)
+	}()
+	select {
+	case <-destroyed:
+		t.Error("destroyed while being read")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	wg.Wait()
+	<-destroyed
+
+	// Errors are passed through, and destroyed buffers aren't read.
+	c, _ := NewMutable(8)
+	e := errors.New("some error")
+	if err := c.ReadAll(func([]byte) error { return e }); err != e {
+		t.Error("unexpected error:", err)
+	}
+	c.Destroy()
+	if err := c.ReadAll(func([]byte) error {
+		t.Error("function called")
+		return nil
+	}); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	a, _ := NewImmutableFromBytes([]byte("yellow submarine"))
+	b, _ := NewMutableFromBytes([]byte("yellow submarine"))
+	c, _ := NewMutableFromBytes([]byte("yellow submarinf"))
+
+	fa, err := a.Fingerprint()
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	fb, _ := b.Fingerprint()
+	fc, _ := c.Fingerprint()
+	if len(fa) != sha256.Size {
+		t.Error("unexpected length;", len(fa))
+	}
+	if !bytes.Equal(fa, fb) {
+		t.Error("expected equal fingerprints")
+	}
+	if bytes.Equal(fa, fc) {
+		t.Error("expected different fingerprints")
+	}
+
+	// It should be keyed, rather than a plain hash.
+	plain := sha256.Sum256([]byte("yellow submarine"))
+	if bytes.Equal(fa, plain[:]) {
+		t.Error("fingerprint is not keyed")
+	}
+
+	a.Destroy()
+	b.Destroy()
+	c.Destroy()
+	if _, err := a.Fingerprint(); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	b, _ := NewMutable(8)
+
+	if err := b.MakeImmutable(); err != nil {
+		t.Error("unexpected error")
+	}
+	if b.IsMutable() {
+		t.Error("unexpected state")
+	}
+	if err := b.MakeMutable(); err != nil {
+		t.Error("unexpected error")
+	}
+	if !b.IsMutable() {
+		t.Error("unexpected state")
+	}
+
+	b.Destroy()
+
+	if err := b.MakeImmutable(); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+
+	if err := b.MakeMutable(); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+}
+
+func TestMove(t *testing.T) {
+	// When buf is larger than LockedBuffer.
+	b, _ := NewMutable(16)
+	buf := []byte("this is a very large buffer")
+	b.Move(buf)
+	if !bytes.Equal(buf, make([]byte, len(buf))) {
+		t.Error("expected buf to be nil")
+	}
+	if !bytes.Equal(b.Buffer(), []byte("this is a very l")) {
+		t.Error("bytes were't copied properly")
+	}
+	b.Destroy()
+
+	// When buf is smaller than LockedBuffer.
+	b, _ = NewMutable(16)
+	buf = []byte("diz small buf")
+	b.Move(buf)
+	if !bytes.Equal(buf, make([]byte, len(buf))) {
+		t.Error("expected buf to be nil")
+	}
+	if !bytes.Equal(b.Buffer()[:len(buf)], []byte("diz small buf")) {
+		t.Error("bytes weren't copied properly")
+	}
+	if !bytes.Equal(b.Buffer()[len(buf):], make([]byte, 16-len(buf))) {
+		t.Error("bytes were't copied properly;", b.Buffer()[len(buf):])
+	}
+	b.Destroy()
+
+	// When buf is equal in size to LockedBuffer.
+	b, _ = NewMutable(16)
+	buf = []byte("yellow submarine")
+	b.Move(buf)
+	if !bytes.Equal(buf, make([]byte, len(buf))) {
+		t.Error("expected buf to be nil")
+	}
+	if !bytes.Equal(b.Buffer(), []byte("yellow submarine")) {
+		t.Error("bytes were't copied properly")
 	}
 
-	b.FillRandomBytes()
 	b.MakeImmutable()
 
-	if err := b.Wipe(); err != ErrImmutable {
+	err := b.Move([]byte("test"))
+	if err != ErrImmutable {
 		t.Error("expected ErrImmutable")
 	}
 
-	if bytes.Equal(b.Buffer(), make([]byte, 16)) {
-		t.Error("bytes wiped")
+	b.Destroy()
+
+	if err := b.Move([]byte("test")); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+}
+
+func TestMoveTo(t *testing.T) {
+	a, _ := NewMutableFromBytes([]byte("yellow submarine"))
+	b, _ := NewMutable(8)
+
+	if err := a.MoveTo(b); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if !bytes.Equal(b.Buffer(), []byte("yellow s")) {
+		t.Error("bytes weren't moved properly;", b.Buffer())
+	}
+	if !bytes.Equal(a.Buffer(), make([]byte, 16)) {
+		t.Error("source not wiped;", a.Buffer())
+	}
+
+	c, _ := NewMutable(32)
+	if err := b.MoveTo(c); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if !bytes.Equal(c.Buffer()[:8], []byte("yellow s")) || !bytes.Equal(c.Buffer()[8:], make([]byte, 24)) {
+		t.Error("bytes weren't moved properly;", c.Buffer())
+	}
+
+	if err := c.MoveTo(c); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if !bytes.Equal(c.Buffer()[:8], []byte("yellow s")) {
+		t.Error("moving into itself modified contents;", c.Buffer())
+	}
+
+	c.MakeImmutable()
+	if err := a.MoveTo(c); err != ErrImmutable {
+		t.Error("expected ErrImmutable")
+	}
+	if err := c.MoveTo(a); err != ErrImmutable {
+		t.Error("expected ErrImmutable")
+	}
+
+	a.Destroy()
+	if err := a.MoveTo(b); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+	if err := b.MoveTo(a); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
 	}
 
-	b.MakeMutable()
-	b.FillRandomBytes()
 	b.Destroy()
+	c.Destroy()
+}
+
+func TestFillRandomBytes(t *testing.T) {
+	a, _ := NewMutable(32)
+	a.FillRandomBytes()
+
+	if bytes.Equal(a.Buffer(), make([]byte, 32)) {
+		t.Error("not random")
+	}
+
+	a.Wipe()
+	a.FillRandomBytesAt(16, 16)
+
+	if !bytes.Equal(a.Buffer()[:16], make([]byte, 16)) || bytes.Equal(a.Buffer()[16:], make([]byte, 16)) {
+		t.Error("incorrect offset/size;", a.Buffer()[:16], a.Buffer()[16:])
+	}
+
+	a.MakeImmutable()
+	if err := a.FillRandomBytes(); err != ErrImmutable {
+		t.Error("expected ErrImmutable")
+	}
+
+	a.Destroy()
+	if err := a.FillRandomBytes(); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+}
+
+func TestCanarySettings(t *testing.T) {
+	defer SetCanarySize(0)
+	defer SetCanaryPattern(nil)
+
+	a, _ := NewMutable(8)
+	SetCanarySize(100)
+	b, _ := NewMutable(8)
+	if a.canaryLen != 32 || b.canaryLen != 100 {
+		t.Error("unexpected canary lengths;", a.canaryLen, b.canaryLen)
+	}
+
+	// The whole canary should be checked.
+	c := getBytes(uintptr(unsafe.Pointer(&b.buffer[0]))-100, 100)
+	if !bytes.Equal(c[:32], canary) || !bytes.Equal(c[96:], canary[:4]) {
+		t.Error("unexpected canary value")
+	}
+	c[0] ^= 0xff
+	if err := b.Verify(); err != ErrCanaryViolation {
+		t.Error("expected ErrCanaryViolation")
+	}
+	c[0] ^= 0xff
+	if err := b.Verify(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	// A fixed pattern.
+	SetCanaryPattern([]byte("poison"))
+	SetCanarySize(16)
+	d, _ := NewImmutable(8)
+	if c := getBytes(uintptr(unsafe.Pointer(&d.buffer[0]))-16, 16); string(c) != "poisonpoisonpois" {
+		t.Error("unexpected canary value;", string(c))
+	}
+	if err := d.Verify(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	// Existing buffers should be unaffected by the changes.
+	for _, x := range []*LockedBuffer{a, b, d} {
+		if err := x.Verify(); err != nil {
+			t.Error("unexpected error:", err)
+		}
+		x.Destroy()
+	}
+}
+
+func TestCopyOut(t *testing.T) {
+	b, _ := NewImmutableFromBytes([]byte("yellow submarine"))
+	count := ExposureCount()
+
+	dst := make([]byte, 6)
+	if n, err := b.CopyOut(dst); n != 6 || err != nil || string(dst) != "yellow" {
+		t.Error("unexpected return values;", n, err, dst)
+	}
+	dst = make([]byte, 32)
+	if n, err := b.CopyOut(dst); n != 16 || err != nil || string(dst[:16]) != "yellow submarine" {
+		t.Error("unexpected return values;", n, err, dst)
+	}
+	if ExposureCount() != count+2 {
+		t.Error("unexpected exposure count;", ExposureCount())
+	}
+
+	b.Destroy()
+	if _, err := b.CopyOut(dst); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+	if ExposureCount() != count+2 {
+		t.Error("failed calls should not be counted")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	b, _ := NewMutable(8)
+
+	if err := b.Verify(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	// Simulate an underflow into the canary.
+	c := getBytes(uintptr(unsafe.Pointer(&b.Buffer()[0]))-1, 1)
+	c[0] ^= 0xff
+
+	if err := b.Verify(); err != ErrCanaryViolation {
+		t.Error("expected ErrCanaryViolation")
+	}
+
+	// Repair it so that the buffer can be destroyed.
+	c[0] ^= 0xff
+	if err := b.Verify(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	b.MakeImmutable()
+	if err := b.Verify(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	b.Destroy()
+	if err := b.Verify(); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+}
+
+// failingFreeAllocator wraps the default Allocator, reporting an error after freeing memory.
+type failingFreeAllocator struct {
+	memcallAllocator
+}
+
+func (a failingFreeAllocator) Free(b []byte) error {
+	a.memcallAllocator.Free(b)
+	return errors.New("could not free")
+}
+
+func TestTryDestroy(t *testing.T) {
+	b, _ := NewMutableFromBytes([]byte("yellow submarine"))
+	if err := b.TryDestroy(); err != nil || !b.IsDestroyed() {
+		t.Error("unexpected result;", err)
+	}
+	if err := b.TryDestroy(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	// An overwritten canary should be reported rather than panicking, and the memory released anyway.
+	c, _ := NewMutableFromBytes([]byte("yellow submarine"))
+	getBytes(uintptr(unsafe.Pointer(&c.buffer[0]))-1, 1)[0] ^= 0xff
+	before := ActiveBuffers()
+	if err := c.TryDestroy(); err != ErrCanaryViolation || !c.IsDestroyed() || ActiveBuffers() != before-1 {
+		t.Error("unexpected result;", err)
+	}
+
+	// So should failing system calls.
+	SetAllocator(failingFreeAllocator{})
+	d, _ := NewImmutableRandom(32)
+	SetAllocator(nil)
+	if err := d.TryDestroy(); err == nil || err.Error() != "could not free" || !d.IsDestroyed() {
+		t.Error("unexpected result;", err)
+	}
+}
+
+// Count the regions of memory that are in quarantine.
+func quarantinedRegions() int {
+	quarantinedMutex.Lock()
+	defer quarantinedMutex.Unlock()
+
+	return len(quarantined)
+}
+
+func TestSetQuarantine(t *testing.T) {
+	a := &MockAllocator{}
+	SetAllocator(a)
+	defer SetAllocator(nil)
+	defer SetQuarantine(false, 0)
+
+	// Without quarantine, memory should be freed straight away.
+	b, _ := NewImmutableFromBytes([]byte("yellow submarine"))
+	b.Destroy()
+	if quarantinedRegions() != 0 {
+		t.Error("memory was quarantined")
+	}
+
+	// With it, the whole region should be made inaccessible and held onto.
+	SetQuarantine(true, time.Hour)
+	c, _ := NewImmutableFromBytes([]byte("yellow submarine"))
+	memory := c.memory
+	c.Destroy()
+	p := a.RecordedProtections()
+	if last := p[len(p)-1]; &last.Region[0] != &memory[0] || len(last.Region) != len(memory) || last.Read || last.Write {
+		t.Error("memory was not made inaccessible;", last)
+	}
+	if quarantinedRegions() != 1 {
+		t.Error("memory was not quarantined")
+	}
+
+	// Disabling quarantine should free it straight away.
+	SetQuarantine(false, time.Hour)
+	if quarantinedRegions() != 0 {
+		t.Error("quarantine was not emptied")
+	}
+
+	// Memory should be freed once the quarantine period is over.
+	SetQuarantine(true, time.Millisecond)
+	d, _ := NewImmutableFromBytes([]byte("yellow submarine"))
+	d.Destroy()
+	for i := 0; quarantinedRegions() != 0; i++ {
+		if i == 1000 {
+			t.Fatal("memory was not freed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Slabs should carry on as usual.
+	EnableSlabAllocator(64)
+	defer EnableSlabAllocator(0)
+	e, _ := NewMutable(16)
+	e.Destroy()
+	if quarantinedRegions() != 0 {
+		t.Error("slab memory was quarantined")
+	}
+}
+
+// recordingWipe is a WipeStrategy that remembers what it was asked to wipe, and fills it with a marker.
+type recordingWipe struct {
+	wiped [][]byte
+}
+
+func (r *recordingWipe) Wipe(b []byte) {
+	r.wiped = append(r.wiped, append([]byte{}, b...))
+	for i := range b {
+		b[i] = 0xaa
+	}
+}
+
+func TestSetWipeStrategy(t *testing.T) {
+	r := &recordingWipe{}
+	SetWipeStrategy(r)
+	defer SetWipeStrategy(nil)
+
+	// Sub-region wipes should use it, and still finish with zeroes.
+	b, _ := NewMutableFromBytes([]byte("yellow submarine"))
+	if err := b.WipeAt(7, 3); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if len(r.wiped) != 1 || string(r.wiped[0]) != "sub" || string(b.Buffer()) != "yellow \x00\x00\x00marine" {
+		t.Error("unexpected result;", r.wiped, b.Buffer())
+	}
+
+	// So should destroying.
+	b.Destroy()
+	if len(r.wiped) != 2 || !bytes.Contains(r.wiped[1], []byte("yellow \x00\x00\x00marine")) {
+		t.Error("unexpected result;", r.wiped)
+	}
+
+	// Patterns should be repeated to fill the memory.
+	buf := make([]byte, 7)
+	MultiPassWipe([][]byte{{1, 2, 3}}).Wipe(buf)
+	if !bytes.Equal(buf, []byte{1, 2, 3, 1, 2, 3, 1}) {
+		t.Error("unexpected result;", buf)
+	}
+	pattern := []byte{0xff}
+	m := MultiPassWipe([][]byte{{}, pattern})
+	pattern[0] = 0
+	m.Wipe(buf)
+	if !bytes.Equal(buf, bytes.Repeat([]byte{0xff}, 7)) {
+		t.Error("unexpected result;", buf)
+	}
+
+	// Random passes should change the contents.
+	buf = make([]byte, 32)
+	RandomWipe.Wipe(buf)
+	MultiPassWipe([][]byte{{0}, nil}).Wipe(buf[16:])
+	if bytes.Equal(buf[:16], make([]byte, 16)) || bytes.Equal(buf[16:], make([]byte, 16)) {
+		t.Error("expected random bytes;", buf)
+	}
+	ZeroWipe.Wipe(buf)
+}
+
+func TestSetMemoryLimit(t *testing.T) {
+	// Leave room for two pages on top of whatever is already locked.
+	memoryLimitMutex.Lock()
+	base := memoryLocked
+	memoryLimitMutex.Unlock()
+	SetMemoryLimit(base + 2*pageSize)
+	defer SetMemoryLimit(0)
+
+	a, err := NewMutable(8)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	b, err := NewImmutableRandom(8)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := NewMutable(8); err != ErrMemoryLimitExceeded {
+		t.Error("expected ErrMemoryLimitExceeded; got", err)
+	}
+	if _, err := NewMutableBatch(8, 1); err != ErrMemoryLimitExceeded {
+		t.Error("expected ErrMemoryLimitExceeded; got", err)
+	}
+
+	// Destroying one should make room again.
+	a.Destroy()
+	c, err := NewMutable(8)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	// Suspending gives memory back, and resuming takes it again.
+	c.Suspend()
+	d, err := NewMutable(8)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if err := c.Resume(); err != ErrMemoryLimitExceeded {
+		t.Error("expected ErrMemoryLimitExceeded; got", err)
+	}
+	d.Destroy()
+	if err := c.Resume(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	b.Destroy()
+	c.Destroy()
+	memoryLimitMutex.Lock()
+	if memoryLocked != base {
+		t.Error("unexpected locked memory;", memoryLocked, base)
+	}
+	memoryLimitMutex.Unlock()
+}
+
+func TestMakeImmutableAll(t *testing.T) {
+	a, _ := NewMutable(8)
+	b, _ := NewMutableRandom(8)
+	b.Hide()
+	c, _ := NewImmutable(8)
+
+	if errs := MakeImmutableAll(); len(errs) != 0 {
+		t.Error("unexpected errors;", errs)
+	}
+	if a.IsMutable() || b.IsMutable() || c.IsMutable() {
+		t.Error("expected everything to be immutable")
+	}
+	b.Reveal()
+
+	// Read-only mappings can't be made mutable.
+	region, _ := memcall.Alloc(pageSize)
+	d, _ := NewFromMmap(region, false)
+	errs := MakeMutableAll()
+	if len(errs) != 1 || errs[0] != ErrUnsupported {
+		t.Error("unexpected errors;", errs)
+	}
+	if !a.IsMutable() || !b.IsMutable() || !c.IsMutable() || d.IsMutable() {
+		t.Error("expected everything else to be mutable")
+	}
+	b.Buffer()[0] = 1
+
+	a.Destroy()
+	b.Destroy()
+	c.Destroy()
+	d.Destroy()
+	memcall.Free(region)
+
+	// Destroyed ones should be skipped.
+	if errs := MakeImmutableAll(); len(errs) != 0 {
+		t.Error("unexpected errors;", errs)
+	}
+	MakeMutableAll()
+}
+
+func TestDestroyAll(t *testing.T) {
+	b, _ := NewMutable(16)
+	c, _ := NewMutable(16)
+
+	b.Copy([]byte("yellow submarine"))
+	c.Copy([]byte("yellow submarine"))
+
+	DestroyAll()
+
+	if b.Buffer() != nil || c.Buffer() != nil {
+		t.Error("expected buffers to be nil")
+	}
+
+	if b.IsMutable() || c.IsMutable() {
+		t.Error("expected permissions to be immutable")
+	}
+
+	if !b.IsDestroyed() || !c.IsDestroyed() {
+		t.Error("expected it to be destroyed")
+	}
+
+	// Calling it again should be harmless.
+	DestroyAll()
+
+	allLockedBuffersMutex.Lock()
+	if len(allLockedBuffers) != 0 {
+		t.Error("expected no active buffers; got", len(allLockedBuffers))
+	}
+	allLockedBuffersMutex.Unlock()
+}
+
+func TestSize(t *testing.T) {
+	b, _ := NewMutable(16)
+
+	if b.Size() != 16 {
+		t.Error("unexpected size")
+	}
+
+	b.Destroy()
+
+	if b.Size() != 0 {
+		t.Error("unexpected size")
+	}
+}
+
+func TestPageSize(t *testing.T) {
+	if PageSize() != os.Getpagesize() {
+		t.Error("unexpected page size;", PageSize())
+	}
+
+	for n, expected := range map[int]int{0: 0, 1: PageSize(), PageSize(): PageSize(), PageSize() + 1: 2 * PageSize()} {
+		if RoundToPageSize(n) != expected {
+			t.Error("unexpected rounding;", n, RoundToPageSize(n))
+		}
+	}
+}
+
+func TestLockedMemory(t *testing.T) {
+	before := LockedMemory()
+
+	a, _ := NewMutable(16)
+	b, _ := NewImmutable(pageSize)
+
+	if LockedMemory()-before != pageSize+2*pageSize {
+		t.Error("unexpected value;", LockedMemory()-before)
+	}
+
+	a.Destroy()
+	if LockedMemory()-before != 2*pageSize {
+		t.Error("unexpected value;", LockedMemory()-before)
+	}
+
+	// It should be safe to call while LockedBuffers are being suspended and resumed.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			b.Suspend()
+			b.Resume()
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		LockedMemory()
+	}
+	<-done
+
+	b.Destroy()
+	if LockedMemory() != before {
+		t.Error("unexpected value;", LockedMemory())
+	}
+}
+
+func TestLockRetryPolicy(t *testing.T) {
+	defer SetLockRetryPolicy(0, 0)
+
+	SetLockRetryPolicy(-1, time.Millisecond)
+	if lockRetryAttempts != 0 {
+		t.Error("unexpected attempts;", lockRetryAttempts)
+	}
+
+	// Buffers should be created as usual.
+	SetLockRetryPolicy(3, time.Millisecond)
+	b, err := NewMutable(16)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	b.Destroy()
+
+	// Only running out of room is worth retrying.
+	for err, expected := range map[error]bool{
+		fmt.Errorf("wrapped [Err: %w]", syscall.EAGAIN): true,
+		fmt.Errorf("wrapped [Err: %w]", syscall.ENOMEM): true,
+		fmt.Errorf("wrapped [Err: %w]", syscall.EPERM):  false,
+		errors.New("something else"):                   false,
+	} {
+		if isTransientLockError(err) != expected {
+			t.Error("unexpected result for", err)
+		}
+	}
+}
+
+func TestLockPolicy(t *testing.T) {
+	defer SetLockPolicy(LockRequired)
+
+	a, _ := NewMutable(16)
+	if !a.IsLocked() {
+		t.Error("expected buffer to be locked")
+	}
+
+	// With locking disabled, buffers still work but aren't locked or counted.
+	SetLockPolicy(LockDisabled)
+	before := LockedMemory()
+	b, err := NewImmutableFromBytes([]byte("yellow submarine"))
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if b.IsLocked() {
+		t.Error("expected buffer to not be locked")
+	}
+	if !bytes.Equal(b.Buffer(), []byte("yellow submarine")) {
+		t.Error("unexpected contents;", b.Buffer())
+	}
+	if LockedMemory() != before {
+		t.Error("unlocked memory was counted;", LockedMemory()-before)
+	}
+
+	// Best effort should manage to lock it here.
+	SetLockPolicy(LockBestEffort)
+	c, _ := NewMutable(16)
+	if !c.IsLocked() {
+		t.Error("expected buffer to be locked")
+	}
+
+	// Existing buffers aren't affected.
+	if !a.IsLocked() || b.IsLocked() {
+		t.Error("existing buffers changed")
+	}
+
+	a.Destroy()
+	b.Destroy()
+	c.Destroy()
+	if a.IsLocked() || c.IsLocked() {
+		t.Error("destroyed buffer reported as locked")
+	}
+}
+
+func TestWipeVerification(t *testing.T) {
+	SetWipeVerification(true)
+	defer SetWipeVerification(false)
+
+	// Normal destruction should pass the check.
+	b, _ := NewMutableRandom(32)
+	b.Destroy()
+	EnableSlabAllocator(32)
+	b, _ = NewMutableRandom(32)
+	b.Destroy()
+	EnableSlabAllocator(0)
+
+	// Memory that isn't zero should cause a panic.
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic")
+		}
+	}()
+	verifyWiped([]byte{0, 0, 1, 0})
+}
+
+func TestWipe(t *testing.T) {
+	b, _ := NewMutableFromBytes([]byte("yellow submarine"))
+
+	if err := b.Wipe(); err != nil {
+		t.Error("failed to wipe:", err)
+	}
+
+	if !bytes.Equal(b.Buffer(), make([]byte, 16)) {
+		t.Error("bytes not wiped; b =", b.Buffer())
+	}
+
+	b.FillRandomBytes()
+	b.MakeImmutable()
+
+	if err := b.Wipe(); err != ErrImmutable {
+		t.Error("expected ErrImmutable")
+	}
+
+	if bytes.Equal(b.Buffer(), make([]byte, 16)) {
+		t.Error("bytes wiped")
+	}
+
+	b.MakeMutable()
+	b.FillRandomBytes()
+	b.Destroy()
+
+	if err := b.Wipe(); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+}
+
+func TestWipeAt(t *testing.T) {
+	b, _ := NewMutableFromBytes([]byte("yellow submarine"))
+
+	if err := b.WipeAt(0, 7); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if !bytes.Equal(b.Buffer(), append(make([]byte, 7), []byte("submarine")...)) {
+		t.Error("unexpected value;", b.Buffer())
+	}
+
+	if err := b.WipeAt(10, 7); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange")
+	}
+	if err := b.WipeAt(-1, 4); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange")
+	}
+	if err := b.WipeAt(4, -1); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange")
+	}
+	if err := b.WipeAt(4, maxInt); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange")
+	}
+	if err := b.WipeAt(maxInt, 1); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange")
+	}
+	if !bytes.Equal(b.Buffer()[7:], []byte("submarine")) {
+		t.Error("bytes wiped on failure")
+	}
+
+	b.MakeImmutable()
+	if err := b.WipeAt(0, 4); err != ErrImmutable {
+		t.Error("expected ErrImmutable")
+	}
+
+	b.Destroy()
+	if err := b.WipeAt(0, 4); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+}
+
+func TestConcatenate(t *testing.T) {
+	a, _ := NewImmutableFromBytes([]byte("xxxx"))
+	b, _ := NewMutableFromBytes([]byte("yyyy"))
+
+	c, err := Concatenate(a, b)
+	if err != nil {
+		t.Error("unexpected error")
+	}
+
+	if !bytes.Equal(c.Buffer(), []byte("xxxxyyyy")) {
+		t.Error("unexpected output;", c.Buffer())
+	}
+	if c.IsMutable() {
+		t.Error("expected immutability")
+	}
+
+	// The originals should be left alone.
+	if !bytes.Equal(a.Buffer(), []byte("xxxx")) || !bytes.Equal(b.Buffer(), []byte("yyyy")) {
+		t.Error("originals were changed")
+	}
+
+	// An immutable result should get pages of its own, even when slabs are enabled, so that the kernel enforces it.
+	EnableSlabAllocator(64)
+	f, _ := Concatenate(a, b)
+	EnableSlabAllocator(0)
+	if f.slab != nil || f.IsMutable() || !bytes.Equal(f.Buffer(), []byte("xxxxyyyy")) {
+		t.Error("unexpected result;", f.slab != nil, f.IsMutable())
+	}
+	f.Destroy()
+
+	// More than two, including the same one twice.
+	d, _ := NewMutableFromBytes([]byte("zz"))
+	e, err := Concatenate(b, d, b)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if !bytes.Equal(e.Buffer(), []byte("yyyyzzyyyy")) || !e.IsMutable() {
+		t.Error("unexpected output;", e.Buffer())
+	}
+	e.Destroy()
+
+	// Concurrent calls with the arguments in different orders shouldn't deadlock.
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			x, _ := Concatenate(a, b, d)
+			x.Destroy()
+		}()
+		go func() {
+			defer wg.Done()
+			x, _ := Concatenate(d, b, a)
+			x.Destroy()
+		}()
+	}
+	wg.Wait()
+
+	if _, err := Concatenate(); err != ErrInvalidLength {
+		t.Error("expected ErrInvalidLength")
+	}
+
+	a.Destroy()
+	c.Destroy()
+
+	if _, err := Concatenate(a, b); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+	if _, err := Concatenate(b, d, a); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+	b.Destroy()
+	d.Destroy()
+}
+
+func TestDuplicate(t *testing.T) {
+	b, _ := NewImmutableFromBytes([]byte("test"))
+
+	c, err := Duplicate(b)
+	if err != nil {
+		t.Error("unexpected error")
+	}
+	if !bytes.Equal(b.Buffer(), c.Buffer()) {
+		t.Error("duplicated buffer has different contents")
+	}
+	if c.IsMutable() {
+		t.Error("permissions not copied")
+	}
+	b.Destroy()
+	c.Destroy()
+
+	// Mutable ones stay mutable.
+	d, _ := NewMutableFromBytes([]byte("test"))
+	e, err := Duplicate(d)
+	if err != nil || !e.IsMutable() || !bytes.Equal(e.Buffer(), []byte("test")) {
+		t.Error("unexpected result;", err)
+	}
+	d.Destroy()
+	e.Destroy()
+
+	// Allocation errors are passed on.
+	f, _ := NewImmutableFromBytes([]byte("test"))
+	SetAllocator(&countingAllocator{fail: true})
+	if _, err := Duplicate(f); err == nil {
+		t.Error("expected error")
+	}
+	SetAllocator(nil)
+	f.Destroy()
+
+	if _, err := Duplicate(b); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+}
+
+func TestDuplicateMutable(t *testing.T) {
+	b, _ := NewImmutableFromBytes([]byte("test"))
+
+	c, err := DuplicateMutable(b)
+	if err != nil || !c.IsMutable() || !bytes.Equal(c.Buffer(), []byte("test")) {
+		t.Error("unexpected result;", err)
+	}
+	if b.IsMutable() {
+		t.Error("original should be left immutable")
+	}
+
+	// The copy is independent of the original.
+	c.Copy([]byte("best"))
+	if !bytes.Equal(b.Buffer(), []byte("test")) {
+		t.Error("original changed;", b.Buffer())
+	}
+
+	// Overflowing the copy's canary is caught on the copy alone.
+	canary := getBytes(uintptr(unsafe.Pointer(&c.buffer[0]))-1, 1)
+	canary[0] ^= 0xff
+	if err := c.Verify(); err != ErrCanaryViolation {
+		t.Error("expected ErrCanaryViolation;", err)
+	}
+	if err := b.Verify(); err != nil {
+		t.Error("unexpected error;", err)
+	}
+	canary[0] ^= 0xff
+	c.Destroy()
+
+	// Other readers aren't held up.
+	b.ReadAll(func([]byte) error {
+		d, err := DuplicateMutable(b)
+		if err != nil {
+			t.Error("unexpected error;", err)
+		}
+		d.Destroy()
+		return nil
+	})
+
+	b.Hide()
+	if _, err := DuplicateMutable(b); err != ErrHidden {
+		t.Error("expected ErrHidden;", err)
+	}
+	b.Destroy()
+	if _, err := DuplicateMutable(b); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed;", err)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	b, _ := NewMutable(16)
+	c, _ := NewMutable(16)
+
+	equal, err := Equal(b, c)
+	if err != nil {
+		t.Error("unexpected error")
+	}
+	if !equal {
+		t.Error("should be equal")
+	}
+
+	a, _ := NewMutable(8)
+	equal, err = Equal(a, b)
+	if err != nil {
+		t.Error("unexpected error")
+	}
+	if equal {
+		t.Error("should not be equal")
+	}
+
+	equal, err = Equal(b, b)
+	if err != nil {
+		t.Error("unexpected error")
+	}
+	if !equal {
+		t.Error("should be equal to itself")
+	}
+
+	// Calls with the arguments swapped shouldn't deadlock, even alongside a writer.
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(3)
+		go func() { defer wg.Done(); Equal(b, c) }()
+		go func() { defer wg.Done(); Equal(c, b) }()
+		go func() { defer wg.Done(); c.Copy([]byte("x")) }()
+	}
+	wg.Wait()
+
+	a.Destroy()
+	b.Destroy()
+	c.Destroy()
+
+	if _, err := Equal(a, b); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+}
+
+func TestSecureCompare(t *testing.T) {
+	a, _ := NewMutableFromBytes([]byte("yellow submarine"))
+	b, _ := NewImmutableFromBytes([]byte("yellow submarine"))
+	c, _ := NewMutableFromBytes([]byte("yellow"))
+
+	if equal, err := SecureCompare(a, b); !equal || err != nil {
+		t.Error("unexpected return values;", equal, err)
+	}
+	if equal, err := SecureCompare(a, a); !equal || err != nil {
+		t.Error("unexpected return values;", equal, err)
+	}
+	if equal, err := SecureCompare(c, a); equal || err != nil {
+		t.Error("unexpected return values;", equal, err)
+	}
+
+	// Calls with the arguments swapped shouldn't deadlock, even alongside a writer.
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(3)
+		go func() { defer wg.Done(); SecureCompare(a, c) }()
+		go func() { defer wg.Done(); SecureCompare(c, a) }()
+		go func() { defer wg.Done(); Equal(a, c) }()
+	}
+	wg.Wait()
+
+	// An overwritten canary should be reported instead of a result, whichever side it's on.
+	canary := getBytes(uintptr(unsafe.Pointer(&a.buffer[0]))-1, 1)
+	canary[0] ^= 0xff
+	if equal, err := SecureCompare(a, b); equal || err != ErrCanaryViolation {
+		t.Error("unexpected return values;", equal, err)
+	}
+	if equal, err := SecureCompare(c, a); equal || err != ErrCanaryViolation {
+		t.Error("unexpected return values;", equal, err)
+	}
+	canary[0] ^= 0xff
+
+	a.Destroy()
+	b.Destroy()
+	c.Destroy()
+
+	if _, err := SecureCompare(a, b); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+}
+
+func TestSplit(t *testing.T) {
+	a, _ := NewImmutableFromBytes([]byte("xxxxyyyy"))
+
+	b, c, err := Split(a, 4)
+	if err != nil {
+		t.Error("unexpected error")
+	}
+	if !bytes.Equal(b.Buffer(), []byte("xxxx")) {
+		t.Error("first buffer has unexpected value")
+	}
+	if !bytes.Equal(c.Buffer(), []byte("yyyy")) {
+		t.Error("second buffer has unexpected value")
+	}
+	if b.IsMutable() || c.IsMutable() {
+		t.Error("permissions not preserved")
+	}
+	if !bytes.Equal(a.Buffer(), []byte("xxxxyyyy")) {
+		t.Error("original is not preserved")
+	}
+
+	b.Destroy()
+	c.Destroy()
+
+	if _, _, err := Split(a, 0); err != ErrInvalidLength {
+		t.Error("expected ErrInvalidLength")
+	}
+	if _, _, err := Split(a, 8); err != ErrInvalidLength {
+		t.Error("expected ErrInvalidLength")
+	}
+	if _, _, err := Split(a, -1); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange")
+	}
+	if _, _, err := Split(a, 9); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange")
+	}
+
+	a.Destroy()
+
+	if _, _, err := Split(a, 4); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+}
+
+func TestTrim(t *testing.T) {
+	b, _ := NewImmutableFromBytes([]byte("xxxxyyyy"))
+
+	c, err := Trim(b, 2, 4)
+	if err != nil {
+		t.Error("unexpected error")
+	}
+
+	if !bytes.Equal(c.Buffer(), []byte("xxyy")) {
+		t.Error("unexpected value:", c.Buffer())
+	}
+
+	if c.IsMutable() {
+		t.Error("unexpected state")
+	}
+	c.Destroy()
+
+	if _, err := Trim(b, 4, 0); err != ErrInvalidLength {
+		t.Error("expected ErrInvalidLength")
+	}
+
+	b.Destroy()
+
+	if _, err := Trim(b, 2, 4); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+}
+
+func TestResize(t *testing.T) {
+	b, _ := NewMutableFromBytes([]byte("yellow submarine"))
+
+	c, err := Resize(b, 32)
+	if err != nil {
+		t.Error("unexpected error")
+	}
+	if !bytes.Equal(c.Buffer()[:16], []byte("yellow submarine")) || !bytes.Equal(c.Buffer()[16:], make([]byte, 16)) {
+		t.Error("unexpected value:", c.Buffer())
+	}
+	if !c.IsMutable() {
+		t.Error("unexpected state")
+	}
+	if !b.IsDestroyed() {
+		t.Error("expected original to be destroyed")
+	}
+
+	d, err := Resize(c, 6)
+	if err != nil {
+		t.Error("unexpected error")
+	}
+	if !bytes.Equal(d.Buffer(), []byte("yellow")) {
+		t.Error("unexpected value:", d.Buffer())
+	}
+
+	if _, err := Resize(d, 0); err != ErrInvalidLength {
+		t.Error("expected ErrInvalidLength")
+	}
+	if d.IsDestroyed() {
+		t.Error("original destroyed on failure")
+	}
+
+	d.MakeImmutable()
+	if _, err := Resize(d, 8); err != ErrImmutable {
+		t.Error("expected ErrImmutable")
+	}
+
+	d.Destroy()
+
+	if _, err := Resize(d, 8); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+}
+
+func TestGrowImmutable(t *testing.T) {
+	b, _ := NewImmutableFromBytes([]byte("yellow submarine"))
+
+	c, err := GrowImmutable(b, 32)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if !bytes.Equal(c.Buffer()[:16], []byte("yellow submarine")) || !bytes.Equal(c.Buffer()[16:], make([]byte, 16)) {
+		t.Error("unexpected value:", c.Buffer())
+	}
+	if c.IsMutable() || c.memory == nil {
+		t.Error("unexpected state")
+	}
+	if !b.IsDestroyed() {
+		t.Error("expected original to be destroyed")
+	}
+
+	if _, err := GrowImmutable(c, 8); err != ErrInvalidLength {
+		t.Error("expected ErrInvalidLength; got", err)
+	}
+	if c.IsDestroyed() {
+		t.Error("original destroyed on failure")
+	}
+
+	c.Destroy()
+	if _, err := GrowImmutable(c, 64); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+}
+
+func TestGrow(t *testing.T) {
+	b, _ := NewMutableFromBytes([]byte("yellow submarine"))
+	inner := &b.inner[0]
+
+	// Growing within the page shouldn't move the memory.
+	if err := b.Grow(16); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if &b.inner[0] != inner || b.Size() != 32 {
+		t.Error("unexpected state;", b.Size())
+	}
+	if !bytes.Equal(b.Buffer()[:16], []byte("yellow submarine")) || !bytes.Equal(b.Buffer()[16:], make([]byte, 16)) {
+		t.Error("unexpected value:", b.Buffer())
+	}
+	if err := b.Verify(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	// Growing to fill the page exactly is fine, but not beyond it.
+	if err := b.Grow(len(b.inner) - 32 - b.canaryLen + 1); err != ErrNoSlack {
+		t.Error("expected ErrNoSlack; got", err)
+	}
+	if err := b.Grow(len(b.inner) - 32 - b.canaryLen); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if b.Size() != len(b.inner)-b.canaryLen || !bytes.Equal(b.Buffer()[:16], []byte("yellow submarine")) {
+		t.Error("unexpected state;", b.Size())
+	}
+	if err := b.Grow(1); err != ErrNoSlack {
+		t.Error("expected ErrNoSlack; got", err)
+	}
+
+	if err := b.Grow(-1); err != ErrInvalidLength {
+		t.Error("expected ErrInvalidLength; got", err)
+	}
+	b.MakeImmutable()
+	if err := b.Grow(1); err != ErrImmutable {
+		t.Error("expected ErrImmutable; got", err)
+	}
+	b.Destroy()
+	if err := b.Grow(1); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+
+	// An overwritten canary shouldn't be covered up.
+	c, _ := NewMutable(8)
+	x := getBytes(uintptr(unsafe.Pointer(&c.buffer[0]))-1, 1)
+	x[0] ^= 0xff
+	if err := c.Grow(8); err != ErrCanaryViolation {
+		t.Error("expected ErrCanaryViolation; got", err)
+	}
+	x[0] ^= 0xff
+	c.Destroy()
+}
+
+func TestScrambleBytes(t *testing.T) {
+	b := make([]byte, 32)
+	if err := ScrambleBytes(b); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if bytes.Equal(b, make([]byte, 32)) {
+		t.Error("bytes not scrambled")
+	}
+
+	// Try with empty list.
+	if err := ScrambleBytes(nil); err != nil {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestXORBytes(t *testing.T) {
+	// Compare against a plain loop for various lengths and alignments.
+	for n := 0; n < 40; n++ {
+		for off := 0; off < 3; off++ {
+			a, b := make([]byte, n+off), make([]byte, n+1)
+			fillRandBytes(a)
+			fillRandBytes(b)
+			dst := make([]byte, n+off)
+			if err := XORBytes(dst[off:], a[off:], b[1:]); err != nil {
+				t.Error("unexpected error:", err)
+			}
+			for i := 0; i < n; i++ {
+				if dst[off+i] != a[off+i]^b[1+i] {
+					t.Error("incorrect output at", i)
+				}
+			}
+		}
+	}
+
+	// Only the shorter input is used, and in place is fine.
+	a, b := []byte{1, 2, 3, 4}, []byte{1, 1}
+	if err := XORBytes(a, a, b); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if !bytes.Equal(a, []byte{0, 3, 3, 4}) {
+		t.Error("unexpected output;", a)
+	}
+
+	// The destination must be big enough.
+	if err := XORBytes(make([]byte, 1), a, b); err != ErrInvalidLength {
+		t.Error("expected ErrInvalidLength; got", err)
+	}
+}
+
+func TestXOR(t *testing.T) {
+	a, _ := NewMutableFromBytes([]byte{0xf0, 0x0f, 0xff})
+	b, _ := NewImmutableFromBytes([]byte{0xff, 0xff})
+	dst, _ := NewMutable(2)
+
+	if err := XOR(dst, a, b); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if !bytes.Equal(dst.Buffer(), []byte{0x0f, 0xf0}) {
+		t.Error("unexpected output;", dst.Buffer())
+	}
+
+	// In place.
+	if err := XOR(a, a, b); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if !bytes.Equal(a.Buffer(), []byte{0x0f, 0xf0, 0xff}) {
+		t.Error("unexpected output;", a.Buffer())
+	}
+
+	if err := XOR(b, a, a); err != ErrImmutable {
+		t.Error("expected ErrImmutable; got", err)
+	}
+
+	small, _ := NewMutable(1)
+	if err := XOR(small, a, b); err != ErrInvalidLength {
+		t.Error("expected ErrInvalidLength; got", err)
+	}
+
+	small.Destroy()
+	if err := XOR(dst, a, small); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+
+	a.Destroy()
+	b.Destroy()
+	dst.Destroy()
+}
+
+func TestConstantTimeCopy(t *testing.T) {
+	a, _ := NewMutableFromBytes([]byte("yellow"))
+	b, _ := NewImmutableFromBytes([]byte("orange"))
+
+	if err := ConstantTimeCopy(0, a, b); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if !bytes.Equal(a.Buffer(), []byte("yellow")) {
+		t.Error("unexpected copy;", a.Buffer())
+	}
+	if err := ConstantTimeCopy(1, a, b); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if !bytes.Equal(a.Buffer(), []byte("orange")) {
+		t.Error("copy failed;", a.Buffer())
+	}
+
+	// Copying onto itself is fine.
+	if err := ConstantTimeCopy(1, a, a); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	if err := ConstantTimeCopy(1, b, a); err != ErrImmutable {
+		t.Error("expected ErrImmutable; got", err)
+	}
+
+	c, _ := NewMutable(4)
+	if err := ConstantTimeCopy(1, c, a); err != ErrLengthMismatch {
+		t.Error("expected ErrLengthMismatch; got", err)
+	}
+
+	c.Destroy()
+	if err := ConstantTimeCopy(1, a, c); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+	a.Destroy()
+	b.Destroy()
+}
+
+func TestConstantTimeLookup(t *testing.T) {
+	table, _ := NewImmutableFromBytes([]byte("zeroonetwothrfou"))
+
+	// Every entry should be found.
+	dst := make([]byte, 5)
+	for i, entry := range []string{"zero", "onet", "woth", "rfou"} {
+		copy(dst, "xxxxx")
+		if err := ConstantTimeLookup(table, 4, i, dst); err != nil {
+			t.Error("unexpected error;", err)
+		}
+		if string(dst) != entry+"x" {
+			t.Error("unexpected entry;", i, string(dst))
+		}
+	}
+	if err := ConstantTimeLookup(table, 1, 15, dst); err != nil || dst[0] != 'u' {
+		t.Error("unexpected result;", err, string(dst))
+	}
+
+	// Bad arguments should be rejected.
+	for _, c := range []struct {
+		entrySize, index, dstLen int
+		err                      error
+	}{
+		{0, 0, 4, ErrInvalidLength},
+		{-4, 0, 4, ErrInvalidLength},
+		{3, 0, 4, ErrInvalidLength},
+		{4, 0, 3, ErrInvalidLength},
+		{4, 4, 4, ErrOutOfRange},
+		{4, -1, 4, ErrOutOfRange},
+		{1, maxInt, 4, ErrOutOfRange},
+	} {
+		if err := ConstantTimeLookup(table, c.entrySize, c.index, make([]byte, c.dstLen)); err != c.err {
+			t.Error("unexpected error;", c, err)
+		}
+	}
+
+	table.Destroy()
+
+	if err := ConstantTimeLookup(table, 4, 0, dst); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+}
+
+func TestWipeBytes(t *testing.T) {
+	// Create random byte slice.
+	b := make([]byte, 32)
+	fillRandBytes(b)
+
+	// Wipe it.
+	WipeBytes(b)
+
+	// Check.
+	if !bytes.Equal(b, make([]byte, 32)) {
+		t.Error("unsuccessful wipe")
+	}
+
+	// Try with empty list.
+	ebuf := make([]byte, 0)
+	WipeBytes(ebuf)
+	if len(ebuf) != 0 || cap(ebuf) != 0 {
+		t.Error("changes made to zero-sized slice")
+	}
+
+	// Try with a slice spanning several chunks.
+	large := make([]byte, 3*wipeChunkSize+17)
+	for i := range large {
+		large[i] = 0xff
+	}
+	WipeBytes(large)
+	if !bytes.Equal(large, make([]byte, len(large))) {
+		t.Error("unsuccessful wipe")
+	}
+
+	// The wipe should happen even if the slice is never used again, which we can see through another reference to the same memory.
+	sentinel := make([]byte, 64)
+	fillRandBytes(sentinel)
+	alias := getBytes(uintptr(unsafe.Pointer(&sentinel[0])), len(sentinel))
+	WipeBytes(sentinel)
+	if !bytes.Equal(alias, make([]byte, 64)) {
+		t.Error("wipe was elided")
+	}
+}
+
+func TestWipeString(t *testing.T) {
+	s := string([]byte("yellow submarine"))
+	wipeString(s)
+	if s != string(make([]byte, 16)) {
+		t.Error("string not wiped;", s)
+	}
+	wipeString("")
+}
+
+func TestCheckMemlockBudget(t *testing.T) {
+	if err := CheckMemlockBudget(0); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	// Compare against the limit, if there is one.
+	limit, err := memcall.LockLimit()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	err = CheckMemlockBudget(maxInt / 2)
+	if limit < 0 && err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if limit >= 0 && err != ErrMemlockBudget {
+		t.Error("expected ErrMemlockBudget; got", err)
+	}
+}
+
+func TestCatchInterrupt(t *testing.T) {
+	CatchInterrupt(func() {})
+
+	var i int
+	for x := 0; x < 1024; x++ {
+		catchInterruptOnce.Do(func() {
+			i++
+		})
+	}
+	if i != 0 {
+		t.Error("sync.Once failed")
+	}
+}
+
+func TestCatchSignal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals cannot be sent on windows")
+	}
+
+	// Signals can only be caught once per process, so the real work is done in a child process.
+	if os.Getenv("MEMGUARD_TEST_CATCH_SIGNAL") == "1" {
+		catchSignalChild()
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCatchSignal$", "-test.count=1")
+	cmd.Env = append(os.Environ(), "MEMGUARD_TEST_CATCH_SIGNAL=1")
+	out, err := cmd.CombinedOutput()
+
+	// The child should have been killed by the second signal, once the first had been handled.
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatal("expected child to be killed;", err, string(out))
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); !ok || !status.Signaled() || status.Signal() != syscall.SIGHUP {
+		t.Error("unexpected exit;", exitErr, string(out))
+	}
+}
+
+// Run the child process of TestCatchSignal, which reports problems through its exit code.
+func catchSignalChild() {
+	destroyed := make(chan bool)
+	b, _ := NewMutable(8)
+	CatchSignal(func(s os.Signal) {
+		destroyed <- s == syscall.SIGHUP && b.IsDestroyed()
+	}, syscall.SIGHUP)
+
+	// Subsequent calls should be ignored.
+	CatchSignal(nil, syscall.SIGHUP)
+
+	// Send ourselves a signal, which should be handled after destroying everything.
+	p, _ := os.FindProcess(os.Getpid())
+	p.Signal(syscall.SIGHUP)
+	if !<-destroyed {
+		os.Exit(3)
+	}
+
+	// The next one shouldn't be caught any more, so it should kill us.
+	p.Signal(syscall.SIGHUP)
+	time.Sleep(10 * time.Second)
+	os.Exit(4)
+}
+
+func TestConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+
+	b, _ := NewMutable(16)
+	for i := 0; i < 1024; i++ {
+		wg.Add(1)
+		go func() {
+			CatchInterrupt(func() {
+				return
+			})
+
+			b.MakeImmutable()
+			b.MakeMutable()
+
+			b.Move([]byte("Test"))
+			b.Copy([]byte("test"))
+
+			b.FillRandomBytes()
+
+			b.Wipe()
+
+			wg.Done()
+		}()
+	}
+
+	wg.Wait()
+	b.Destroy()
+}
+
+func TestSetPanicHandler(t *testing.T) {
+	defer SetPanicHandler(nil)
+
+	b, _ := NewMutable(8)
+	c := getBytes(uintptr(unsafe.Pointer(&b.Buffer()[0]))-1, 1)
+
+	// Returns the value that Destroy panics with.
+	destroy := func() (v interface{}) {
+		defer func() {
+			v = recover()
+		}()
+		b.Destroy()
+		return
+	}
+
+	var handled interface{}
+	SetPanicHandler(func(v interface{}) {
+		handled = v
+	})
+
+	c[0] ^= 0xff
+	v := destroy()
+	if v == nil {
+		t.Error("expected panic")
+	}
+	if handled != v {
+		t.Error("handler was not called with panic value;", handled)
+	}
+
+	// A panicking handler should not change the outcome.
+	SetPanicHandler(func(interface{}) {
+		panic("oops")
+	})
+	if destroy() != v {
+		t.Error("unexpected panic value")
+	}
+
+	// Removing the handler.
+	handled = nil
+	SetPanicHandler(nil)
+	if destroy() != v {
+		t.Error("unexpected panic value")
+	}
+	if handled != nil {
+		t.Error("removed handler was called")
+	}
+
+	c[0] ^= 0xff
+	b.Destroy()
+	if !b.IsDestroyed() {
+		t.Error("expected it to be destroyed")
+	}
+}
+
+func TestDisableUnixCoreDumps(t *testing.T) {
+	DisableUnixCoreDumps()
+}
+
+func TestRoundPage(t *testing.T) {
+	if roundToPageSize(pageSize) != pageSize {
+		t.Error("incorrect rounding;", roundToPageSize(pageSize))
+	}
+
+	if roundToPageSize(pageSize+1) != 2*pageSize {
+		t.Error("incorrect rounding;", roundToPageSize(pageSize+1))
+	}
+}
+
+func TestGetBytes(t *testing.T) {
+	b := make([]byte, 16)
+	copy(b, "yellow submarine")
+
+	ptr := unsafe.Pointer(&b[0])
+	length := len(b)
+	bBytes := getBytes(uintptr(ptr), length)
+
+	copy(bBytes, []byte("fellow submarine"))
+
+	if !bytes.Equal(b, bBytes) {
+		t.Error("pointer does not describe actual memory")
+	}
+}
+
+func TestGuardFaultReporting(t *testing.T) {
+	b, _ := NewMutable(32)
+	b.SetLabel("overflowed")
+	defer b.Destroy()
+
+	// Returns the value that a goroutine reading from a given address panics with.
+	fault := func(ptr uintptr) interface{} {
+		c := make(chan interface{})
+		go func() {
+			defer func() {
+				c <- recover()
+			}()
+			defer ReportGuardFault()
+			EnableGuardFaultReporting()
+
+			b.buffer[0] = getBytes(ptr, 1)[0]
+		}()
+		return <-c
+	}
+
+	// Reading one byte past the end.
+	v, ok := fault(uintptr(unsafe.Pointer(&b.buffer[0])) + 32).(string)
+	if !ok || !strings.Contains(v, "after LockedBuffer \"overflowed\" (32 bytes)") {
+		t.Error("unexpected panic value;", v)
+	}
+
+	// Reading the page before the data.
+	v, ok = fault(uintptr(unsafe.Pointer(&b.memory[0]))).(string)
+	if !ok || !strings.Contains(v, "before LockedBuffer \"overflowed\"") {
+		t.Error("unexpected panic value;", v)
+	}
+
+	// It should be safe to describe faults while LockedBuffers are changing.
+	c, _ := NewMutable(16)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			c.SetLabel(fmt.Sprint(i))
+		}
+		c.Destroy()
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		describeGuardFault(uintptr(unsafe.Pointer(&b.memory[0])))
+	}
+	<-done
+
+	// Other panics should be passed on untouched.
+	func() {
+		defer func() {
+			if v := recover(); v != "oops" {
+				t.Error("unexpected panic value;", v)
+			}
+		}()
+		defer ReportGuardFault()
+		panic("oops")
+	}()
+
+	// Without a panic, nothing should happen.
+	func() {
+		defer ReportGuardFault()
+	}()
+}
+
+func TestSetGuardFaultMode(t *testing.T) {
+	b, _ := NewMutable(32)
+	defer b.Destroy()
+	guard := uintptr(unsafe.Pointer(&b.buffer[0])) + 32
+
+	c := make(chan interface{})
+	go func() {
+		// The default is to crash.
+		if SetGuardFaultMode(GuardFaultPanic) != GuardFaultCrash {
+			t.Error("unexpected previous mode")
+		}
+
+		// Touching the guard page should cause a panic that gives the address.
+		func() {
+			defer func() {
+				fault, ok := recover().(interface{ Addr() uintptr })
+				if !ok || fault.Addr() != guard {
+					t.Error("unexpected panic value;", fault)
+				}
+			}()
+			b.buffer[0] = getBytes(guard, 1)[0]
+		}()
+
+		// Switching back.
+		if SetGuardFaultMode(GuardFaultCrash) != GuardFaultPanic {
+			t.Error("unexpected previous mode")
+		}
+		c <- nil
+	}()
+	<-c
+}
+
+func TestSetGuardPageCount(t *testing.T) {
+	defer SetGuardPageCount(0)
+
+	// Two guard pages on either side.
+	SetGuardPageCount(2)
+	b, err := NewMutableFromBytes([]byte("yellow submarine"))
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if b.guardLen != 2*pageSize || len(b.memory) != 5*pageSize || &b.inner[0] != &b.memory[2*pageSize] {
+		t.Error("unexpected layout;", b.guardLen, len(b.memory))
+	}
+	if err := b.Verify(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	// Every guard page should be inaccessible, and reported as such.
+	for _, off := range []int{0, pageSize, 3 * pageSize, 4*pageSize + 1} {
+		c := make(chan interface{})
+		go func() {
+			defer func() {
+				c <- recover()
+			}()
+			defer ReportGuardFault()
+			EnableGuardFaultReporting()
+
+			b.buffer[0] = b.memory[off]
+		}()
+		if v, ok := (<-c).(string); !ok || !strings.Contains(v, "guard page") {
+			t.Error("unexpected panic value;", off, v)
+		}
+	}
+	b.Destroy()
+
+	// Existing buffers keep their guard pages.
+	c, _ := NewMutable(8)
+	SetGuardPageCount(0)
+	if c.guardLen != 2*pageSize {
+		t.Error("unexpected guard length;", c.guardLen)
+	}
+	c.Destroy()
+	d, _ := NewMutable(8)
+	if d.guardLen != pageSize || len(d.memory) != 3*pageSize {
+		t.Error("unexpected layout;", d.guardLen, len(d.memory))
+	}
+	d.Destroy()
+
+	// Guard pages count towards the allocation limit.
+	defer SetMaxAllocSize(1 << 30)
+	SetMaxAllocSize(4 * pageSize)
+	SetGuardPageCount(2)
+	if _, err := NewMutable(8); err != ErrSizeTooLarge {
+		t.Error("expected ErrSizeTooLarge; got", err)
+	}
+}
+
+func TestHide(t *testing.T) {
+	b, _ := NewMutableFromBytes([]byte("yellow submarine"))
+
+	// Returns the value that a goroutine reading the buffer panics with.
+	read := func() interface{} {
+		c := make(chan interface{})
+		go func() {
+			defer func() {
+				if v := recover(); v != nil {
+					c <- v
+				}
+			}()
+			EnableGuardFaultReporting()
+
+			c <- getBytes(uintptr(unsafe.Pointer(&b.buffer[0])), 1)[0]
+		}()
+		if v := <-c; v != byte('y') {
+			return v
+		}
+		return nil
+	}
+
+	if b.IsHidden() {
+		t.Error("expected not hidden")
+	}
+	if err := b.Hide(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if !b.IsHidden() {
+		t.Error("expected hidden")
+	}
+	if read() == nil {
+		t.Error("expected hidden memory to fault")
+	}
+	if err := b.Verify(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if read() == nil {
+		t.Error("expected memory to still be hidden after Verify")
+	}
+
+	// Changing mutability while hidden takes effect on Reveal.
+	b.MakeImmutable()
+	if read() == nil {
+		t.Error("expected memory to still be hidden after MakeImmutable")
+	}
+	if err := b.Reveal(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if b.IsHidden() || b.IsMutable() {
+		t.Error("unexpected state")
+	}
+	if v := read(); v != nil {
+		t.Error("unexpected panic;", v)
+	}
+	if !bytes.Equal(b.Buffer(), []byte("yellow submarine")) {
+		t.Error("contents changed;", b.Buffer())
+	}
+
+	// Hiding and revealing twice does nothing.
+	b.Hide()
+	b.Hide()
+	b.MakeMutable()
+	b.Reveal()
+	b.Reveal()
+	if b.IsHidden() || !b.IsMutable() {
+		t.Error("unexpected state")
+	}
+
+	// Accessing a hidden buffer through the package returns an error instead of faulting.
+	b.Hide()
+	other, _ := NewMutable(16)
+	if err := b.Copy([]byte("x")); err != ErrHidden {
+		t.Error("expected ErrHidden;", err)
+	}
+	if _, err := b.CopyOut(make([]byte, 16)); err != ErrHidden {
+		t.Error("expected ErrHidden;", err)
+	}
+	if _, err := b.EqualBytes([]byte("yellow submarine")); err != ErrHidden {
+		t.Error("expected ErrHidden;", err)
+	}
+	if _, err := b.Slice(0, 1); err != ErrHidden {
+		t.Error("expected ErrHidden;", err)
+	}
+	if err := b.ReadAll(func([]byte) error { return nil }); err != ErrHidden {
+		t.Error("expected ErrHidden;", err)
+	}
+	if _, err := b.Uint32At(0); err != ErrHidden {
+		t.Error("expected ErrHidden;", err)
+	}
+	if err := b.Wipe(); err != ErrHidden {
+		t.Error("expected ErrHidden;", err)
+	}
+	if err := b.Grow(1); err != ErrHidden {
+		t.Error("expected ErrHidden;", err)
+	}
+	if _, err := Equal(b, other); err != ErrHidden {
+		t.Error("expected ErrHidden;", err)
+	}
+	if err := other.MoveTo(b); err != ErrHidden {
+		t.Error("expected ErrHidden;", err)
+	}
+	if _, err := Duplicate(b); err != ErrHidden {
+		t.Error("expected ErrHidden;", err)
+	}
+	if _, err := Concatenate(other, b); err != ErrHidden {
+		t.Error("expected ErrHidden;", err)
+	}
+	if _, err := GrowImmutable(b, 32); err != ErrHidden {
+		t.Error("expected ErrHidden;", err)
+	}
+	if _, err := Checkpoint(b); err != ErrHidden {
+		t.Error("expected ErrHidden;", err)
+	}
+	if _, err := NewReader(b).Read(make([]byte, 16)); err != ErrHidden {
+		t.Error("expected ErrHidden;", err)
+	}
+	if _, err := NewWriter(b).Write([]byte("x")); err != ErrHidden {
+		t.Error("expected ErrHidden;", err)
+	}
+	if _, err := b.WriteTo(new(bytes.Buffer)); err != ErrHidden {
+		t.Error("expected ErrHidden;", err)
+	}
+	if _, err := Seal(b); err != ErrHidden {
+		t.Error("expected ErrHidden;", err)
+	}
+	if b.IsDestroyed() {
+		t.Error("expected Seal to leave a hidden buffer alone")
+	}
+	other.Destroy()
+
+	// It can still be used once revealed.
+	b.Reveal()
+	if ok, err := b.EqualBytes([]byte("yellow submarine")); !ok || err != nil {
+		t.Error("unexpected result;", ok, err)
+	}
+
+	// Destroying a hidden buffer.
+	b.Hide()
+	b.Destroy()
+	if !b.IsDestroyed() || b.IsHidden() {
+		t.Error("unexpected state")
+	}
+	if err := b.Hide(); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+	if err := b.Reveal(); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+}
+
+func TestVerifyHashed(t *testing.T) {
+	b, _ := NewImmutableFromBytes([]byte("hunter2"))
+
+	// Check it against a stored digest, which is what a password hashing library would do.
+	verify := func(stored [sha256.Size]byte) func([]byte) (bool, error) {
+		return func(plaintext []byte) (bool, error) {
+			sum := sha256.Sum256(plaintext)
+			return bytes.Equal(sum[:], stored[:]), nil
+		}
+	}
+	if ok, err := VerifyHashed(b, verify(sha256.Sum256([]byte("hunter2")))); !ok || err != nil {
+		t.Error("unexpected result;", ok, err)
+	}
+	if ok, err := VerifyHashed(b, verify(sha256.Sum256([]byte("hunter3")))); ok || err != nil {
+		t.Error("unexpected result;", ok, err)
+	}
+
+	// Errors should be passed through.
+	e := errors.New("malformed hash")
+	if ok, err := VerifyHashed(b, func([]byte) (bool, error) { return false, e }); ok || err != e {
+		t.Error("unexpected result;", ok, err)
+	}
+
+	// Other readers shouldn't be held up.
+	VerifyHashed(b, func([]byte) (bool, error) {
+		if err := b.ReadAll(func([]byte) error { return nil }); err != nil {
+			t.Error("unexpected error;", err)
+		}
+		return true, nil
+	})
+
+	b.Destroy()
+
+	called := false
+	if ok, err := VerifyHashed(b, func([]byte) (bool, error) { called = true; return true, nil }); ok || err != ErrDestroyed || called {
+		t.Error("unexpected result;", ok, err)
+	}
+}
+
+func TestWithExposed(t *testing.T) {
+	b, _ := NewMutableFromBytes([]byte("yellow submarine"))
+	b.Hide()
+
+	// The contents should be accessible during the call only.
+	err := WithExposed(b, func(data []byte) error {
+		if !bytes.Equal(data, []byte("yellow submarine")) {
+			t.Error("unexpected contents;", data)
+		}
+		data[0] = 'f'
+		return io.EOF
+	})
+	if err != io.EOF {
+		t.Error("expected io.EOF; got", err)
+	}
+	if !b.IsHidden() {
+		t.Error("expected buffer to be hidden again")
+	}
+
+	// Even if the function panics.
+	func() {
+		defer func() {
+			if v := recover(); v != "oops" {
+				t.Error("unexpected panic value;", v)
+			}
+		}()
+		WithExposed(b, func([]byte) error {
+			panic("oops")
+		})
+	}()
+	if !b.IsHidden() {
+		t.Error("expected buffer to be hidden again")
+	}
+
+	// Suspended buffers are locked for the duration of the call.
+	b.Suspend()
+	before := LockedMemory()
+	WithExposed(b, func(data []byte) error {
+		if data[0] != 'f' {
+			t.Error("unexpected contents;", data)
+		}
+		return nil
+	})
+	if !b.IsSuspended() || !b.IsHidden() || LockedMemory() != before {
+		t.Error("unexpected state")
+	}
+
+	// Visible buffers are left alone.
+	b.Resume()
+	WithExposed(b, func([]byte) error { return nil })
+	if b.IsHidden() {
+		t.Error("expected buffer to stay visible")
+	}
+
+	b.Destroy()
+	if err := WithExposed(b, func([]byte) error { return nil }); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+}
+
+func TestReadPassword(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	// A pipe is not a terminal.
+	if b, err := ReadPassword(int(r.Fd())); err == nil {
+		t.Error("expected error for a pipe")
+		b.Destroy()
+	}
+
+	// Lines should be read up to the line ending, growing as needed.
+	long := strings.Repeat("x", 100)
+	w.Write([]byte("hunter2\r\n" + long + "\n\nlast"))
+	w.Close()
+	for _, want := range []string{"hunter2", long} {
+		b, err := readLine(int(r.Fd()))
+		if err != nil {
+			t.Fatal("unexpected error;", err)
+		}
+		if string(b.Buffer()) != want || !b.IsMutable() {
+			t.Error("unexpected line;", b.Buffer())
+		}
+		b.Destroy()
+	}
+	if _, err := readLine(int(r.Fd())); err != ErrInvalidLength {
+		t.Error("expected ErrInvalidLength; got", err)
+	}
+	b, err := readLine(int(r.Fd()))
+	if err != nil || string(b.Buffer()) != "last" {
+		t.Error("unexpected result;", b, err)
+	}
+	b.Destroy()
+}
+
+func TestSlice(t *testing.T) {
+	b, _ := NewMutableFromBytes([]byte("yellow submarine"))
+
+	s, err := b.Slice(7, 3)
+	if err != nil || string(s) != "sub" || cap(s) != 3 {
+		t.Error("unexpected result;", s, err)
+	}
+	if s, err := b.Slice(16, 0); err != nil || len(s) != 0 {
+		t.Error("unexpected result;", s, err)
+	}
+	for _, r := range [][2]int{{-1, 2}, {0, 17}, {15, 2}, {17, 0}, {1, -1}, {1, maxInt}} {
+		if _, err := b.Slice(r[0], r[1]); err != ErrOutOfRange {
+			t.Error("expected ErrOutOfRange for", r, "got", err)
+		}
+	}
+
+	// The callback form should see the same region.
+	err = WithSlice(b, 0, 6, func(region []byte) error {
+		if string(region) != "yellow" {
+			t.Error("unexpected region;", region)
+		}
+		copy(region, "mellow")
+		return io.EOF
+	})
+	if err != io.EOF || string(b.Buffer()) != "mellow submarine" {
+		t.Error("unexpected result;", err, b.Buffer())
+	}
+	if err := WithSlice(b, 10, 7, func([]byte) error { t.Error("should not be called"); return nil }); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange; got", err)
+	}
+
+	b.Destroy()
+	if _, err := b.Slice(0, 1); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+	if err := WithSlice(b, 0, 1, func([]byte) error { return nil }); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+}
+
+func TestHKDF(t *testing.T) {
+	// Test case 1 from RFC 5869, split into two subkeys.
+	secret, _ := NewImmutableFromBytes(bytes.Repeat([]byte{0x0b}, 22))
+	salt, _ := NewImmutableFromBytes([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12})
+	info := []byte{0xf0, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8, 0xf9}
+	keys, err := HKDF(sha256.New, secret, salt, info, 32, 10)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	okm := append(append([]byte{}, keys[0].Buffer()...), keys[1].Buffer()...)
+	if fmt.Sprintf("%x", okm) != "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865" {
+		t.Error("unexpected output;", okm)
+	}
+	if keys[0].IsMutable() || keys[1].IsMutable() {
+		t.Error("expected immutable subkeys")
+	}
+	for _, k := range keys {
+		k.Destroy()
+	}
+
+	// Test case 3, with no salt and no info.
+	keys, err = HKDF(sha256.New, secret, nil, nil, 42)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if fmt.Sprintf("%x", keys[0].Buffer()) != "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8" {
+		t.Error("unexpected output;", keys[0].Buffer())
+	}
+	keys[0].Destroy()
+
+	// The secret can be used as its own salt.
+	keys, err = HKDF(sha256.New, secret, secret, nil, 16)
+	if err != nil || len(keys) != 1 {
+		t.Fatal("unexpected result;", err)
+	}
+	keys[0].Destroy()
+
+	if _, err := HKDF(sha256.New, secret, nil, nil, 16, 0); err != ErrInvalidLength {
+		t.Error("expected ErrInvalidLength; got", err)
+	}
+	if _, err := HKDF(sha256.New, secret, nil, nil, 255*32, 1); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange; got", err)
+	}
+	salt.Destroy()
+	if _, err := HKDF(sha256.New, secret, salt, nil, 16); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+	secret.Destroy()
+	if _, err := HKDF(sha256.New, secret, nil, nil, 16); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+}
+
+func TestSuspend(t *testing.T) {
+	b, _ := NewMutableFromBytes([]byte("yellow submarine"))
+	before := LockedMemory()
+
+	if err := b.Suspend(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if !b.IsSuspended() || !b.IsHidden() || b.IsLocked() {
+		t.Error("unexpected state")
+	}
+	if LockedMemory() != before-pageSize {
+		t.Error("memory still counted as locked;", before-LockedMemory())
+	}
+
+	// Suspending twice is fine.
+	if err := b.Suspend(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	if err := b.Resume(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if b.IsSuspended() || b.IsHidden() || !b.IsLocked() || LockedMemory() != before {
+		t.Error("unexpected state")
+	}
+	if !bytes.Equal(b.Buffer(), []byte("yellow submarine")) {
+		t.Error("unexpected contents;", b.Buffer())
+	}
+
+	// Destroying a suspended buffer shouldn't unlock it twice.
+	b.Suspend()
+	b.Destroy()
+	if b.IsSuspended() {
+		t.Error("unexpected state")
+	}
+	if err := b.Suspend(); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+
+	// Slabs can't be suspended.
+	EnableSlabAllocator(32)
+	defer EnableSlabAllocator(0)
+	c, _ := NewMutable(8)
+	if err := c.Suspend(); err != ErrUnsupported {
+		t.Error("expected ErrUnsupported; got", err)
+	}
+	c.Destroy()
+}
+
+func TestSlabAllocator(t *testing.T) {
+	EnableSlabAllocator(32)
+	defer EnableSlabAllocator(0)
+
+	// Small mutable buffers should share a slab.
+	a, _ := NewMutableFromBytes([]byte("yellow submarine"))
+	b, _ := NewMutableRandom(32)
+	if a.slab == nil || a.slab != b.slab {
+		t.Error("expected buffers to share a slab")
+	}
+	if &a.inner[0] == &b.inner[0] || len(a.inner) != len(b.inner) {
+		t.Error("expected distinct slots of equal size")
+	}
+	if !bytes.Equal(a.Buffer(), []byte("yellow submarine")) {
+		t.Error("unexpected contents;", a.Buffer())
+	}
+	if err := a.Verify(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	// Large or immutable ones should not.
+	c, _ := NewMutable(33)
+	d, _ := NewImmutable(8)
+	fromBytes, _ := NewImmutableFromBytes([]byte("yellow submarine"))
+	random, _ := NewImmutableRandom(8)
+	fromReader, _ := NewImmutableFromReader(strings.NewReader("yellow submarine"), 16)
+	first, second, _ := Split(fromBytes, 8)
+	trimmed, _ := Trim(fromBytes, 4, 8)
+	for _, buf := range []*LockedBuffer{c, d, fromBytes, random, fromReader, first, second, trimmed} {
+		if buf.slab != nil {
+			t.Error("expected buffers to have their own pages")
+		}
+		buf.Destroy()
+	}
+
+	// The kernel can't protect them on their own, so making them immutable and hiding them are unsupported.
+	if err := a.MakeImmutable(); err != ErrUnsupported || !a.IsMutable() {
+		t.Error("expected ErrUnsupported; got", err)
+	}
+	if err := a.Copy([]byte("x")); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if err := a.MakeMutable(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if err := a.Hide(); err != ErrUnsupported {
+		t.Error("expected ErrUnsupported")
+	}
+
+	// Canary violations should still be caught.
+	x := getBytes(uintptr(unsafe.Pointer(&a.buffer[0]))-1, 1)
+	x[0] ^= 0xff
+	if err := a.Verify(); err != ErrCanaryViolation {
+		t.Error("expected ErrCanaryViolation")
+	}
+	x[0] ^= 0xff
+
+	// Destroying should wipe the slot but keep the slab while it's in use.
+	s, slot := a.slab, a.inner
+	a.Destroy()
+	if !a.IsDestroyed() || a.slab != nil {
+		t.Error("expected buffer to be destroyed")
+	}
+	for _, v := range slot {
+		if v != 0 {
+			t.Error("slot not wiped")
+			break
+		}
+	}
+	if len(s.free) != len(s.inner)/s.slotSize-1 {
+		t.Error("unexpected number of free slots;", len(s.free))
+	}
+
+	// The freed slot should be reused.
+	e, _ := NewMutable(4)
+	if e.slab != s || &e.inner[0] != &slot[0] {
+		t.Error("expected slot to be reused")
+	}
+
+	// The slab should be freed along with its last buffer.
+	b.Destroy()
+	e.Destroy()
+	allSlabsMutex.Lock()
+	n := len(allSlabs)
+	allSlabsMutex.Unlock()
+	if n != 0 {
+		t.Error("expected slab to be freed;", n)
+	}
+
+	// Disabling slabs.
+	EnableSlabAllocator(0)
+	f, _ := NewMutable(4)
+	if f.slab != nil {
+		t.Error("expected slabs to be disabled")
+	}
+	f.Destroy()
+}
+
+// countingAllocator wraps the default Allocator, counting calls and optionally failing allocations.
+type countingAllocator struct {
+	memcallAllocator
+	allocs, frees int
+	fail          bool
+}
+
+func (a *countingAllocator) Alloc(n int) ([]byte, error) {
+	if a.fail {
+		return nil, errors.New("out of memory")
+	}
+	a.allocs++
+	return a.memcallAllocator.Alloc(n)
+}
+
+func (a *countingAllocator) Free(b []byte) error {
+	a.frees++
+	return a.memcallAllocator.Free(b)
+}
+
+func TestMockAllocator(t *testing.T) {
+	defer SetAllocator(nil)
+
+	a := &MockAllocator{}
+	SetAllocator(a)
+	b, err := NewMutable(32)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if uintptr(unsafe.Pointer(&b.memory[0]))%uintptr(pageSize) != 0 {
+		t.Error("memory is not page aligned")
+	}
+
+	// Check the calls made by each operation.
+	expect := func(op func() error, want ...Protection) {
+		before := len(a.RecordedProtections())
+		if err := op(); err != nil {
+			t.Error("unexpected error:", err)
+		}
+		got := a.RecordedProtections()[before:]
+		if len(got) != len(want) {
+			t.Fatal("unexpected protections;", got)
+		}
+		for i := range want {
+			if &got[i].Region[0] != &want[i].Region[0] || len(got[i].Region) != len(want[i].Region) || got[i].Read != want[i].Read || got[i].Write != want[i].Write {
+				t.Error("unexpected protection;", got[i])
+			}
+		}
+	}
+	inner, memory := b.inner, b.memory
+	expect(b.MakeImmutable, Protection{inner, true, false})
+	expect(b.Hide, Protection{inner, false, false})
+
+	// Hidden memory can still be read, since nothing was really protected.
+	if b.buffer[0] != 0 {
+		t.Error("unexpected contents")
+	}
+
+	expect(b.Reveal, Protection{inner, true, false})
+	expect(func() error { b.Destroy(); return nil }, Protection{memory, true, true})
+}
+
+// countingObserver counts the events that it is notified of.
+type countingObserver struct {
+	sync.Mutex
+	created, destroyed, violations int
+	lockErrs                       []error
+}
+
+func (o *countingObserver) OnCreate(size int) {
+	o.Lock()
+	o.created += size
+	o.Unlock()
+}
+
+func (o *countingObserver) OnDestroy(size int) {
+	o.Lock()
+	o.destroyed += size
+	o.Unlock()
+}
+
+func (o *countingObserver) OnCanaryViolation() {
+	o.Lock()
+	o.violations++
+	o.Unlock()
+}
+
+func (o *countingObserver) OnLockFailure(err error) {
+	o.Lock()
+	o.lockErrs = append(o.lockErrs, err)
+	o.Unlock()
+}
+
+// failingLockAllocator wraps the default Allocator, failing every attempt to lock memory.
+type failingLockAllocator struct {
+	memcallAllocator
+}
+
+func (failingLockAllocator) Lock([]byte) error {
+	return errors.New("no locking for you")
+}
+
+func TestSetObserver(t *testing.T) {
+	o := &countingObserver{}
+	SetObserver(o)
+	defer SetObserver(nil)
+
+	// Creation and destruction should be reported with sizes.
+	b, _ := NewMutable(8)
+	c, _ := NewMutableRandom(32)
+	b.Destroy()
+	if o.created != 40 || o.destroyed != 8 {
+		t.Error("unexpected counts;", o.created, o.destroyed)
+	}
+
+	// So should canary violations.
+	getBytes(uintptr(unsafe.Pointer(&c.buffer[0]))-1, 1)[0] ^= 0xff
+	if err := c.Verify(); err != ErrCanaryViolation || o.violations != 1 {
+		t.Error("expected violation to be reported;", err, o.violations)
+	}
+	getBytes(uintptr(unsafe.Pointer(&c.buffer[0]))-1, 1)[0] ^= 0xff
+	c.Destroy()
+
+	// LockedBuffers that fail to be filled in were never created as far as the observer is concerned.
+	if _, err := NewFromFunc(16, func([]byte) error { return errors.New("fill failed") }); err == nil {
+		t.Error("expected error")
+	}
+	if o.created != 40 || o.destroyed != 40 {
+		t.Error("unexpected counts;", o.created, o.destroyed)
+	}
+
+	// And lock failures, even if they aren't fatal.
+	SetAllocator(failingLockAllocator{})
+	defer SetAllocator(nil)
+	SetLockPolicy(LockBestEffort)
+	defer SetLockPolicy(LockRequired)
+	d, err := NewMutable(8)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(o.lockErrs) != 1 || o.lockErrs[0].Error() != "no locking for you" {
+		t.Error("expected lock failure to be reported;", o.lockErrs)
+	}
+	d.Destroy()
+
+	// Nothing should be reported once it's removed.
+	SetObserver(nil)
+	e, _ := NewMutable(8)
+	e.Destroy()
+	if o.created != 48 || o.destroyed != 48 {
+		t.Error("unexpected counts;", o.created, o.destroyed)
+	}
+}
+
+func TestSetAllocator(t *testing.T) {
+	defer SetAllocator(nil)
+
+	// Allocations should go through the new Allocator.
+	a := &countingAllocator{}
+	SetAllocator(a)
+	b, err := NewMutableRandom(32)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if a.allocs != 1 || b.alloc != a {
+		t.Error("expected memory to come from the allocator;", a.allocs)
+	}
+
+	// Buffers should be freed by the Allocator they came from, even after it has been replaced.
+	SetAllocator(nil)
+	b.Destroy()
+	if a.frees != 1 {
+		t.Error("expected memory to be freed by the allocator;", a.frees)
+	}
+
+	// Huge pages are only supported by the default Allocator.
+	SetAllocator(a)
+	h, err := NewMutableHugePages(32)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if h.huge {
+		t.Error("expected normal pages")
+	}
+	h.Destroy()
+
+	// Slabs should come from the Allocator too, and not be shared with other ones.
+	EnableSlabAllocator(32)
+	defer EnableSlabAllocator(0)
+	x, _ := NewMutable(8)
+	SetAllocator(nil)
+	y, _ := NewMutable(8)
+	if x.slab == nil || x.slab.alloc != a || y.slab == x.slab {
+		t.Error("unexpected slab sharing")
+	}
+	x.Destroy()
+	y.Destroy()
+	if a.frees != 3 {
+		t.Error("expected slab to be freed by the allocator;", a.frees)
+	}
+	EnableSlabAllocator(0)
+
+	// Errors should be passed on.
+	a.fail = true
+	SetAllocator(a)
+	if _, err := NewMutable(32); err == nil || err.Error() != "out of memory" {
+		t.Error("expected allocation error;", err)
+	}
+
+	// Restoring the default.
+	SetAllocator(nil)
+	if !isDefaultAllocator(getAllocator()) {
+		t.Error("expected default allocator")
+	}
+	c, err := NewMutable(32)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	c.Destroy()
+}
+
+func TestPool(t *testing.T) {
+	p := NewPool(1)
+	defer p.Destroy()
+	n := ActiveBuffers()
+
+	a, _ := p.Get(32)
+	fillRandBytes(a.Buffer())
+	a.MakeImmutable()
+	inner := a.inner
+
+	// Putting it back should destroy it as far as the caller is concerned.
+	p.Put(a)
+	if !a.IsDestroyed() || ActiveBuffers() != n {
+		t.Error("expected buffer to be destroyed")
+	}
+	for _, v := range inner {
+		if v != 0 {
+			t.Error("memory not wiped")
+			break
+		}
+	}
+
+	// The memory should be reused, and look brand new.
+	b, _ := p.Get(32)
+	if &b.inner[0] != &inner[0] {
+		t.Error("expected memory to be reused")
+	}
+	if !b.IsMutable() || !bytes.Equal(b.Buffer(), make([]byte, 32)) {
+		t.Error("unexpected state")
+	}
+	if err := b.Verify(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if ActiveBuffers() != n+1 {
+		t.Error("expected buffer to be tracked")
+	}
+	if err := a.Copy([]byte("stale")); err != ErrDestroyed {
+		t.Error("expected old handle to stay destroyed")
+	}
+
+	// Only up to the capacity should be kept, and only for matching sizes.
+	c, _ := p.Get(32)
+	d, _ := p.Get(16)
+	p.Put(b)
+	p.Put(c)
+	p.Put(d)
+	if len(p.idle[32]) != 1 || len(p.idle[16]) != 1 {
+		t.Error("unexpected idle counts;", len(p.idle[32]), len(p.idle[16]))
+	}
+	if !c.IsDestroyed() {
+		t.Error("expected buffer to be destroyed")
+	}
+
+	// Overflows should be caught when putting back.
+	e, _ := p.Get(8)
+	x := getBytes(uintptr(unsafe.Pointer(&e.Buffer()[0]))-1, 1)
+	x[0] ^= 0xff
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic")
+			}
+		}()
+		p.Put(e)
+	}()
+	x[0] ^= 0xff
+	e.Destroy()
+
+	// Destroying the pool.
+	p.Destroy()
+	if len(p.idle) != 0 {
+		t.Error("expected pool to be empty")
+	}
+}
+
+func TestFinalizer(t *testing.T) {
+	b, err := NewMutable(8)
+	if err != nil {
+		t.Error("unexpected error")
+	}
+	ib := b.container
+
+	c, err := NewImmutable(8)
+	if err != nil {
+		t.Error("unexpected error")
+	}
+	ic := c.container
+
+	if ib.IsDestroyed() != false {
+		t.Error("expected b to not be destroyed")
+	}
+	if ic.IsDestroyed() != false {
+		t.Error("expected c to not be destroyed")
+	}
+
+	runtime.KeepAlive(b)
+	// b is now unreachable
+
+	runtime.GC() // should collect b
+	for ib.IsDestroyed() != true {
+		runtime.Gosched()
+	}
+
+	if ic.IsDestroyed() != false {
+		t.Error("expected c to not be destroyed")
+	}
+
+	runtime.KeepAlive(c)
+	// c is now unreachable
+
+	runtime.GC() // should collect c
+	for ic.IsDestroyed() != true {
+		runtime.Gosched()
+	}
+}
+
+func TestLeakLogger(t *testing.T) {
+	var out bytes.Buffer
+	SetLeakLogger(log.New(&out, "", 0))
+	defer SetLeakLogger(nil)
+
+	// Leaked.
+	b, _ := NewMutable(8)
+	b.SetLabel("leaked")
+	ib := b.container
+	runtime.KeepAlive(b)
+
+	runtime.GC()
+	for !ib.IsDestroyed() {
+		runtime.Gosched()
+	}
+	if out.String() != "memguard: LockedBuffer \"leaked\" (8 bytes) was garbage collected without being destroyed\n" {
+		t.Error("unexpected log output;", out.String())
+	}
+
+	// Destroyed properly.
+	out.Reset()
+	c, _ := NewMutable(8)
+	c.Destroy()
+	runtime.GC()
+	runtime.GC()
+	if out.Len() != 0 {
+		t.Error("unexpected log output;", out.String())
+	}
+}
+
+func TestSecureString(t *testing.T) {
+	// Strings built at runtime should be wiped.
+	src := string([]byte("correct horse"))
+	s, err := NewSecureString(src)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if src != string(make([]byte, 13)) {
+		t.Error("source not wiped;", src)
+	}
+	if s.Len() != 13 || s.b.IsMutable() {
+		t.Error("unexpected state;", s.Len())
+	}
+
+	// Constants can't be, but that shouldn't be a problem.
+	c, err := NewSecureString("battery staple")
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if tryWipeString("battery staple") {
+		t.Error("expected constant not to be wiped")
+	}
+	c.Destroy()
+
+	if !s.EqualString("correct horse") || s.EqualString("correct horsf") || s.EqualString("correct") || s.EqualString("") {
+		t.Error("unexpected comparison results")
+	}
+
+	var out bytes.Buffer
+	if _, err := out.ReadFrom(s.Reader()); err != nil || out.String() != "correct horse" {
+		t.Error("unexpected result;", out.Bytes(), err)
+	}
+
+	for _, v := range []string{fmt.Sprint(s), fmt.Sprintf("%s", s), fmt.Sprintf("%#v", s)} {
+		if strings.Contains(v, "horse") || !strings.Contains(v, "redacted") {
+			t.Error("secret not redacted;", v)
+		}
+	}
+
+	s.Destroy()
+	if s.Len() != 0 || s.EqualString("correct horse") || !strings.Contains(s.String(), "destroyed") {
+		t.Error("unexpected state")
+	}
+	if _, err := s.Reader().Read(make([]byte, 1)); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+
+	if _, err := NewSecureString(""); err != ErrInvalidLength {
+		t.Error("expected ErrInvalidLength; got", err)
+	}
+}
+
+func TestScratchBuffer(t *testing.T) {
+	b, _ := NewMutableFromBytes([]byte("one-time token"))
+	s, err := NewScratchBuffer(b)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if s.Size() != 14 {
+		t.Error("unexpected size;", s.Size())
+	}
+
+	// Short destinations shouldn't use it up.
+	if _, err := s.Consume(make([]byte, 13)); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange; got", err)
+	}
+
+	// It should only be readable once.
+	before := ExposureCount()
+	dst := make([]byte, 16)
+	n, err := s.Consume(dst)
+	if err != nil || n != 14 || string(dst[:n]) != "one-time token" {
+		t.Error("unexpected result;", n, err, dst)
+	}
+	if !b.IsDestroyed() || s.Size() != 0 || ExposureCount() != before+1 {
+		t.Error("expected buffer to be destroyed")
+	}
+	if _, err := s.Consume(dst); err != ErrConsumed {
+		t.Error("expected ErrConsumed; got", err)
+	}
+	s.Destroy()
+
+	// Destroying it unread should stop it from being consumed.
+	c, _ := NewMutableRandom(8)
+	s, _ = NewScratchBuffer(c)
+	s.Destroy()
+	if _, err := s.Consume(dst); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+
+	if _, err := NewScratchBuffer(c); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+}
+
+func TestReader(t *testing.T) {
+	b, _ := NewImmutableRandom(1024)
+
+	h := sha256.New()
+	n, err := io.Copy(h, NewReader(b))
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if n != 1024 {
+		t.Error("unexpected number of bytes read:", n)
+	}
+	sum := sha256.Sum256(b.Buffer())
+	if !bytes.Equal(h.Sum(nil), sum[:]) {
+		t.Error("hash mismatch")
+	}
+
+	r := NewReader(b)
+	buf := make([]byte, 1000)
+	if n, err := r.Read(buf); n != 1000 || err != nil {
+		t.Error("unexpected return values;", n, err)
+	}
+	if n, err := r.Read(buf); n != 24 || err != nil {
+		t.Error("unexpected return values;", n, err)
+	}
+	if n, err := r.Read(buf); n != 0 || err != io.EOF {
+		t.Error("expected io.EOF;", n, err)
+	}
+
+	r = NewReader(b)
+	r.Read(buf[:16])
+	b.Destroy()
+	if _, err := r.Read(buf); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+}
+
+func TestReaderSeek(t *testing.T) {
+	b, _ := NewImmutableFromBytes([]byte("yellow submarine"))
+	var r io.ReadSeeker = NewReader(b)
+
+	p := make([]byte, 3)
+	for _, c := range []struct {
+		offset   int64
+		whence   int
+		expected int64
+		read     string
+	}{
+		{7, io.SeekStart, 7, "sub"},
+		{-6, io.SeekCurrent, 4, "ow "},
+		{-3, io.SeekEnd, 13, "ine"},
+		{0, io.SeekStart, 0, "yel"},
+	} {
+		n, err := r.Seek(c.offset, c.whence)
+		if n != c.expected || err != nil {
+			t.Error("unexpected return values;", n, err)
+		}
+		if _, err := io.ReadFull(r, p); err != nil || string(p) != c.read {
+			t.Error("unexpected read;", err, string(p))
+		}
+	}
+
+	// Seeking to the very end is fine, but not beyond either end.
+	if n, err := r.Seek(0, io.SeekEnd); n != 16 || err != nil {
+		t.Error("unexpected return values;", n, err)
+	}
+	if _, err := r.Read(p); err != io.EOF {
+		t.Error("expected io.EOF; got", err)
+	}
+	if _, err := r.Seek(1, io.SeekCurrent); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange; got", err)
+	}
+	if _, err := r.Seek(-1, io.SeekStart); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange; got", err)
+	}
+	if _, err := r.Seek(-1<<63, io.SeekEnd); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange; got", err)
+	}
+	if n, _ := r.Seek(0, io.SeekCurrent); n != 16 {
+		t.Error("offset changed;", n)
+	}
+	if _, err := r.Seek(0, 42); err == nil {
+		t.Error("expected error")
+	}
+
+	b.Destroy()
+	if _, err := r.Seek(0, io.SeekStart); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	b, _ := NewMutable(16)
+
+	n, err := io.Copy(NewWriter(b), bytes.NewReader([]byte("yellow submarine")))
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if n != 16 || !bytes.Equal(b.Buffer(), []byte("yellow submarine")) {
+		t.Error("unexpected value;", n, b.Buffer())
+	}
+
+	w := NewWriter(b)
+	if n, err := w.Write([]byte("fellow")); n != 6 || err != nil {
+		t.Error("unexpected return values;", n, err)
+	}
+	if n, err := w.Write([]byte(" submarines")); n != 10 || err != io.ErrShortWrite {
+		t.Error("expected io.ErrShortWrite;", n, err)
+	}
+	if !bytes.Equal(b.Buffer(), []byte("fellow submarine")) {
+		t.Error("unexpected value;", b.Buffer())
+	}
+	if n, err := w.Write([]byte("x")); n != 0 || err != io.ErrShortWrite {
+		t.Error("expected io.ErrShortWrite;", n, err)
+	}
+
+	b.MakeImmutable()
+	if _, err := NewWriter(b).Write([]byte("test")); err != ErrImmutable {
+		t.Error("expected ErrImmutable")
+	}
+
+	b.Destroy()
+	if _, err := NewWriter(b).Write([]byte("test")); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+	b, _ := NewMutable(16)
+
+	// Filling it up should stop reading once it's full.
+	r := strings.NewReader("yellow submarines")
+	n, err := b.ReadFrom(r)
+	if err != nil || n != 16 || !bytes.Equal(b.Buffer(), []byte("yellow submarine")) {
+		t.Error("unexpected result;", n, err, b.Buffer())
+	}
+	if r.Len() != 1 {
+		t.Error("read too much;", r.Len())
+	}
+
+	// Running out of data isn't an error.
+	n, err = b.ReadFrom(iotest.OneByteReader(strings.NewReader("fellow")))
+	if err != nil || n != 6 || !bytes.Equal(b.Buffer(), []byte("fellow submarine")) {
+		t.Error("unexpected result;", n, err, b.Buffer())
+	}
+
+	// Other errors are passed on.
+	if _, err := b.ReadFrom(iotest.TimeoutReader(iotest.OneByteReader(strings.NewReader("xx")))); err != iotest.ErrTimeout {
+		t.Error("expected ErrTimeout; got", err)
+	}
+
+	// A Writer should carry on from its offset. Sources that implement io.WriterTo take precedence in io.Copy, so hide that.
+	w := NewWriter(b)
+	w.Write([]byte("mellow"))
+	n, err = io.Copy(w, iotest.HalfReader(strings.NewReader(" yellow submarine")))
+	if err != nil || n != 10 || !bytes.Equal(b.Buffer(), []byte("mellow yellow su")) {
+		t.Error("unexpected result;", n, err, b.Buffer())
+	}
+
+	b.MakeImmutable()
+	if _, err := b.ReadFrom(strings.NewReader("test")); err != ErrImmutable {
+		t.Error("expected ErrImmutable; got", err)
+	}
+	if _, err := NewWriter(b).ReadFrom(strings.NewReader("test")); err != ErrImmutable {
+		t.Error("expected ErrImmutable; got", err)
+	}
+
+	b.Destroy()
+	if _, err := b.ReadFrom(strings.NewReader("test")); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+}
+
+func TestAESBlock(t *testing.T) {
+	// Test vector from FIPS-197, appendix C.1.
+	key, _ := NewMutableFromBytes([]byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f})
+	c, err := NewAESBlock(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	ciphertext := make([]byte, 16)
+	c.Encrypt(ciphertext, plaintext)
+	if !bytes.Equal(ciphertext, []byte{0x69, 0xc4, 0xe0, 0xd8, 0x6a, 0x7b, 0x04, 0x30, 0xd8, 0xcd, 0xb7, 0x80, 0x70, 0xb4, 0xc5, 0x5a}) {
+		t.Errorf("unexpected ciphertext; %x", ciphertext)
+	}
+	c.Decrypt(ciphertext, ciphertext)
+	if !bytes.Equal(ciphertext, plaintext) {
+		t.Errorf("unexpected plaintext; %x", ciphertext)
+	}
+	if c.BlockSize() != aes.BlockSize {
+		t.Error("unexpected block size;", c.BlockSize())
+	}
+	key.Destroy()
+
+	// Compare against crypto/aes for every key size.
+	for _, size := range []int{16, 24, 32} {
+		key, _ := NewImmutableRandom(size)
+		c, err := NewAESBlock(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, _ := aes.NewCipher(key.Buffer())
+
+		src := make([]byte, 16)
+		a, b := make([]byte, 16), make([]byte, 16)
+		for i := 0; i < 64; i++ {
+			fillRandBytes(src)
+			c.Encrypt(a, src)
+			ref.Encrypt(b, src)
+			if !bytes.Equal(a, b) {
+				t.Errorf("encryption mismatch with %d byte key; %x != %x", size, a, b)
+			}
+			c.Decrypt(a, src)
+			ref.Decrypt(b, src)
+			if !bytes.Equal(a, b) {
+				t.Errorf("decryption mismatch with %d byte key; %x != %x", size, a, b)
+			}
+		}
+
+		// It should work with the modes in crypto/cipher.
+		aead, err := cipher.NewGCM(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refAead, _ := cipher.NewGCM(ref)
+		nonce := make([]byte, 12)
+		if !bytes.Equal(aead.Seal(nil, nonce, plaintext, nil), refAead.Seal(nil, nonce, plaintext, nil)) {
+			t.Error("GCM output mismatch")
+		}
+
+		// Destroying should destroy the round keys.
+		c.Destroy()
+		if !c.roundKeys.IsDestroyed() {
+			t.Error("expected round keys to be destroyed")
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected panic")
+				}
+			}()
+			c.Encrypt(a, src)
+		}()
+		key.Destroy()
+	}
+
+	// The S-box is computed rather than looked up, so check it against a few known values and make sure that it inverts.
+	for x, y := range map[byte]byte{0x00: 0x63, 0x01: 0x7c, 0x53: 0xed, 0x8f: 0x73, 0xff: 0x16} {
+		if aesSub(x) != y {
+			t.Errorf("unexpected S-box value for %#x; %#x", x, aesSub(x))
+		}
+	}
+	for i := 0; i < 256; i++ {
+		if aesInvSub(aesSub(byte(i))) != byte(i) {
+			t.Errorf("inverse S-box doesn't invert %#x", i)
+		}
+	}
+
+	// Invalid keys.
+	key, _ = NewMutable(20)
+	if _, err := NewAESBlock(key); err != ErrInvalidKeySize {
+		t.Error("expected ErrInvalidKeySize")
+	}
+	key.Destroy()
+	if _, err := NewAESBlock(key); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+}
+
+func TestNewFromReader(t *testing.T) {
+	b, err := NewMutableFromReader(strings.NewReader("yellow submarine"), 6)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if string(b.Buffer()) != "yellow" || !b.IsMutable() {
+		t.Error("unexpected buffer;", b.Buffer())
+	}
+	b.Destroy()
+
+	c, err := NewImmutableFromReader(iotest.OneByteReader(strings.NewReader("yellow submarine")), 16)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if string(c.Buffer()) != "yellow submarine" || c.IsMutable() {
+		t.Error("unexpected buffer;", c.Buffer())
+	}
+	c.Destroy()
+
+	// Running out of data.
+	n := ActiveBuffers()
+	if _, err := NewMutableFromReader(strings.NewReader("yellow"), 16); err != io.ErrUnexpectedEOF {
+		t.Error("expected io.ErrUnexpectedEOF;", err)
+	}
+	if _, err := NewImmutableFromReader(strings.NewReader(""), 16); err != io.EOF {
+		t.Error("expected io.EOF;", err)
+	}
+	if _, err := NewMutableFromReader(iotest.TimeoutReader(strings.NewReader("yellow submarine")), 32); err != iotest.ErrTimeout {
+		t.Error("expected iotest.ErrTimeout;", err)
+	}
+	if ActiveBuffers() != n {
+		t.Error("partially filled buffers not destroyed")
+	}
+
+	// Invalid sizes.
+	if _, err := NewMutableFromReader(strings.NewReader("yellow"), 0); err != ErrInvalidLength {
+		t.Error("expected ErrInvalidLength;", err)
+	}
+	if _, err := NewImmutableFromReader(strings.NewReader("yellow"), -1); err != ErrInvalidLength {
+		t.Error("expected ErrInvalidLength;", err)
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	b, _ := NewImmutableFromBytes([]byte("yellow submarine"))
+
+	var out bytes.Buffer
+	if n, err := b.WriteTo(&out); n != 16 || err != nil || out.String() != "yellow submarine" {
+		t.Error("unexpected return values;", n, err, out.String())
+	}
+	if b.IsDestroyed() {
+		t.Error("expected buffer to be intact")
+	}
+
+	// Draining.
+	out.Reset()
+	if n, err := DrainTo(b, &out); n != 16 || err != nil || out.String() != "yellow submarine" {
+		t.Error("unexpected return values;", n, err, out.String())
+	}
+	if !b.IsDestroyed() {
+		t.Error("expected buffer to be destroyed")
+	}
+	if _, err := b.WriteTo(&out); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+	if _, err := DrainTo(b, &out); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed")
+	}
+
+	// Failed writes still destroy the buffer when draining.
+	c, _ := NewMutableRandom(16)
+	pr, pw := io.Pipe()
+	pr.Close()
+	if _, err := DrainTo(c, pw); err != io.ErrClosedPipe {
+		t.Error("expected io.ErrClosedPipe;", err)
+	}
+	if !c.IsDestroyed() {
+		t.Error("expected buffer to be destroyed")
+	}
+}
+
+func TestLineReader(t *testing.T) {
+	// Lines longer than the read buffer, blank lines, CRLFs, and no trailing newline.
+	long := strings.Repeat("x", 5000)
+	input := "first\n\nsecond\r\n" + long + "\n\r\nlast"
+	l := NewLineReader(iotest.OneByteReader(strings.NewReader(input)))
+	defer l.Destroy()
+
+	for _, want := range []string{"first", "second", long, "last"} {
+		line, err := l.Next()
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if string(line.Buffer()) != want {
+			t.Error("unexpected line;", len(line.Buffer()))
+		}
+		line.Destroy()
+	}
+	if _, err := l.Next(); err != io.EOF {
+		t.Error("expected io.EOF;", err)
+	}
+	if _, err := l.Next(); err != io.EOF {
+		t.Error("expected io.EOF;", err)
+	}
+
+	// Consumed data should have been wiped from the read buffer.
+	if !bytes.Equal(l.buf.Buffer(), make([]byte, l.buf.Size())) {
+		t.Error("read buffer not wiped")
+	}
 
-	if err := b.Wipe(); err != ErrDestroyed {
-		t.Error("expected ErrDestroyed")
+	// Read errors should be passed on.
+	l = NewLineReader(iotest.TimeoutReader(strings.NewReader("partial")))
+	defer l.Destroy()
+	if _, err := l.Next(); err != iotest.ErrTimeout {
+		t.Error("expected iotest.ErrTimeout;", err)
+	}
+
+	// Empty input.
+	l = NewLineReader(strings.NewReader(""))
+	defer l.Destroy()
+	if _, err := l.Next(); err != io.EOF {
+		t.Error("expected io.EOF;", err)
 	}
 }
 
-func TestConcatenate(t *testing.T) {
-	a, _ := NewImmutableFromBytes([]byte("xxxx"))
-	b, _ := NewMutableFromBytes([]byte("yyyy"))
+func TestEnclave(t *testing.T) {
+	b, _ := NewImmutableFromBytes([]byte("yellow submarine"))
 
-	c, err := Concatenate(a, b)
+	e, err := Seal(b)
 	if err != nil {
-		t.Error("unexpected error")
+		t.Error("unexpected error:", err)
 	}
-
-	if !bytes.Equal(c.Buffer(), []byte("xxxxyyyy")) {
-		t.Error("unexpected output;", c.Buffer())
+	if !b.IsDestroyed() {
+		t.Error("expected source to be destroyed")
 	}
-	if c.IsMutable() {
-		t.Error("expected immutability")
+	if e.Size() != 16 {
+		t.Error("unexpected size;", e.Size())
+	}
+	if bytes.Contains(e.ciphertext, []byte("yellow submarine")) {
+		t.Error("plaintext found in ciphertext")
 	}
 
-	a.Destroy()
-	b.Destroy()
+	// It should be possible to open it more than once.
+	for i := 0; i < 2; i++ {
+		c, err := Open(e)
+		if err != nil {
+			t.Error("unexpected error:", err)
+		}
+		if !bytes.Equal(c.Buffer(), []byte("yellow submarine")) {
+			t.Error("unexpected value;", c.Buffer())
+		}
+		if !c.IsMutable() {
+			t.Error("unexpected state")
+		}
+		c.Destroy()
+	}
+
+	// The key schedule should be expanded into a LockedBuffer, which is destroyed afterwards.
+	o := &countingObserver{}
+	SetObserver(o)
+	c, _ := Open(e)
 	c.Destroy()
+	SetObserver(nil)
+	if o.created != 16+240 || o.destroyed != 16+240 {
+		t.Error("unexpected counts;", o.created, o.destroyed)
+	}
 
-	if _, err := Concatenate(a, b); err != ErrDestroyed {
+	// Tampering should be detected.
+	e.ciphertext[len(e.ciphertext)-1] ^= 0xff
+	if _, err := Open(e); err != ErrDecryptionFailed {
+		t.Error("expected ErrDecryptionFailed; got", err)
+	}
+	e.ciphertext[len(e.ciphertext)-1] ^= 0xff
+
+	// Enclaves can no longer be opened once the key is destroyed.
+	DestroyAll()
+	if _, err := Open(e); err != ErrDecryptionFailed {
+		t.Error("expected ErrDecryptionFailed; got", err)
+	}
+
+	if _, err := Seal(b); err != ErrDestroyed {
 		t.Error("expected ErrDestroyed")
 	}
 }
 
-func TestDuplicate(t *testing.T) {
-	b, _ := NewImmutableFromBytes([]byte("test"))
+func TestEnclaveChunks(t *testing.T) {
+	// Use small chunks so that there are plenty of them.
+	defer func(n int) { enclaveChunkSize = n }(enclaveChunkSize)
+	enclaveChunkSize = 16
 
-	c, err := Duplicate(b)
-	if err != nil {
-		t.Error("unexpected error")
+	for _, n := range []int{1, 15, 16, 17, 48, 100} {
+		b, _ := NewMutableRandom(n)
+		plaintext := make([]byte, n)
+		copy(plaintext, b.Buffer())
+
+		e, _ := Seal(b)
+		if e.Size() != n {
+			t.Error("unexpected size;", e.Size(), n)
+		}
+		c, err := Open(e)
+		if err != nil {
+			t.Error("unexpected error:", err)
+		} else if !bytes.Equal(c.Buffer(), plaintext) {
+			t.Error("unexpected value;", n)
+		}
+		c.Destroy()
 	}
-	if !bytes.Equal(b.Buffer(), c.Buffer()) {
-		t.Error("duplicated buffer has different contents")
+
+	a, _ := NewMutableFromBytes(bytes.Repeat([]byte("yellow submarine"), 3))
+	e, _ := Seal(a)
+
+	// Swapping two chunks should be detected.
+	ct := make([]byte, len(e.ciphertext))
+	copy(ct, e.ciphertext)
+	copy(e.ciphertext[12:44], ct[44:76])
+	copy(e.ciphertext[44:76], ct[12:44])
+	if _, err := Open(e); err != ErrDecryptionFailed {
+		t.Error("expected ErrDecryptionFailed; got", err)
 	}
-	if c.IsMutable() {
-		t.Error("permissions not copied")
+	copy(e.ciphertext, ct)
+
+	// So should dropping the last chunk.
+	truncated := &Enclave{ciphertext: e.ciphertext[:len(e.ciphertext)-32], chunkSize: e.chunkSize}
+	if truncated.Size() != 32 {
+		t.Error("unexpected size;", truncated.Size())
+	}
+	if _, err := Open(truncated); err != ErrDecryptionFailed {
+		t.Error("expected ErrDecryptionFailed; got", err)
 	}
-	b.Destroy()
-	c.Destroy()
 
-	if _, err := Duplicate(b); err != ErrDestroyed {
-		t.Error("expected ErrDestroyed")
+	// A malformed one shouldn't get anywhere.
+	if _, err := Open(&Enclave{ciphertext: e.ciphertext[:len(e.ciphertext)-20], chunkSize: e.chunkSize}); err != ErrDecryptionFailed {
+		t.Error("expected ErrDecryptionFailed; got", err)
 	}
 }
 
-func TestEqual(t *testing.T) {
-	b, _ := NewMutable(16)
-	c, _ := NewMutable(16)
+func TestOpenContext(t *testing.T) {
+	b, _ := NewMutableFromBytes([]byte("yellow submarine"))
+	e, _ := Seal(b)
 
-	equal, err := Equal(b, c)
+	c, err := OpenContext(context.Background(), e)
 	if err != nil {
-		t.Error("unexpected error")
+		t.Error("unexpected error:", err)
 	}
-	if !equal {
-		t.Error("should be equal")
+	if !bytes.Equal(c.Buffer(), []byte("yellow submarine")) {
+		t.Error("unexpected value;", c.Buffer())
 	}
+	c.Destroy()
 
-	a, _ := NewMutable(8)
-	equal, err = Equal(a, b)
-	if err != nil {
-		t.Error("unexpected error")
+	// A cancelled context stops it, without leaving anything behind.
+	active := ActiveBuffers()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := OpenContext(ctx, e); err != context.Canceled {
+		t.Error("expected context.Canceled; got", err)
 	}
-	if equal {
-		t.Error("should not be equal")
+	if ActiveBuffers() != active {
+		t.Error("partial plaintext left behind")
 	}
 
-	a.Destroy()
-	b.Destroy()
-	c.Destroy()
+	// Cancelling part of the way through destroys what was decrypted so far.
+	defer func(n int) { enclaveChunkSize = n }(enclaveChunkSize)
+	enclaveChunkSize = 4
+	b, _ = NewMutableFromBytes([]byte("yellow submarine"))
+	e, _ = Seal(b)
+	if _, err := OpenContext(&cancelAfter{context.Background(), 3}, e); err != context.Canceled {
+		t.Error("expected context.Canceled; got", err)
+	}
+	if ActiveBuffers() != active {
+		t.Error("partial plaintext left behind")
+	}
+}
 
-	if _, err := Equal(a, b); err != ErrDestroyed {
-		t.Error("expected ErrDestroyed")
+// cancelAfter is a context that is cancelled after Err has been called a given number of times.
+type cancelAfter struct {
+	context.Context
+	n int
+}
+
+func (c *cancelAfter) Err() error {
+	if c.n--; c.n < 0 {
+		return context.Canceled
 	}
+	return nil
 }
 
-func TestSplit(t *testing.T) {
-	a, _ := NewImmutableFromBytes([]byte("xxxxyyyy"))
+func TestStream(t *testing.T) {
+	// Use small frames so that there are plenty of them.
+	defer func(n int) { streamChunkSize = n }(streamChunkSize)
+	streamChunkSize = 16
+
+	key, _ := NewImmutableRandom(32)
+	defer key.Destroy()
+
+	encrypt := func(plaintext []byte) []byte {
+		var out bytes.Buffer
+		w, err := NewEncryptStream(key, &out)
+		if err != nil {
+			t.Error("unexpected error:", err)
+		}
+		// Write in awkwardly sized pieces.
+		for len(plaintext) > 0 {
+			n := 7
+			if n > len(plaintext) {
+				n = len(plaintext)
+			}
+			if m, err := w.Write(plaintext[:n]); m != n || err != nil {
+				t.Error("unexpected write;", m, err)
+			}
+			plaintext = plaintext[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Error("unexpected error:", err)
+		}
+		if _, err := w.Write([]byte("x")); err != ErrDestroyed {
+			t.Error("expected ErrDestroyed; got", err)
+		}
+		return out.Bytes()
+	}
+	decrypt := func(ciphertext []byte) ([]byte, error) {
+		r, err := NewDecryptStream(key, bytes.NewReader(ciphertext))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		var out bytes.Buffer
+		_, err = io.Copy(&out, iotest.OneByteReader(r))
+		return out.Bytes(), err
+	}
+
+	for _, n := range []int{0, 1, 15, 16, 17, 32, 100} {
+		plaintext := make([]byte, n)
+		fillRandBytes(plaintext)
+		ciphertext := encrypt(plaintext)
+		if len(ciphertext) != 12+n+16*(n/16+1) {
+			t.Error("unexpected length;", n, len(ciphertext))
+		}
+		if out, err := decrypt(ciphertext); err != nil || !bytes.Equal(out, plaintext) {
+			t.Error("unexpected output;", n, err)
+		}
+	}
+
+	ciphertext := encrypt(bytes.Repeat([]byte("yellow submarine"), 3))
+
+	// Each frame should be plain AES-GCM, matching crypto/aes.
+	block, _ := aes.NewCipher(key.Buffer())
+	ref, _ := cipher.NewGCM(block)
+	nonce, ad := make([]byte, 12), make([]byte, 9)
+	chunkParams(nonce, ad, ciphertext[:12], 0, false)
+	if frame, err := ref.Open(nil, nonce, ciphertext[12:44], ad); err != nil || string(frame) != "yellow submarine" {
+		t.Error("frame doesn't match crypto/aes;", err)
+	}
+
+	// Tampering, reordering, and truncation should all be detected.
+	tampered := append([]byte{}, ciphertext...)
+	tampered[20] ^= 1
+	swapped := append([]byte{}, ciphertext...)
+	copy(swapped[12:44], ciphertext[44:76])
+	copy(swapped[44:76], ciphertext[12:44])
+	for _, bad := range [][]byte{tampered, swapped, ciphertext[:len(ciphertext)-16], ciphertext[:len(ciphertext)-1], ciphertext[:44]} {
+		if _, err := decrypt(bad); err != ErrDecryptionFailed {
+			t.Error("expected ErrDecryptionFailed; got", err)
+		}
+	}
+	if _, err := decrypt(ciphertext[:8]); err != ErrDecryptionFailed {
+		t.Error("expected ErrDecryptionFailed; got", err)
+	}
+
+	// So should using the wrong key.
+	other, _ := NewImmutableRandom(32)
+	r, _ := NewDecryptStream(other, bytes.NewReader(ciphertext))
+	if _, err := r.Read(make([]byte, 16)); err != ErrDecryptionFailed {
+		t.Error("expected ErrDecryptionFailed; got", err)
+	}
+	r.Close()
+	other.Destroy()
+	if _, err := r.Read(make([]byte, 16)); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+
+	// Invalid keys.
+	short, _ := NewImmutableRandom(8)
+	if _, err := NewEncryptStream(short, &bytes.Buffer{}); err != ErrInvalidKeySize {
+		t.Error("expected ErrInvalidKeySize; got", err)
+	}
+	short.Destroy()
+	if _, err := NewDecryptStream(short, bytes.NewReader(ciphertext)); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+}
 
-	b, c, err := Split(a, 4)
+func TestEnclaveReader(t *testing.T) {
+	b, _ := NewMutableFromBytes([]byte("yellow submarine"))
+	e, _ := Seal(b)
+
+	r, err := e.Reader()
 	if err != nil {
-		t.Error("unexpected error")
+		t.Error("unexpected error:", err)
 	}
-	if !bytes.Equal(b.Buffer(), []byte("xxxx")) {
-		t.Error("first buffer has unexpected value")
+	er := r.(*enclaveReader)
+	if er.b != nil {
+		t.Error("expected decryption to be deferred")
 	}
-	if !bytes.Equal(c.Buffer(), []byte("yyyy")) {
-		t.Error("second buffer has unexpected value")
+
+	// Read part of the way through.
+	p := make([]byte, 6)
+	if n, err := io.ReadFull(r, p); n != 6 || err != nil || string(p) != "yellow" {
+		t.Error("unexpected read;", n, err, p)
 	}
-	if b.IsMutable() || c.IsMutable() {
-		t.Error("permissions not preserved")
+
+	// Closing early should still destroy the plaintext.
+	plaintext := er.b
+	if err := r.Close(); err != nil {
+		t.Error("unexpected error:", err)
 	}
-	if !bytes.Equal(a.Buffer(), []byte("xxxxyyyy")) {
-		t.Error("original is not preserved")
+	if !plaintext.IsDestroyed() {
+		t.Error("expected plaintext to be destroyed")
+	}
+	if _, err := r.Read(p); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed;", err)
 	}
 
-	b.Destroy()
-	c.Destroy()
+	// The whole stream, through io.Copy.
+	r, _ = e.Reader()
+	defer r.Close()
+	var out bytes.Buffer
+	if n, err := io.Copy(&out, r); n != 16 || err != nil || out.String() != "yellow submarine" {
+		t.Error("unexpected copy;", n, err, out.String())
+	}
 
-	if _, _, err := Split(a, 0); err != ErrInvalidLength {
-		t.Error("expected ErrInvalidLength")
+	// Closing without reading.
+	r, _ = e.Reader()
+	if err := r.Close(); err != nil {
+		t.Error("unexpected error:", err)
 	}
-	if _, _, err := Split(a, 8); err != ErrInvalidLength {
-		t.Error("expected ErrInvalidLength")
+	if _, err := r.Read(p); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed;", err)
 	}
 
-	a.Destroy()
-
-	if _, _, err := Split(a, 4); err != ErrDestroyed {
-		t.Error("expected ErrDestroyed")
+	// A malformed Enclave.
+	if _, err := (&Enclave{}).Reader(); err != ErrDecryptionFailed {
+		t.Error("expected ErrDecryptionFailed;", err)
 	}
 }
 
-func TestTrim(t *testing.T) {
-	b, _ := NewImmutableFromBytes([]byte("xxxxyyyy"))
+func TestEnclaveAppend(t *testing.T) {
+	a, _ := NewMutableFromBytes([]byte("yellow "))
+	e, _ := Seal(a)
 
-	c, err := Trim(b, 2, 4)
+	b, _ := NewMutableFromBytes([]byte("submarine"))
+	f, err := e.Append(b)
 	if err != nil {
-		t.Error("unexpected error")
+		t.Error("unexpected error:", err)
 	}
-
-	if !bytes.Equal(c.Buffer(), []byte("xxyy")) {
-		t.Error("unexpected value:", c.Buffer())
+	if !b.IsDestroyed() {
+		t.Error("expected appended LockedBuffer to be destroyed")
+	}
+	if f.Size() != 16 {
+		t.Error("unexpected size;", f.Size())
 	}
 
-	if c.IsMutable() {
-		t.Error("unexpected state")
+	c, _ := Open(f)
+	if !bytes.Equal(c.Buffer(), []byte("yellow submarine")) {
+		t.Error("unexpected value;", c.Buffer())
 	}
 	c.Destroy()
 
-	if _, err := Trim(b, 4, 0); err != ErrInvalidLength {
-		t.Error("expected ErrInvalidLength")
+	// The original should be unchanged.
+	c, _ = Open(e)
+	if !bytes.Equal(c.Buffer(), []byte("yellow ")) {
+		t.Error("unexpected value;", c.Buffer())
 	}
+	c.Destroy()
 
-	b.Destroy()
-
-	if _, err := Trim(b, 2, 4); err != ErrDestroyed {
+	if _, err := e.Append(b); err != ErrDestroyed {
 		t.Error("expected ErrDestroyed")
 	}
 }
 
-func TestWipeBytes(t *testing.T) {
-	// Create random byte slice.
-	b := make([]byte, 32)
-	fillRandBytes(b)
+func TestCheckpoint(t *testing.T) {
+	b, _ := NewMutableFromBytes([]byte("yellow submarine"))
 
-	// Wipe it.
-	WipeBytes(b)
+	// Taking a checkpoint should leave the LockedBuffer alone.
+	cp, err := Checkpoint(b)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if b.IsDestroyed() || string(b.Buffer()) != "yellow submarine" || cp.Size() != 16 {
+		t.Error("unexpected result;", cp.Size())
+	}
 
-	// Check.
-	if !bytes.Equal(b, make([]byte, 32)) {
-		t.Error("unsuccessful wipe")
+	// Changes should be rolled back, as many times as necessary.
+	for i := 0; i < 2; i++ {
+		b.Copy([]byte("orange"))
+		if err := Restore(b, cp); err != nil {
+			t.Error("unexpected error:", err)
+		}
+		if string(b.Buffer()) != "yellow submarine" {
+			t.Error("unexpected contents;", string(b.Buffer()))
+		}
 	}
 
-	// Try with empty list.
-	ebuf := make([]byte, 0)
-	WipeBytes(ebuf)
-	if len(ebuf) != 0 || cap(ebuf) != 0 {
-		t.Error("changes made to zero-sized slice")
+	// A tampered checkpoint shouldn't touch the LockedBuffer.
+	b.Copy([]byte("orange"))
+	cp.ciphertext[20] ^= 0xff
+	if err := Restore(b, cp); err != ErrDecryptionFailed {
+		t.Error("expected ErrDecryptionFailed; got", err)
 	}
-}
+	if string(b.Buffer()) != "orange submarine" {
+		t.Error("unexpected contents;", string(b.Buffer()))
+	}
+	cp.ciphertext[20] ^= 0xff
 
-func TestCatchInterrupt(t *testing.T) {
-	CatchInterrupt(func() {})
+	// Nor should one of a different length.
+	c, _ := NewMutable(8)
+	if err := Restore(c, cp); err != ErrLengthMismatch {
+		t.Error("expected ErrLengthMismatch; got", err)
+	}
+	c.Destroy()
 
-	var i int
-	for x := 0; x < 1024; x++ {
-		catchInterruptOnce.Do(func() {
-			i++
-		})
+	b.MakeImmutable()
+	if err := Restore(b, cp); err != ErrImmutable {
+		t.Error("expected ErrImmutable; got", err)
 	}
-	if i != 0 {
-		t.Error("sync.Once failed")
+	b.Destroy()
+
+	if err := Restore(b, cp); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+	if _, err := Checkpoint(b); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
 	}
 }
 
-func TestConcurrent(t *testing.T) {
-	var wg sync.WaitGroup
+func TestCoffer(t *testing.T) {
+	c, err := NewCoffer(0)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
 
-	b, _ := NewMutable(16)
-	for i := 0; i < 1024; i++ {
-		wg.Add(1)
-		go func() {
-			CatchInterrupt(func() {
-				return
-			})
+	// Seal a small secret and one that spans several chunks.
+	defer func(n int) { enclaveChunkSize = n }(enclaveChunkSize)
+	enclaveChunkSize = 8
+	small, _ := NewMutableFromBytes([]byte("yellow"))
+	large, _ := NewMutableFromBytes([]byte("yellow submarine"))
+	a, err := c.Seal(small)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	b, _ := c.Seal(large)
+	if !small.IsDestroyed() || !large.IsDestroyed() {
+		t.Error("expected originals to be destroyed")
+	}
 
-			b.MakeImmutable()
-			b.MakeMutable()
+	// They shouldn't be sealed with the usual key.
+	if _, err := Open(&Enclave{ciphertext: a.ciphertext, chunkSize: a.chunkSize}); err != ErrDecryptionFailed {
+		t.Error("expected ErrDecryptionFailed; got", err)
+	}
 
-			b.Move([]byte("Test"))
-			b.Copy([]byte("test"))
+	// Re-keying should change the ciphertext but not the plaintext.
+	key, before := c.key, append([]byte{}, b.ciphertext...)
+	if err := c.Rekey(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if !key.IsDestroyed() || c.key == key || bytes.Equal(before, b.ciphertext) {
+		t.Error("expected new key and ciphertext")
+	}
+	for e, want := range map[*Enclave]string{a: "yellow", b: "yellow submarine"} {
+		p, err := Open(e)
+		if err != nil {
+			t.Error("unexpected error:", err)
+			continue
+		}
+		if !bytes.Equal(p.Buffer(), []byte(want)) {
+			t.Error("unexpected contents;", p.Buffer())
+		}
+		p.Destroy()
+	}
 
-			b.FillRandomBytes()
+	// Appending should stay within the Coffer.
+	extra, _ := NewMutableFromBytes([]byte("!"))
+	d, err := b.Append(extra)
+	if err != nil || d.coffer != c {
+		t.Error("expected Enclave in the same Coffer;", err)
+	}
 
-			b.Wipe()
+	// Tampered Enclaves shouldn't stop the rest from being re-keyed.
+	a.ciphertext[len(a.ciphertext)-1] ^= 0xff
+	if err := c.Rekey(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if p, err := Open(d); err != nil || !bytes.Equal(p.Buffer(), []byte("yellow submarine!")) {
+		t.Error("unexpected result;", err)
+	} else {
+		p.Destroy()
+	}
 
-			wg.Done()
-		}()
+	// Discarding an Enclave.
+	c.Discard(b)
+	if len(c.enclaves) != 2 {
+		t.Error("expected Enclave to be removed;", len(c.enclaves))
+	}
+	if _, err := Open(b); err != ErrDecryptionFailed {
+		t.Error("expected ErrDecryptionFailed; got", err)
 	}
 
-	wg.Wait()
-	b.Destroy()
+	// Destroying it.
+	c.Destroy()
+	c.Destroy()
+	if _, err := Open(d); err != ErrDecryptionFailed {
+		t.Error("expected ErrDecryptionFailed; got", err)
+	}
+	if err := c.Rekey(); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+	e, _ := NewMutable(8)
+	if _, err := c.Seal(e); err != ErrDestroyed {
+		t.Error("expected ErrDestroyed; got", err)
+	}
+	e.Destroy()
 }
 
-func TestDisableUnixCoreDumps(t *testing.T) {
-	DisableUnixCoreDumps()
-}
+func TestCofferInterval(t *testing.T) {
+	c, _ := NewCoffer(time.Millisecond)
+	e, _ := NewMutableFromBytes([]byte("yellow submarine"))
+	x, _ := c.Seal(e)
 
-func TestRoundPage(t *testing.T) {
-	if roundToPageSize(pageSize) != pageSize {
-		t.Error("incorrect rounding;", roundToPageSize(pageSize))
+	// Wait for it to be re-keyed a few times.
+	c.Lock()
+	key := c.key
+	c.Unlock()
+	for i := 0; i < 1000; i++ {
+		time.Sleep(time.Millisecond)
+		if key.IsDestroyed() {
+			break
+		}
+	}
+	if !key.IsDestroyed() {
+		t.Error("expected key to be replaced")
+	}
+	if p, err := Open(x); err != nil || !bytes.Equal(p.Buffer(), []byte("yellow submarine")) {
+		t.Error("unexpected result;", err)
+	} else {
+		p.Destroy()
 	}
 
-	if roundToPageSize(pageSize+1) != 2*pageSize {
-		t.Error("incorrect rounding;", roundToPageSize(pageSize+1))
+	// The goroutine should stop once it's destroyed.
+	c.Destroy()
+	select {
+	case <-c.done:
+	default:
+		t.Error("expected goroutine to be stopped")
 	}
 }
 
-func TestGetBytes(t *testing.T) {
-	b := []byte("yellow submarine")
-
-	ptr := unsafe.Pointer(&b[0])
-	length := len(b)
-	bBytes := getBytes(uintptr(ptr), length)
-
-	copy(bBytes, []byte("fellow submarine"))
+func TestNewMutableBatch(t *testing.T) {
+	bufs, err := NewMutableBatch(32, 3)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if len(bufs) != 3 {
+		t.Error("unexpected count;", len(bufs))
+	}
+	bt := bufs[0].batch
+
+	// Each one should have its own canary and guard pages, sharing the ones in between.
+	for i, b := range bufs {
+		if b.batch != bt || !b.IsMutable() || !b.IsLocked() || b.Size() != 32 {
+			t.Error("unexpected state;", i)
+		}
+		if err := b.Verify(); err != nil {
+			t.Error("unexpected error:", err)
+		}
+		if &b.memory[0] != &bt.memory[i*2*pageSize] || len(b.memory) != 3*pageSize {
+			t.Error("unexpected layout;", i)
+		}
+		b.Copy([]byte("yellow submarine"))
+	}
+	if len(bt.memory) != 7*pageSize {
+		t.Error("unexpected length;", len(bt.memory))
+	}
+
+	// Guard pages should be inaccessible.
+	c := make(chan interface{})
+	go func() {
+		defer func() {
+			c <- recover()
+		}()
+		defer ReportGuardFault()
+		EnableGuardFaultReporting()
 
-	if !bytes.Equal(b, bBytes) {
-		t.Error("pointer does not describe actual memory")
+		bufs[0].buffer[0] = bufs[0].memory[2*pageSize]
+	}()
+	if v, ok := (<-c).(string); !ok || !strings.Contains(v, "guard page") {
+		t.Error("unexpected panic value;", v)
 	}
-}
 
-func TestFinalizer(t *testing.T) {
-	b, err := NewMutable(8)
-	if err != nil {
-		t.Error("unexpected error")
+	// They can be used independently, but not suspended or pooled.
+	bufs[1].MakeImmutable()
+	if err := bufs[1].Hide(); err != nil {
+		t.Error("unexpected error:", err)
 	}
-	ib := b.container
+	if err := bufs[2].Suspend(); err != ErrUnsupported {
+		t.Error("expected ErrUnsupported; got", err)
+	}
+	p := NewPool(4)
+	p.Put(bufs[2])
+	if !bufs[2].IsDestroyed() || len(p.idle[32]) != 0 {
+		t.Error("expected buffer to be destroyed instead of pooled")
+	}
+	p.Destroy()
 
-	c, err := NewImmutable(8)
-	if err != nil {
-		t.Error("unexpected error")
+	// The memory should only be freed along with the last one.
+	if bufs[2].batch != nil || bt.live != 2 {
+		t.Error("unexpected state;", bt.live)
+	}
+	bufs[0].Destroy()
+	if bt.live != 1 {
+		t.Error("unexpected state;", bt.live)
+	}
+	bufs[1].Reveal()
+	if !bytes.Equal(bufs[1].Buffer()[:16], []byte("yellow submarine")) {
+		t.Error("unexpected contents;", bufs[1].Buffer())
+	}
+	bufs[1].Destroy()
+	if bt.live != 0 {
+		t.Error("unexpected state;", bt.live)
 	}
-	ic := c.container
 
-	if ib.IsDestroyed() != false {
-		t.Error("expected b to not be destroyed")
+	if _, err := NewMutableBatch(0, 1); err != ErrInvalidLength {
+		t.Error("expected ErrInvalidLength; got", err)
 	}
-	if ic.IsDestroyed() != false {
-		t.Error("expected c to not be destroyed")
+	if _, err := NewMutableBatch(1, 0); err != ErrInvalidLength {
+		t.Error("expected ErrInvalidLength; got", err)
 	}
+	if _, err := NewMutableBatch(1, maxInt/2); err != ErrSizeTooLarge {
+		t.Error("expected ErrSizeTooLarge; got", err)
+	}
+}
 
-	runtime.KeepAlive(b)
-	// b is now unreachable
+func benchmarkNewSmall(b *testing.B) {
+	buffers := make([]*LockedBuffer, 64)
+	for i := 0; i < b.N; i++ {
+		for j := range buffers {
+			buffers[j], _ = NewMutable(32)
+		}
+		for _, buf := range buffers {
+			buf.Destroy()
+		}
+	}
+}
 
-	runtime.GC() // should collect b
-	for ib.IsDestroyed() != true {
-		runtime.Gosched()
+func BenchmarkNewSmall(b *testing.B) {
+	benchmarkNewSmall(b)
+}
+
+func BenchmarkNewSmallSlab(b *testing.B) {
+	EnableSlabAllocator(32)
+	defer EnableSlabAllocator(0)
+
+	benchmarkNewSmall(b)
+}
+
+func BenchmarkNewSmallBatch(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		buffers, _ := NewMutableBatch(32, 64)
+		for _, buf := range buffers {
+			buf.Destroy()
+		}
 	}
+}
 
-	if ic.IsDestroyed() != false {
-		t.Error("expected c to not be destroyed")
+func BenchmarkPool(b *testing.B) {
+	p := NewPool(64)
+	defer p.Destroy()
+
+	buffers := make([]*LockedBuffer, 64)
+	for i := 0; i < b.N; i++ {
+		for j := range buffers {
+			buffers[j], _ = p.Get(32)
+		}
+		for _, buf := range buffers {
+			p.Put(buf)
+		}
 	}
+}
 
-	runtime.KeepAlive(c)
-	// c is now unreachable
+func benchmarkRandomAccess(b *testing.B, buf *LockedBuffer) {
+	defer buf.Destroy()
 
-	runtime.GC() // should collect c
-	for ic.IsDestroyed() != true {
-		runtime.Gosched()
+	// Touch the buffer at page-sized strides in a random order, so that almost every access needs a new TLB entry.
+	data := buf.Buffer()
+	var x byte
+	for i := 0; i < b.N; i++ {
+		x ^= data[(i*7919*pageSize+i)%len(data)]
 	}
+	data[0] = x
+}
+
+func BenchmarkRandomAccess(b *testing.B) {
+	buf, _ := NewMutable(64 << 20)
+	benchmarkRandomAccess(b, buf)
+}
+
+func BenchmarkRandomAccessHugePages(b *testing.B) {
+	buf, _ := NewMutableHugePages(64 << 20)
+	benchmarkRandomAccess(b, buf)
 }
@@ -0,0 +1,49 @@
+package memguard
+
+/*
+Observer is notified of events in the lifecycle of LockedBuffers, so that they can be counted and exported as metrics, such as to a dashboard, without memguard having to depend on any particular metrics library. SetObserver is used to install one.
+
+The methods are called synchronously, sometimes while the mutex of the LockedBuffer involved is held, so they should be quick and must not call back into memguard. They may be called from many goroutines at once.
+*/
+type Observer interface {
+	// OnCreate is called when a new LockedBuffer of a given size is created.
+	OnCreate(size int)
+
+	// OnDestroy is called when a LockedBuffer of a given size is destroyed, or put back into a Pool.
+	OnDestroy(size int)
+
+	// OnCanaryViolation is called whenever the canary of a LockedBuffer is found to have been overwritten. This normally happens just before memguard panics.
+	OnCanaryViolation()
+
+	// OnLockFailure is called when memory could not be locked, after any retries, with the error from the last attempt. This is called even if the lock policy allows the LockedBuffer to be created anyway.
+	OnLockFailure(err error)
+}
+
+// noopObserver is the default Observer, which ignores everything.
+type noopObserver struct{}
+
+func (noopObserver) OnCreate(int)        {}
+func (noopObserver) OnDestroy(int)       {}
+func (noopObserver) OnCanaryViolation()  {}
+func (noopObserver) OnLockFailure(error) {}
+
+/*
+SetObserver installs an Observer to be notified of events from now on, replacing any that was installed before. Calling SetObserver with nil, which is the default, stops events from being reported.
+*/
+func SetObserver(o Observer) {
+	observerMutex.Lock()
+	defer observerMutex.Unlock()
+
+	if o == nil {
+		o = noopObserver{}
+	}
+	observer = o
+}
+
+// Get the Observer to notify of events.
+func getObserver() Observer {
+	observerMutex.Lock()
+	defer observerMutex.Unlock()
+
+	return observer
+}
@@ -0,0 +1,61 @@
+package memguard
+
+/*
+ReadPassword reads a line from a terminal, such as a password typed in at a prompt, with echo turned off, straight into a new mutable LockedBuffer. The input is read a byte at a time directly into protected memory, which is grown as needed, so it never passes through a regular slice or string on the way. The trailing newline is not included.
+
+The terminal is put back the way it was before the call returns, whether or not the read succeeded. Only echo is turned off, so line editing such as backspace still works as it normally would.
+
+If fd does not refer to a terminal, that error is returned. If the line is empty, the call will return an ErrInvalidLength. On platforms where this is not implemented, the call will return an ErrUnsupported.
+*/
+func ReadPassword(fd int) (*LockedBuffer, error) {
+	// Turn off echo, remembering how to turn it back on.
+	restore, err := disableEcho(fd)
+	if err != nil {
+		return nil, err
+	}
+	defer restore()
+
+	return readLine(fd)
+}
+
+// Read up to the end of a line from a file descriptor into a new LockedBuffer, without the line ending.
+func readLine(fd int) (*LockedBuffer, error) {
+	// Create a LockedBuffer to read into.
+	b, err := NewMutable(64)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read one byte at a time so that we never read past the end of the line.
+	var n int
+	for {
+		// Double the size whenever it fills up.
+		if n == len(b.buffer) {
+			bigger, err := Resize(b, 2*n)
+			if err != nil {
+				b.Destroy()
+				return nil, err
+			}
+			b = bigger
+		}
+
+		read, err := readFd(fd, b.buffer[n:n+1])
+		if err != nil {
+			b.Destroy()
+			return nil, err
+		}
+		if read == 0 || b.buffer[n] == '\n' {
+			break
+		}
+		n++
+	}
+
+	// Drop the carriage return that comes before the newline on some systems.
+	if n > 0 && b.buffer[n-1] == '\r' {
+		n--
+	}
+
+	// Move the line into a LockedBuffer of the right size.
+	defer b.Destroy()
+	return Trim(b, 0, n)
+}
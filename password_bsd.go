@@ -0,0 +1,11 @@
+// +build darwin freebsd openbsd
+
+package memguard
+
+import "golang.org/x/sys/unix"
+
+// Requests for getting and setting the state of a terminal.
+const (
+	ioctlGetTermios = unix.TIOCGETA
+	ioctlSetTermios = unix.TIOCSETA
+)
@@ -0,0 +1,11 @@
+// +build linux
+
+package memguard
+
+import "golang.org/x/sys/unix"
+
+// Requests for getting and setting the state of a terminal.
+const (
+	ioctlGetTermios = unix.TCGETS
+	ioctlSetTermios = unix.TCSETS
+)
@@ -0,0 +1,13 @@
+// +build !darwin,!freebsd,!linux,!openbsd,!windows
+
+package memguard
+
+// Reading from a terminal with echo turned off is not implemented on this platform.
+func disableEcho(fd int) (func() error, error) {
+	return nil, ErrUnsupported
+}
+
+// Never called, since disableEcho always fails.
+func readFd(fd int, p []byte) (int, error) {
+	return 0, ErrUnsupported
+}
@@ -0,0 +1,37 @@
+// +build darwin freebsd linux openbsd
+
+package memguard
+
+import "golang.org/x/sys/unix"
+
+// Turn off echo on a terminal, returning a function that restores its previous state.
+func disableEcho(fd int) (func() error, error) {
+	// Get the current state.
+	old, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return nil, err
+	}
+
+	// Turn off echo, but leave the line discipline and signals alone.
+	state := *old
+	state.Lflag &^= unix.ECHO
+	state.Lflag |= unix.ICANON | unix.ISIG
+	state.Iflag |= unix.ICRNL
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &state); err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		return unix.IoctlSetTermios(fd, ioctlSetTermios, old)
+	}, nil
+}
+
+// Read from a file descriptor, retrying if interrupted by a signal.
+func readFd(fd int, p []byte) (int, error) {
+	for {
+		n, err := unix.Read(fd, p)
+		if err != unix.EINTR {
+			return n, err
+		}
+	}
+}
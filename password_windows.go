@@ -0,0 +1,35 @@
+// +build windows
+
+package memguard
+
+import "golang.org/x/sys/windows"
+
+// Turn off echo on a console, returning a function that restores its previous state.
+func disableEcho(fd int) (func() error, error) {
+	// Get the current state.
+	var old uint32
+	if err := windows.GetConsoleMode(windows.Handle(fd), &old); err != nil {
+		return nil, err
+	}
+
+	// Turn off echo, but leave line input and Ctrl+C handling on.
+	state := old &^ windows.ENABLE_ECHO_INPUT
+	state |= windows.ENABLE_PROCESSED_INPUT | windows.ENABLE_LINE_INPUT
+	if err := windows.SetConsoleMode(windows.Handle(fd), state); err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		return windows.SetConsoleMode(windows.Handle(fd), old)
+	}, nil
+}
+
+// Read from a file handle, treating a closed pipe as the end of the input.
+func readFd(fd int, p []byte) (int, error) {
+	var n uint32
+	err := windows.ReadFile(windows.Handle(fd), p, &n, nil)
+	if err == windows.ERROR_BROKEN_PIPE {
+		return 0, nil
+	}
+	return int(n), err
+}
@@ -0,0 +1,134 @@
+package memguard
+
+import "sync"
+
+/*
+Pool keeps hold of the memory of LockedBuffers that are no longer needed so that it can be handed out again, which avoids the system calls involved in allocating, protecting, locking, and freeing memory for every LockedBuffer. This makes a big difference when lots of short-lived LockedBuffers of the same size are needed, such as per-request session keys.
+
+Memory is only ever reused for LockedBuffers of exactly the same size. It is wiped when it is put back into the Pool, and the canary is rewritten when it is handed out again, so a LockedBuffer that comes from a Pool is indistinguishable from a freshly allocated one. While memory is sitting in a Pool it remains locked, but it is not counted as an active LockedBuffer.
+*/
+type Pool struct {
+	sync.Mutex // Local mutex lock.
+
+	capacity int                  // Largest number of idle LockedBuffers kept for each size.
+	idle     map[int][]*container // Wiped containers waiting to be reused, by size.
+}
+
+/*
+NewPool creates a Pool that keeps up to capacity idle LockedBuffers of each size. LockedBuffers that are put back when the Pool is already full are destroyed instead.
+*/
+func NewPool(capacity int) *Pool {
+	return &Pool{capacity: capacity, idle: make(map[int][]*container)}
+}
+
+/*
+Get returns a new, mutable LockedBuffer of a specified size, filled with zeroes. If the Pool has an idle LockedBuffer of that size then its memory is reused, and otherwise the call is identical to NewMutable.
+*/
+func (p *Pool) Get(size int) (*LockedBuffer, error) {
+	// Get a mutex lock on the Pool and take an idle container if there is one.
+	p.Lock()
+	var b *container
+	if n := len(p.idle[size]); n > 0 {
+		b = p.idle[size][n-1]
+		p.idle[size] = p.idle[size][:n-1]
+	}
+	p.Unlock()
+
+	// Allocate a new one if there wasn't.
+	if b == nil {
+		return NewMutable(size)
+	}
+
+	// Rewrite the canary, since it will have been wiped along with everything else.
+	fillCanary(b.inner[len(b.inner)-size-b.canaryLen:len(b.inner)-size], b.canaryRef)
+
+	// Start keeping track of it.
+	lb := &LockedBuffer{b, new(littleBird)}
+	track(lb)
+
+	return lb, nil
+}
+
+/*
+Put gives a LockedBuffer back to the Pool once it is no longer needed. The LockedBuffer is left in exactly the same state as if Destroy had been called on it, and its canary is verified in the same way, but its memory is kept around to be handed out again by Get.
+
+If the Pool is full, or the LockedBuffer has already been destroyed, the call is identical to calling Destroy.
+*/
+func (p *Pool) Put(b *LockedBuffer) {
+	// Get a mutex lock on this LockedBuffer.
+	b.Lock()
+	defer b.Unlock()
+
+	// Check if it's destroyed.
+	if len(b.buffer) == 0 {
+		return
+	}
+
+	// Check if there is room for it, and that the memory is ours to reuse and still locked.
+	p.Lock()
+	defer p.Unlock()
+	if len(p.idle[len(b.buffer)]) >= p.capacity || b.foreign || b.suspended || b.batch != nil {
+		b.destroy()
+		return
+	}
+
+	// Make the memory readable so that the canary can be checked, and writable so that it can be wiped.
+	if b.slab == nil {
+		protectMemory(b.alloc, b.inner, true, true)
+	}
+
+	// Verify the canary.
+	if !canaryIntact(b.container) {
+		safePanic("memguard.Pool.Put(): buffer overflow detected")
+	}
+
+	// Stop keeping track of it.
+	untrack(b.container)
+	if b.ttl != nil {
+		b.ttl.Stop()
+		b.ttl = nil
+	}
+
+	// Wipe the memory, and then move it into a new container that the old LockedBuffer knows nothing about.
+	wipeSecret(b.inner)
+	verifyWiped(b.inner)
+	p.idle[len(b.buffer)] = append(p.idle[len(b.buffer)], &container{
+		buffer:    b.buffer,
+		memory:    b.memory,
+		inner:     b.inner,
+		slab:      b.slab,
+		huge:      b.huge,
+		guardLen:  b.guardLen,
+		alloc:     b.alloc,
+		canaryLen: b.canaryLen,
+		canaryRef: b.canaryRef,
+		mutable:   true,
+		locked:    b.locked,
+	})
+
+	// Set the metadata of the old one appropriately.
+	b.buffer, b.memory, b.inner, b.slab = nil, nil, nil, nil
+	b.mutable = false
+	b.hidden = false
+	b.locked = false
+}
+
+/*
+Destroy frees the memory of all of the idle LockedBuffers in the Pool. The Pool can still be used afterwards.
+*/
+func (p *Pool) Destroy() {
+	// Get a mutex lock on the Pool.
+	p.Lock()
+	defer p.Unlock()
+
+	for size, containers := range p.idle {
+		for _, b := range containers {
+			// Put the canary back so that destroy is happy.
+			fillCanary(b.inner[len(b.inner)-size-b.canaryLen:len(b.inner)-size], b.canaryRef)
+			b.Lock()
+			b.destroy()
+			b.Unlock()
+		}
+		delete(p.idle, size)
+	}
+}
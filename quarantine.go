@@ -0,0 +1,103 @@
+package memguard
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// How long the memory of a destroyed LockedBuffer is kept inaccessible before it is freed, or zero if it is freed straight away.
+	quarantineDuration time.Duration
+
+	// Memory that is waiting to be freed, and associated mutex.
+	quarantined      []*quarantine
+	quarantinedMutex = &sync.Mutex{}
+)
+
+// quarantine is the memory of a destroyed LockedBuffer that has been wiped and made inaccessible, and is waiting to be freed.
+type quarantine struct {
+	memory []byte               // All of the memory, including the guard pages.
+	free   func(b []byte) error // Function that frees the memory.
+	timer  *time.Timer          // Timer that frees it when the quarantine period is over.
+}
+
+/*
+SetQuarantine sets whether the memory of destroyed LockedBuffers is kept around, inaccessible, for a while before it is given back to the system. Without this, a slice that was taken from a LockedBuffer before it was destroyed points at memory that has been freed, and using it might read or write whatever has been allocated there since, or crash, depending on timing. With it, any use of such a slice during the quarantine period crashes with a SIGSEGV memory violation, the same as touching a guard page, so that bugs where memory is accessed after it has been freed are caught reliably.
+
+The memory is always wiped and unlocked when the LockedBuffer is destroyed, so nothing is left behind, and it no longer counts towards the limit on locked memory. It does still take up address space until it is freed.
+
+Only LockedBuffers with pages of their own are quarantined. Those carved out of a slab, or created by NewMutableBatch or NewFromMmap, are freed in the usual way. Calling SetQuarantine with enabled set to false, or with a duration that isn't positive, disables quarantine and frees everything that is waiting straight away. It is disabled by default.
+*/
+func SetQuarantine(enabled bool, duration time.Duration) {
+	// Get a mutex lock on the quarantine.
+	quarantinedMutex.Lock()
+
+	// Update the settings, and keep going only if quarantine was disabled.
+	if enabled && duration > 0 {
+		quarantineDuration = duration
+		quarantinedMutex.Unlock()
+		return
+	}
+	quarantineDuration = 0
+
+	// Take everything that is waiting, so that the timers find nothing to do if they go off.
+	waiting := quarantined
+	quarantined = nil
+	quarantinedMutex.Unlock()
+
+	// Free it all.
+	for _, q := range waiting {
+		q.timer.Stop()
+		if err := q.free(q.memory); err != nil {
+			safePanic(err)
+		}
+	}
+}
+
+// Make the memory of a destroyed LockedBuffer inaccessible and free it once the quarantine period is over, or free it straight away if quarantine is disabled.
+func quarantineMemory(a Allocator, memory []byte, free func(b []byte) error) error {
+	// Check if quarantine is enabled.
+	quarantinedMutex.Lock()
+	duration := quarantineDuration
+	quarantinedMutex.Unlock()
+	if duration <= 0 {
+		return free(memory)
+	}
+
+	// Make the memory inaccessible, freeing it straight away if we can't.
+	if err := a.Protect(memory, false, false); err != nil {
+		free(memory)
+		return err
+	}
+
+	// Add it to the quarantine, and set a timer to free it.
+	q := &quarantine{memory: memory, free: free}
+	quarantinedMutex.Lock()
+	quarantined = append(quarantined, q)
+	q.timer = time.AfterFunc(duration, q.release)
+	quarantinedMutex.Unlock()
+
+	return nil
+}
+
+// Take the memory out of the quarantine and free it, unless that has been done already.
+func (q *quarantine) release() {
+	// Remove it from the quarantine.
+	quarantinedMutex.Lock()
+	found := false
+	for i, v := range quarantined {
+		if v == q {
+			quarantined = append(quarantined[:i], quarantined[i+1:]...)
+			found = true
+			break
+		}
+	}
+	quarantinedMutex.Unlock()
+
+	// Free it, if nobody else has.
+	if found {
+		if err := q.free(q.memory); err != nil {
+			safePanic(err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package memguard
+
+import "sync"
+
+/*
+ScratchBuffer holds a single-use secret, such as a one-time token, in a LockedBuffer that can be read exactly once. Consume copies the secret out and destroys the LockedBuffer in the same step, so single use is enforced by the type rather than by convention, and the secret doesn't linger in protected memory after it has been used.
+*/
+type ScratchBuffer struct {
+	sync.Mutex // Local mutex lock.
+
+	b        *LockedBuffer // The contents.
+	consumed bool          // Has Consume been called successfully?
+}
+
+/*
+NewScratchBuffer creates a ScratchBuffer that takes ownership of a LockedBuffer. The LockedBuffer must not be used directly afterwards, since it is destroyed once the ScratchBuffer has been consumed.
+
+If the LockedBuffer has been destroyed, the call will return an ErrDestroyed.
+*/
+func NewScratchBuffer(b *LockedBuffer) (*ScratchBuffer, error) {
+	if b.IsDestroyed() {
+		return nil, ErrDestroyed
+	}
+
+	return &ScratchBuffer{b: b}, nil
+}
+
+/*
+Size returns the length of the secret in bytes, or zero if it has been consumed or destroyed.
+*/
+func (s *ScratchBuffer) Size() int {
+	return s.b.Size()
+}
+
+/*
+Consume copies the secret into dst, returning the number of bytes copied, and then destroys the LockedBuffer that was holding it. Just as with CopyOut, dst is not protected in any way and should be wiped with WipeBytes as soon as possible, and the copy counts towards ExposureCount.
+
+If the ScratchBuffer has already been consumed, the call will return an ErrConsumed, even if it was called at the same time from another goroutine. If it was destroyed without being consumed, the call will return an ErrDestroyed. If dst is too short to hold the whole secret, the call will return an ErrOutOfRange and the ScratchBuffer is left as it is.
+*/
+func (s *ScratchBuffer) Consume(dst []byte) (int, error) {
+	// Get a mutex lock on the ScratchBuffer.
+	s.Lock()
+	defer s.Unlock()
+
+	// Check if it's been used up.
+	if s.consumed {
+		return 0, ErrConsumed
+	}
+
+	// Check that it all fits.
+	if len(dst) < s.b.Size() {
+		return 0, ErrOutOfRange
+	}
+
+	// Copy it out, and then get rid of it.
+	n, err := s.b.CopyOut(dst)
+	if err != nil {
+		return 0, err
+	}
+	s.b.Destroy()
+	s.consumed = true
+
+	return n, nil
+}
+
+/*
+Destroy wipes and frees the protected memory holding the secret without it being read. If the ScratchBuffer has already been consumed or destroyed then the call makes no changes.
+*/
+func (s *ScratchBuffer) Destroy() {
+	s.b.Destroy()
+}
@@ -0,0 +1,81 @@
+package memguard
+
+import (
+	"io"
+	"unsafe"
+)
+
+/*
+SecureString holds a textual secret, such as a password or an API token, in an immutable LockedBuffer, and provides the handful of operations that are usually needed on one without ever turning it back into a regular string.
+
+When printed with the fmt package, a SecureString always shows up as redacted.
+*/
+type SecureString struct {
+	b *LockedBuffer // The contents.
+}
+
+/*
+NewSecureString creates a SecureString holding a copy of a given string. Go strings can't normally be changed, but the bytes behind s are wiped afterwards where that is possible, which it is for any string that was built at runtime, such as one read from a file or decoded from a request. String constants are compiled into read-only memory, so they are left alone; they are visible in the program binary anyway.
+
+If s is empty, the call will return an ErrInvalidLength.
+*/
+func NewSecureString(s string) (*SecureString, error) {
+	b, err := NewImmutableFromString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SecureString{b}, nil
+}
+
+/*
+Len returns the length of the secret in bytes, or zero if it has been destroyed.
+*/
+func (s *SecureString) Len() int {
+	return s.b.Size()
+}
+
+/*
+EqualString compares the secret to a given string in constant time, without revealing the length of the secret through timing. If the SecureString has been destroyed, the result is false.
+*/
+func (s *SecureString) EqualString(v string) bool {
+	// Refer to the bytes of the string directly rather than copying them.
+	var buf []byte
+	if len(v) > 0 {
+		buf = getBytes(*(*uintptr)(unsafe.Pointer(&v)), len(v))
+	}
+
+	equal, err := s.b.EqualBytes(buf)
+	return err == nil && equal
+}
+
+/*
+Reader returns an io.Reader that reads the secret straight out of protected memory, for passing it on to something like the standard input of a subprocess. Reading after the SecureString has been destroyed returns an ErrDestroyed.
+*/
+func (s *SecureString) Reader() io.Reader {
+	return NewReader(s.b)
+}
+
+/*
+Destroy wipes and frees the protected memory holding the secret. If the SecureString has already been destroyed then the call makes no changes.
+*/
+func (s *SecureString) Destroy() {
+	s.b.Destroy()
+}
+
+/*
+String implements the fmt.Stringer interface, always returning a placeholder instead of the secret.
+*/
+func (s *SecureString) String() string {
+	if s.b.IsDestroyed() {
+		return "<memguard::SecureString destroyed>"
+	}
+	return "<memguard::SecureString redacted>"
+}
+
+/*
+GoString implements the fmt.GoStringer interface, so that printing a SecureString with %#v is redacted too.
+*/
+func (s *SecureString) GoString() string {
+	return s.String()
+}
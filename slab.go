@@ -0,0 +1,157 @@
+package memguard
+
+import "sync"
+
+var (
+	// Largest LockedBuffer that is carved out of a slab, or zero if slabs are disabled.
+	slabMaxObjSize int
+
+	// Array of all slabs that hold at least one LockedBuffer, and associated mutex.
+	allSlabs      []*slab
+	allSlabsMutex = &sync.Mutex{}
+)
+
+// slab is a single locked region, surrounded by guard pages, that is divided into equally-sized slots which each hold a small LockedBuffer.
+type slab struct {
+	memory   []byte    // All of the slab's memory, including the guard pages.
+	inner    []byte    // The locked pages between the guard pages.
+	alloc    Allocator // The Allocator that the memory came from.
+	slotSize int       // Length of each slot, including room for the canary.
+	locked   bool      // Is the memory locked into RAM?
+	free     []int     // Indices of the slots that are not in use.
+}
+
+/*
+EnableSlabAllocator makes memguard carve new mutable LockedBuffers of up to maxObjSize bytes out of shared slabs instead of giving each one its own pages. Every slab is a single locked region with guard pages at either end, so creating and destroying lots of small LockedBuffers takes far fewer system calls and far less locked memory.
+
+Each LockedBuffer in a slab still has its own canary, which Destroy and Verify check as usual, and is still wiped when it is destroyed. A slab is freed as soon as the last LockedBuffer in it is destroyed.
+
+Since LockedBuffers in a slab share pages, the kernel cannot protect them individually, so calling MakeImmutable or Hide on them returns an ErrUnsupported. Immutable LockedBuffers are always given pages of their own.
+
+Calling EnableSlabAllocator with a value less than one disables slabs again. Existing LockedBuffers are not affected by either call.
+*/
+func EnableSlabAllocator(maxObjSize int) {
+	allSlabsMutex.Lock()
+	defer allSlabsMutex.Unlock()
+
+	if maxObjSize < 0 {
+		maxObjSize = 0
+	}
+	slabMaxObjSize = maxObjSize
+}
+
+// Find a free slot big enough for a LockedBuffer of a given size and its canary, creating a new slab if necessary. If slabs are disabled or the size is too large, nil is returned.
+func slabAlloc(a Allocator, size, canaryLen, guardLen int) (*slab, []byte, error) {
+	// Get a mutex lock on allSlabs.
+	allSlabsMutex.Lock()
+
+	// Check if this size should come from a slab at all.
+	if size > slabMaxObjSize {
+		allSlabsMutex.Unlock()
+		return nil, nil, nil
+	}
+
+	// Round the slot size to keep the slots aligned.
+	slotSize := (slabMaxObjSize + canaryLen + 15) &^ 15
+
+	// Look for an existing slab from the same Allocator with room to spare, only using one that isn't locked if that's allowed.
+	required := getLockPolicy() == LockRequired
+	for _, s := range allSlabs {
+		if s.alloc == a && s.slotSize == slotSize && len(s.free) > 0 && (s.locked || !required) {
+			slot := s.take()
+			allSlabsMutex.Unlock()
+			return s, slot, nil
+		}
+	}
+
+	// Let go of the mutex while creating a new slab, so that slabs can still be freed while we wait to lock its memory.
+	allSlabsMutex.Unlock()
+
+	// Calculate the size of the locked region, filling the pages with as many slots as will fit.
+	roundedLength := roundToPageSize(slotSize)
+
+	// Allocate it all.
+	memory, err := a.Alloc((2 * guardLen) + roundedLength)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Make the guard pages inaccessible.
+	protectMemory(a, memory[:guardLen], false, false)
+	protectMemory(a, memory[guardLen+roundedLength:], false, false)
+
+	// Lock the pages that will hold the sensitive data, releasing everything if we can't.
+	locked, err := lockMemory(a, memory[guardLen:guardLen+roundedLength])
+	if err != nil {
+		freeMemory(a, memory)
+		return nil, nil, err
+	}
+
+	// Keep them out of core dumps, and out of forked children, too.
+	if err := dontDump(a, memory[guardLen:guardLen+roundedLength]); err != nil {
+		if locked {
+			unlockMemory(a, memory[guardLen:guardLen+roundedLength])
+		}
+		freeMemory(a, memory)
+		return nil, nil, err
+	}
+
+	// Set up the slab with all of its slots free.
+	s := &slab{memory: memory, inner: memory[guardLen : guardLen+roundedLength], alloc: a, slotSize: slotSize, locked: locked}
+	for i := roundedLength/slotSize - 1; i >= 0; i-- {
+		s.free = append(s.free, i)
+	}
+	slot := s.take()
+
+	// Start keeping track of it.
+	allSlabsMutex.Lock()
+	allSlabs = append(allSlabs, s)
+	allSlabsMutex.Unlock()
+
+	return s, slot, nil
+}
+
+// Take a free slot from the slab. The caller must hold allSlabsMutex.
+func (s *slab) take() []byte {
+	i := s.free[len(s.free)-1]
+	s.free = s.free[:len(s.free)-1]
+	return s.inner[i*s.slotSize : (i+1)*s.slotSize]
+}
+
+// Return a wiped slot to its slab, freeing the slab if it is no longer in use. The first error from freeing it is returned.
+func (s *slab) release(slot []byte) error {
+	// Get a mutex lock on allSlabs.
+	allSlabsMutex.Lock()
+	defer allSlabsMutex.Unlock()
+
+	// Work out which slot this is and mark it as free.
+	s.free = append(s.free, (cap(s.inner)-cap(slot))/s.slotSize)
+
+	// Keep the slab around while something is still using it.
+	if len(s.free) < len(s.inner)/s.slotSize {
+		return nil
+	}
+
+	// Remove it from the list of slabs.
+	for i, v := range allSlabs {
+		if v == s {
+			allSlabs = append(allSlabs[:i], allSlabs[i+1:]...)
+			break
+		}
+	}
+
+	// Wipe, unlock, and free all of its memory, carrying on as far as we can if something fails.
+	err := s.alloc.Protect(s.memory, true, true)
+	if err == nil {
+		wipeBytes(s.inner)
+	}
+	if s.locked {
+		if e := tryUnlockMemory(s.alloc, s.inner); err == nil {
+			err = e
+		}
+	}
+	if e := s.alloc.Free(s.memory); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,249 @@
+package memguard
+
+import (
+	"crypto/cipher"
+	"io"
+)
+
+// Length of the plaintext sealed into each frame of a stream, except for the last.
+var streamChunkSize = 64 * 1024
+
+/*
+NewEncryptStream returns an io.WriteCloser that encrypts everything written to it under a key held in a LockedBuffer, writing the result to dst. This allows something like a large file to be encrypted without the key ever leaving protected memory.
+
+The key must be 16, 24, or 32 bytes long, selecting AES-128, AES-192, or AES-256 respectively, and it is used with GCM. The key is expanded into an AESBlock, so the LockedBuffer itself is not referenced and may be destroyed once this call returns, and since AESBlock is constant-time the key can't be recovered through cache timing. Plaintext waiting to be encrypted is also kept in a LockedBuffer. Note that GCM derives an authentication key from the cipher, which it keeps in regular memory.
+
+The stream starts with a random nonce, followed by the plaintext sealed in frames of 64 KiB. Each frame is bound to its position and to whether it is the last, so frames cannot be reordered, dropped, or truncated without NewDecryptStream noticing. Close must be called to write the final frame; it also destroys the expanded key. Writing after Close returns an ErrDestroyed.
+
+If the key is not a valid size, the call will return an ErrInvalidKeySize. If it has been destroyed, the call will return an ErrDestroyed. If the nonce could not be written to dst, that error is returned.
+*/
+func NewEncryptStream(key *LockedBuffer, dst io.Writer) (io.WriteCloser, error) {
+	// Set up the cipher.
+	block, aead, err := newStreamCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a LockedBuffer to collect the plaintext of each frame in.
+	buf, err := NewMutable(streamChunkSize)
+	if err != nil {
+		block.Destroy()
+		return nil, err
+	}
+
+	// Generate a random nonce and write it out as the header.
+	s := &encryptStream{block: block, aead: aead, dst: dst, buf: buf, base: make([]byte, 12)}
+	fillRandBytes(s.base)
+	if _, err := dst.Write(s.base); err != nil {
+		s.destroy()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// encryptStream implements the io.WriteCloser returned by NewEncryptStream.
+type encryptStream struct {
+	block *AESBlock     // The expanded key.
+	aead  cipher.AEAD   // GCM on top of the expanded key.
+	dst   io.Writer     // Where the ciphertext goes.
+	buf   *LockedBuffer // Plaintext of the current frame.
+	n     int           // Length of the plaintext in buf.
+	base  []byte        // Nonce that the nonce of each frame is derived from.
+	index int           // Index of the current frame.
+	ct    []byte        // Scratch space for the ciphertext of a frame.
+	err   error         // Error that stopped the stream, if any.
+}
+
+func (s *encryptStream) Write(p []byte) (int, error) {
+	// Check if it's been closed, or has failed.
+	if s.buf.IsDestroyed() {
+		return 0, ErrDestroyed
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	var written int
+	for len(p) > 0 {
+		// Add as much as fits to the current frame.
+		n := copy(s.buf.buffer[s.n:], p)
+		s.n += n
+		written += n
+		p = p[n:]
+
+		// Seal it as soon as it's full. The last frame is always shorter, even if that means that it's empty.
+		if s.n == len(s.buf.buffer) {
+			if err := s.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+func (s *encryptStream) Close() error {
+	// Check if it's been closed already.
+	if s.buf.IsDestroyed() {
+		return nil
+	}
+	defer s.destroy()
+
+	// Write the last frame.
+	if s.err != nil {
+		return s.err
+	}
+	return s.seal(true)
+}
+
+// Seal the current frame, write it out, and wipe the plaintext.
+func (s *encryptStream) seal(last bool) error {
+	nonce, ad := make([]byte, 12), make([]byte, 9)
+	chunkParams(nonce, ad, s.base, s.index, last)
+	s.ct = s.aead.Seal(s.ct[:0], nonce, s.buf.buffer[:s.n], ad)
+	wipeBytes(s.buf.buffer[:s.n])
+	s.n = 0
+	s.index++
+
+	if _, err := s.dst.Write(s.ct); err != nil {
+		s.err = err
+		return err
+	}
+	return nil
+}
+
+// Destroy the expanded key and any plaintext.
+func (s *encryptStream) destroy() {
+	s.buf.Destroy()
+	s.block.Destroy()
+}
+
+/*
+NewDecryptStream returns an io.ReadCloser that decrypts a stream written by NewEncryptStream from src, using the same key. Each frame is authenticated before any of its plaintext is returned, and the plaintext of the current frame is kept in a LockedBuffer until it has been read.
+
+If the stream has been tampered with, including by reordering, dropping, or truncating frames, Read returns an ErrDecryptionFailed once it gets to the affected frame, and it keeps returning it after that. Close destroys the expanded key and any plaintext that has not been read yet, so callers should always defer a call to Close. Reading after Close returns an ErrDestroyed.
+
+If the key is not a valid size, the call will return an ErrInvalidKeySize. If it has been destroyed, the call will return an ErrDestroyed. If the nonce at the start of the stream could not be read, the call will return an ErrDecryptionFailed, or the error from src if it was something other than running out of data.
+*/
+func NewDecryptStream(key *LockedBuffer, src io.Reader) (io.ReadCloser, error) {
+	// Set up the cipher.
+	block, aead, err := newStreamCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a LockedBuffer to decrypt each frame into.
+	buf, err := NewMutable(streamChunkSize)
+	if err != nil {
+		block.Destroy()
+		return nil, err
+	}
+	s := &decryptStream{block: block, aead: aead, src: src, buf: buf, base: make([]byte, 12), ct: make([]byte, streamChunkSize+16)}
+
+	// Read the header.
+	if _, err := io.ReadFull(src, s.base); err != nil {
+		s.destroy()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrDecryptionFailed
+		}
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// decryptStream implements the io.ReadCloser returned by NewDecryptStream.
+type decryptStream struct {
+	block *AESBlock     // The expanded key.
+	aead  cipher.AEAD   // GCM on top of the expanded key.
+	src   io.Reader     // Where the ciphertext comes from.
+	buf   *LockedBuffer // Plaintext of the current frame.
+	r, w  int           // Unread part of the plaintext in buf.
+	base  []byte        // Nonce that the nonce of each frame is derived from.
+	index int           // Index of the next frame.
+	ct    []byte        // Scratch space for the ciphertext of a frame.
+	done  bool          // Has the last frame been decrypted?
+	err   error         // Error that stopped the stream, if any.
+}
+
+func (s *decryptStream) Read(p []byte) (int, error) {
+	// Check if it's been closed.
+	if s.buf.IsDestroyed() {
+		return 0, ErrDestroyed
+	}
+
+	for {
+		// Hand out whatever is left of the current frame, wiping it as we go.
+		if s.r < s.w {
+			n := copy(p, s.buf.buffer[s.r:s.w])
+			wipeBytes(s.buf.buffer[s.r : s.r+n])
+			s.r += n
+			return n, nil
+		}
+
+		// Check if we've finished, or have failed.
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.done {
+			return 0, io.EOF
+		}
+
+		// Decrypt the next frame.
+		s.err = s.open()
+	}
+}
+
+func (s *decryptStream) Close() error {
+	s.destroy()
+	return nil
+}
+
+// Read and decrypt the next frame into buf.
+func (s *decryptStream) open() error {
+	// Only the last frame is shorter than a full frame.
+	n, err := io.ReadFull(s.src, s.ct)
+	last := err == io.ErrUnexpectedEOF
+	if err == io.EOF || (last && n < 16) {
+		return ErrDecryptionFailed
+	}
+	if err != nil && !last {
+		return err
+	}
+
+	// Decrypt straight into the protected memory.
+	nonce, ad := make([]byte, 12), make([]byte, 9)
+	chunkParams(nonce, ad, s.base, s.index, last)
+	plaintext, err := s.aead.Open(s.buf.buffer[:0], nonce, s.ct[:n], ad)
+	if err != nil {
+		return ErrDecryptionFailed
+	}
+	s.r, s.w = 0, len(plaintext)
+	s.index++
+	s.done = last
+
+	return nil
+}
+
+// Destroy the expanded key and any plaintext.
+func (s *decryptStream) destroy() {
+	s.buf.Destroy()
+	s.block.Destroy()
+}
+
+// Expand a key held in a LockedBuffer and set up GCM on top of it.
+func newStreamCipher(key *LockedBuffer) (*AESBlock, cipher.AEAD, error) {
+	block, err := NewAESBlock(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		block.Destroy()
+		return nil, nil, err
+	}
+
+	return block, aead, nil
+}
@@ -0,0 +1,94 @@
+package memguard
+
+import "sync/atomic"
+
+/*
+WipeStrategy decides how the memory of LockedBuffers is overwritten when they are destroyed or wiped with Wipe or WipeAt, for compliance regimes that mandate particular overwrite patterns. SetWipeStrategy is used to choose one.
+
+Whatever the strategy, memguard always finishes with a pass of zeroes of its own that is guaranteed not to be optimised away, so wiped memory always reads back as zero. A single pass of zeroes, which is what ZeroWipe does, is all that volatile memory needs: unlike the magnetic media that multi-pass schemes were designed for, RAM keeps no trace of what it held before it was overwritten. The other strategies are provided for when a policy asks for them anyway.
+*/
+type WipeStrategy interface {
+	// Wipe overwrites the contents of a slice.
+	Wipe(b []byte)
+}
+
+// ZeroWipe overwrites memory with zeroes, in a single pass. This is the default.
+var ZeroWipe WipeStrategy = zeroWipe{}
+
+// RandomWipe overwrites memory with cryptographically-secure random bytes, before the final pass of zeroes.
+var RandomWipe WipeStrategy = randomWipe{}
+
+/*
+MultiPassWipe returns a WipeStrategy that overwrites memory once with each of a number of patterns in turn, before the final pass of zeroes. Each pattern is repeated as many times as is needed to cover the memory, and a nil pattern stands for a pass of random bytes, so the three passes of DoD 5220.22-M are MultiPassWipe([][]byte{{0x00}, {0xff}, nil}). Empty patterns are skipped. The patterns are copied, so they can be changed afterwards without affecting the strategy.
+*/
+func MultiPassWipe(patterns [][]byte) WipeStrategy {
+	p := make(multiPassWipe, len(patterns))
+	for i := range patterns {
+		if patterns[i] != nil {
+			p[i] = append([]byte{}, patterns[i]...)
+		}
+	}
+	return p
+}
+
+// zeroWipe implements ZeroWipe. The final pass of zeroes does all of the work.
+type zeroWipe struct{}
+
+func (zeroWipe) Wipe(b []byte) {}
+
+// randomWipe implements RandomWipe.
+type randomWipe struct{}
+
+func (randomWipe) Wipe(b []byte) {
+	fillRandBytes(b)
+}
+
+// multiPassWipe implements MultiPassWipe. A nil pattern stands for a pass of random bytes.
+type multiPassWipe [][]byte
+
+func (m multiPassWipe) Wipe(b []byte) {
+	for _, pattern := range m {
+		switch {
+		case pattern == nil:
+			fillRandBytes(b)
+		case len(pattern) > 0 && len(b) > 0:
+			// Fill in the first copy of the pattern and then keep doubling it.
+			n := copy(b, pattern)
+			for n < len(b) {
+				n += copy(b[n:], b[:n])
+			}
+		}
+
+		// Make sure that each pass reaches memory before the next one starts.
+		atomic.StoreUint32(&wipeBarrier, 0)
+	}
+}
+
+/*
+SetWipeStrategy chooses how the memory of LockedBuffers is overwritten from now on. Calling SetWipeStrategy with nil restores the default, ZeroWipe.
+
+WipeBytes, and the wiping of temporary copies inside memguard, are not affected; they always use a single pass of zeroes.
+*/
+func SetWipeStrategy(s WipeStrategy) {
+	wipeStrategyMutex.Lock()
+	defer wipeStrategyMutex.Unlock()
+
+	if s == nil {
+		s = ZeroWipe
+	}
+	wipeStrategy = s
+}
+
+// Get the WipeStrategy to use.
+func getWipeStrategy() WipeStrategy {
+	wipeStrategyMutex.Lock()
+	defer wipeStrategyMutex.Unlock()
+
+	return wipeStrategy
+}
+
+// Wipe the memory of a LockedBuffer with the WipeStrategy, followed by a pass of zeroes.
+func wipeSecret(buf []byte) {
+	getWipeStrategy().Wipe(buf)
+	wipeBytes(buf)
+}